@@ -50,8 +50,61 @@ type HarborSyncSpec struct {
 	// if the robot account changes (e..g automatic rotation, expired account, disabled...)
 	// +optional
 	Webhook []WebhookConfig `json:"webhook,omitempty"`
+
+	// DeletionPolicy specifies what happens with secrets that are no longer desired,
+	// e.g. because a mapping or project has been removed or the HarborSync is deleted.
+	// Valid values are:
+	// - "Delete" (default): delete the secrets;
+	// - "Retain": keep the secrets but remove the owner label. They are not managed anymore;
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// RobotDeletionPolicy specifies what happens with the robot accounts in Harbor
+	// once the HarborSync is deleted.
+	// Valid values are:
+	// - "Retain" (default): keep the robot accounts and their credentials;
+	// - "Delete": delete the robot accounts and their credentials;
+	// +optional
+	RobotDeletionPolicy DeletionPolicy `json:"robotDeletionPolicy,omitempty"`
+
+	// MaxProjects limits the number of projects the HarborSync may match.
+	// If more projects match, no robot accounts and secrets are reconciled
+	// until the limit is raised. Defaults to the limit of the controller.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxProjects int `json:"maxProjects,omitempty"`
+
+	// Rotation configures how robot accounts are rotated. If omitted,
+	// all robot accounts which are due are rotated at once without verification.
+	// +optional
+	Rotation *RotationStrategy `json:"rotation,omitempty"`
+}
+
+// RotationStrategy rotates robot accounts in stages. The canary projects are rotated first,
+// the new credentials are verified with a login at the harbor registry.
+// The remaining projects are rotated only if the verification succeeded.
+// Credentials which fail the verification are not written into secrets.
+type RotationStrategy struct {
+	// CanaryPercent is the percentage of the projects due for rotation
+	// which are rotated first. At least one project is rotated first. Defaults to 0.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	CanaryPercent int `json:"canaryPercent,omitempty"`
 }
 
+// DeletionPolicy specifies what happens with resources that are no longer desired
+// +kubebuilder:validation:Enum=Delete;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes resources that are no longer desired
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+
+	// DeletionPolicyRetain keeps resources that are no longer desired
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
 // ProjectMatchingType specifies the type of matching to be done.
 // Only one of the following matching types may be specified.
 // If none of the following types is specified, the default one
@@ -70,8 +123,94 @@ type ProjectMapping struct {
 	Namespace string      `json:"namespace"`
 	Secret    string      `json:"secret"`
 	Type      MappingType `json:"type"`
+
+	// ServiceAccounts specifies the ServiceAccounts in the target namespace
+	// which should reference the secret in their imagePullSecrets.
+	// The secret is removed from the ServiceAccounts once the mapping goes away.
+	// +optional
+	ServiceAccounts *ServiceAccountSelector `json:"serviceAccounts,omitempty"`
+
+	// RolloutRestart restarts Deployments, StatefulSets and DaemonSets in the target namespace
+	// which reference the secret once the credentials change.
+	// +optional
+	RolloutRestart *RolloutRestart `json:"rolloutRestart,omitempty"`
+}
+
+// RolloutRestart specifies which workloads should be restarted after the credentials changed
+// and how often that may happen.
+// A workload references a secret if its pod template lists the secret in imagePullSecrets
+// or if its ServiceAccount does.
+type RolloutRestart struct {
+	// Selector restricts the workloads to those matching the label selector.
+	// If omitted, all workloads that reference the secret are restarted.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// MinInterval is the minimum time between two restarts of a workload. Restarts
+	// which are due within that interval are delayed. Defaults to 10m.
+	// +optional
+	MinInterval *metav1.Duration `json:"minInterval,omitempty"`
 }
 
+// ServiceAccountSelector selects ServiceAccounts by name or by label.
+// A ServiceAccount is selected if it matches any of the fields.
+type ServiceAccountSelector struct {
+	// Names is a list of ServiceAccount names, e.g. "default"
+	// +optional
+	Names []string `json:"names,omitempty"`
+
+	// Selector selects ServiceAccounts by their labels
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// ImagePullSecretsAnnotation is set on ServiceAccounts. It contains a comma-separated
+// list of imagePullSecrets which have been added by harbor-sync.
+const ImagePullSecretsAnnotation = "harborsync.io/image-pull-secrets"
+
+const (
+	// OwnerLabel is set on secrets managed by harbor-sync.
+	// It contains the name of the HarborSync which owns the secret.
+	OwnerLabel = "harborsync.io/owner"
+
+	// ProjectAnnotation is set on secrets managed by harbor-sync.
+	// It contains the name of the harbor project.
+	ProjectAnnotation = "harborsync.io/project"
+
+	// Finalizer is set on HarborSyncs. It is removed once the robot accounts,
+	// credentials and secrets have been cleaned up.
+	Finalizer = "harborsync.io/cleanup"
+)
+
+// RecreateRobotsAnnotation acknowledges that robot accounts whose credentials are missing
+// from the store are re-created. It is set to "true" by the user once the reconciliation
+// of a HarborSync has been paused and is removed by harbor-sync after the reconciliation.
+const RecreateRobotsAnnotation = "harborsync.io/recreate-robots"
+
+const (
+	// PausedAnnotation pauses a HarborSync if it is set to "true": robot accounts,
+	// credentials and secrets are not changed until the annotation is removed.
+	PausedAnnotation = "harborsync.io/paused"
+
+	// RotateAtAnnotation contains a timestamp in RFC3339 format. Once it has passed,
+	// the robot accounts of the HarborSync which have been created before are rotated.
+	RotateAtAnnotation = "harborsync.io/rotate-at"
+)
+
+const (
+	// PullSecretChecksumAnnotation is set on the pod template of restarted workloads.
+	// It contains a checksum of the imagePullSecrets managed by harbor-sync which are referenced by the workload.
+	PullSecretChecksumAnnotation = "harborsync.io/pull-secret-checksum"
+
+	// RestartedAtAnnotation is set on the pod template of restarted workloads.
+	// It contains the time of the last restart in RFC3339 format.
+	RestartedAtAnnotation = "harborsync.io/restarted-at"
+
+	// RestartPendingAnnotation is set on a secret if workloads which have never been restarted
+	// could not be restarted after the secret changed. They are restarted with the next reconciliation.
+	RestartPendingAnnotation = "harborsync.io/restart-pending"
+)
+
 // MappingType specifies how to map the project into the namespace/secret
 // Only one of the following matching types may be specified.
 // If none of the following types is specified, the default one
@@ -92,24 +231,319 @@ const (
 type WebhookConfig struct {
 	// Endpoint is a url
 	Endpoint string `json:"endpoint"`
+
+	// Format of the request. JSON sends the WebhookUpdatePayload,
+	// CloudEventsStructured and CloudEventsBinary send a CloudEvents 1.0 event in
+	// structured or binary content mode with the WebhookUpdatePayload as data.
+	// Slack, Mattermost and Teams send a human-readable message to an incoming webhook
+	// of the chat system, the message never contains the token. Defaults to JSON.
+	// +kubebuilder:validation:Enum=JSON;CloudEventsStructured;CloudEventsBinary;Slack;Mattermost;Teams
+	// +optional
+	Format WebhookFormat `json:"format,omitempty"`
+
+	// PayloadMode controls how the credentials of io.harborsync.robot.rotated events are sent.
+	// Full sends the token in cleartext, Redacted omits the token and Encrypted
+	// seals the credentials to the EncryptionKey. Defaults to Full.
+	// +kubebuilder:validation:Enum=Full;Redacted;Encrypted
+	// +optional
+	PayloadMode WebhookPayloadMode `json:"payloadMode,omitempty"`
+
+	// EncryptionKey is the PEM encoded RSA or EC public key of the receiver, it is required
+	// with the payload mode Encrypted. The credentials are encrypted as JWE in compact serialization
+	// with the key management algorithm RSA-OAEP-256 or ECDH-ES+A256KW and the content encryption A256GCM.
+	// +optional
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+
+	// Events is the list of event types which are sent to the webhook.
+	// Defaults to io.harborsync.robot.rotated.
+	// +optional
+	Events []WebhookEventType `json:"events,omitempty"`
+
+	// Headers are added to the request. They may not contain the headers set by harbor-sync:
+	// Content-Type, User-Agent, X-Harbor-Sync-Signature, ce- headers and Authorization if Auth is set.
+	// +optional
+	Headers []WebhookHeader `json:"headers,omitempty"`
+
+	// Auth authenticates the request with credentials from a Secret
+	// +optional
+	Auth *WebhookAuth `json:"auth,omitempty"`
+
+	// SigningSecret references the key of a Secret which contains the HMAC key.
+	// The payload is signed with HMAC-SHA256, the signature is sent
+	// in the X-Harbor-Sync-Signature header as sha256=<hex encoded signature>.
+	// +optional
+	SigningSecret *SecretKeyReference `json:"signingSecret,omitempty"`
+
+	// Timeout of a single request. Defaults to 10s.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// CABundle is a PEM encoded CA bundle which is used to verify the certificate of the endpoint.
+	// Defaults to the system trust store.
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
 }
 
-// WebhookUpdatePayload contains the new credentials of a robot account
+// WebhookFormat is the format of a webhook request
+type WebhookFormat string
+
+const (
+	// JSONWebhookFormat sends the payload as JSON document
+	JSONWebhookFormat WebhookFormat = "JSON"
+
+	// CloudEventsStructuredWebhookFormat sends a CloudEvents 1.0 event in structured content mode:
+	// the event including its attributes is the JSON body of the request
+	CloudEventsStructuredWebhookFormat WebhookFormat = "CloudEventsStructured"
+
+	// CloudEventsBinaryWebhookFormat sends a CloudEvents 1.0 event in binary content mode:
+	// the attributes of the event are sent as ce- headers and the payload is the body of the request
+	CloudEventsBinaryWebhookFormat WebhookFormat = "CloudEventsBinary"
+
+	// SlackWebhookFormat sends a message to a Slack incoming webhook
+	SlackWebhookFormat WebhookFormat = "Slack"
+
+	// MattermostWebhookFormat sends a message to a Mattermost incoming webhook
+	MattermostWebhookFormat WebhookFormat = "Mattermost"
+
+	// TeamsWebhookFormat sends a message card to a Microsoft Teams incoming webhook
+	TeamsWebhookFormat WebhookFormat = "Teams"
+)
+
+// WebhookPayloadMode controls how credentials are sent to a webhook
+type WebhookPayloadMode string
+
+const (
+	// FullPayloadMode sends the token in cleartext
+	FullPayloadMode WebhookPayloadMode = "Full"
+
+	// RedactedPayloadMode omits the token, the receiver is only notified about the rotation
+	RedactedPayloadMode WebhookPayloadMode = "Redacted"
+
+	// EncryptedPayloadMode omits the token and sends the credentials encrypted to the public key of the receiver
+	EncryptedPayloadMode WebhookPayloadMode = "Encrypted"
+)
+
+// WebhookEventType is the type of a webhook event. It is used as CloudEvents type.
+// +kubebuilder:validation:Enum=io.harborsync.robot.rotated;io.harborsync.robot.expiring;io.harborsync.reconcile.failed;io.harborsync.project.matched;io.harborsync.project.unmatched;io.harborsync.secret.deleted
+type WebhookEventType string
+
+const (
+	// RobotRotatedEvent is sent when the credentials of a robot account changed.
+	// The payload is a WebhookUpdatePayload.
+	RobotRotatedEvent WebhookEventType = "io.harborsync.robot.rotated"
+
+	// RobotExpiringEvent is sent when a robot account expires within the rotation interval
+	// and has not been rotated, e.g. because the rotation is held back or deferred by the rate limit
+	RobotExpiringEvent WebhookEventType = "io.harborsync.robot.expiring"
+
+	// ReconcileFailedEvent is sent when the reconciliation of a HarborSync starts failing
+	ReconcileFailedEvent WebhookEventType = "io.harborsync.reconcile.failed"
+
+	// ProjectMatchedEvent is sent when a project starts matching a HarborSync
+	ProjectMatchedEvent WebhookEventType = "io.harborsync.project.matched"
+
+	// ProjectUnmatchedEvent is sent when a project stops matching a HarborSync
+	ProjectUnmatchedEvent WebhookEventType = "io.harborsync.project.unmatched"
+
+	// SecretDeletedEvent is sent when a secret which is no longer desired has been deleted
+	SecretDeletedEvent WebhookEventType = "io.harborsync.secret.deleted"
+)
+
+// WebhookPayloadVersion is the version of the webhook payloads. Fields may be added
+// to a version, removing or changing fields requires a new version.
+const WebhookPayloadVersion = "v1"
+
+// WebhookHeader is a header of a webhook request.
+// Either Value or ValueFrom must be set.
+type WebhookHeader struct {
+	Name string `json:"name"`
+
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// ValueFrom reads the value from a key of a Secret
+	// +optional
+	ValueFrom *SecretKeyReference `json:"valueFrom,omitempty"`
+}
+
+// WebhookAuth authenticates webhook requests.
+// Only one of the fields may be specified.
+type WebhookAuth struct {
+	// Bearer sends the value of the key as bearer token in the Authorization header
+	// +optional
+	Bearer *SecretKeyReference `json:"bearer,omitempty"`
+
+	// Basic uses the keys username and password of the Secret for basic authentication,
+	// e.g. a Secret of type kubernetes.io/basic-auth
+	// +optional
+	Basic *SecretReference `json:"basic,omitempty"`
+}
+
+// SecretReference references a Secret. Only Secrets in the namespace of harbor-sync
+// or in the namespaces allowed with --webhook-secret-namespaces may be referenced.
+type SecretReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// SecretKeyReference references a key of a Secret. Only Secrets in the namespace of harbor-sync
+// or in the namespaces allowed with --webhook-secret-namespaces may be referenced.
+type SecretKeyReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// WebhookUpdatePayload contains the new credentials of a robot account.
+// It is the payload of io.harborsync.robot.rotated events.
 type WebhookUpdatePayload struct {
-	Project     string                 `json:"project"`
-	Credentials RobotAccountCredential `json:"credentials"`
+	// Version of the payload, see WebhookPayloadVersion
+	Version string `json:"version"`
+
+	Type WebhookEventType `json:"type"`
+
+	// HarborSync is the name of the HarborSync which emitted the event
+	HarborSync string `json:"harborSync"`
+
+	Project     string             `json:"project"`
+	Credentials WebhookCredentials `json:"credentials"`
+
+	// Namespaces into which the mappings write the credentials of the project
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// WebhookCredentials are the credentials of a robot account in a WebhookUpdatePayload
+type WebhookCredentials struct {
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+
+	// Token is omitted with the payload modes Redacted and Encrypted
+	// +optional
+	Token string `json:"token,omitempty"`
+
+	// Encrypted contains the RobotAccountCredential encrypted as JWE with the payload mode Encrypted
+	// +optional
+	Encrypted string `json:"encrypted,omitempty"`
+}
+
+// WebhookEventPayload is the payload of all events except io.harborsync.robot.rotated.
+// The fields which are set depend on the type of the event.
+type WebhookEventPayload struct {
+	// Version of the payload, see WebhookPayloadVersion
+	Version string `json:"version"`
+
+	Type WebhookEventType `json:"type"`
+
+	// HarborSync is the name of the HarborSync which emitted the event
+	HarborSync string `json:"harborSync"`
+
+	// Project is set for all events except io.harborsync.reconcile.failed
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// RobotAccount is the name of the expiring robot account of io.harborsync.robot.expiring events
+	// +optional
+	RobotAccount string `json:"robotAccount,omitempty"`
+
+	// ExpiresAt is the unix time at which the robot account of io.harborsync.robot.expiring events expires
+	// +optional
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// Namespace and Secret identify the deleted secret of io.harborsync.secret.deleted events
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// +optional
+	Secret string `json:"secret,omitempty"`
+
+	// Error is the reason of io.harborsync.reconcile.failed events
+	// +optional
+	Error string `json:"error,omitempty"`
 }
 
 // HarborSyncStatus defines the observed state of HarborSync
 type HarborSyncStatus struct {
+	// ObservedGeneration is the generation of the spec which has last been reconciled
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
 	// +optional
 	LastReconciliation metav1.Time `json:"lastReconciliation,omitempty"`
 
+	// LastRotateAt is the value of the RotateAtAnnotation which has last been reconciled
+	// +optional
+	LastRotateAt string `json:"lastRotateAt,omitempty"`
+
+	// MatchedProjects is the number of projects in the project status
+	// +optional
+	MatchedProjects int `json:"matchedProjects"`
+
+	// FailedProjects is the number of projects whose last reconciliation failed
+	// +optional
+	FailedProjects int `json:"failedProjects"`
+
+	// ManagedSecrets is the number of secrets written by the mappings
+	// +optional
+	ManagedSecrets int `json:"managedSecrets"`
+
+	// FailedSecrets is the number of secrets the mappings failed to write
+	// +optional
+	FailedSecrets int `json:"failedSecrets,omitempty"`
+
 	// +optional
 	ProjectList []ProjectStatus `json:"projectStatus,omitempty"`
 
 	// +optional
 	Conditions []HarborSyncStatusCondition `json:"conditions,omitempty"`
+
+	// WebhookDeliveries contains the webhook events which have not been delivered yet.
+	// They are retried until they succeed or expire.
+	// +optional
+	WebhookDeliveries []WebhookDelivery `json:"webhookDeliveries,omitempty"`
+}
+
+// WebhookDelivery is a pending webhook event. The credentials are not stored in the event,
+// the current credentials of the project are sent when an io.harborsync.robot.rotated event is delivered.
+type WebhookDelivery struct {
+	// ID of the event. Events which are sent to multiple webhooks share the ID.
+	// +optional
+	ID string `json:"id,omitempty"`
+
+	// Endpoint of the webhook
+	Endpoint string `json:"endpoint"`
+
+	// Type of the event. Defaults to io.harborsync.robot.rotated.
+	// +optional
+	Type WebhookEventType `json:"type,omitempty"`
+
+	// Project the event is about
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// RobotAccount is the name of the robot account whose credentials changed
+	// +optional
+	RobotAccount string `json:"robotAccount,omitempty"`
+
+	// Payload of the event. It is not set for io.harborsync.robot.rotated events,
+	// the credentials are not stored in the status.
+	// +optional
+	Payload *WebhookEventPayload `json:"payload,omitempty"`
+
+	// CreatedAt is the time the credentials changed. Events expire
+	// if they could not be delivered within the expiry of the controller.
+	CreatedAt metav1.Time `json:"createdAt"`
+
+	// Attempts is the number of failed delivery attempts
+	// +optional
+	Attempts int `json:"attempts,omitempty"`
+
+	// NextAttempt is the time of the next delivery attempt
+	// +optional
+	NextAttempt metav1.Time `json:"nextAttempt,omitempty"`
+
+	// LastError is the error of the last delivery attempt
+	// +optional
+	LastError string `json:"lastError,omitempty"`
 }
 
 type ProjectStatus struct {
@@ -117,12 +551,97 @@ type ProjectStatus struct {
 	LastRobotReconciliation metav1.Time `json:"lastRobotReconciliation,omitempty"`
 	// +optional
 	ManagedNamespaces []string `json:"managedNamespaces,omitempty"`
+
+	// RobotAccount is the name of the robot account of the project
+	// +optional
+	RobotAccount string `json:"robotAccount,omitempty"`
+
+	// RobotCreatedAt is the time the robot account has been created
+	// +optional
+	RobotCreatedAt metav1.Time `json:"robotCreatedAt,omitempty"`
+
+	// RobotExpiresAt is the time the robot account expires. It is not set
+	// if the robot account never expires.
+	// +optional
+	RobotExpiresAt metav1.Time `json:"robotExpiresAt,omitempty"`
+
+	// LastRotation is the time the robot account has last been rotated by harbor-sync
+	// +optional
+	LastRotation metav1.Time `json:"lastRotation,omitempty"`
+
+	// LastError is the error of the last reconciliation of the project.
+	// It is empty if the reconciliation succeeded.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// Mappings contains the result of every mapping of the project
+	// +optional
+	Mappings []MappingStatus `json:"mappings,omitempty"`
+
+	// Conditions of the project, e.g. whether the credentials authenticate at the registry
+	// +optional
+	Conditions []HarborSyncStatusCondition `json:"conditions,omitempty"`
+}
+
+// MappingStatus is the result of a mapping for a project
+type MappingStatus struct {
+	Type      MappingType `json:"type"`
+	Namespace string      `json:"namespace"`
+	Secret    string      `json:"secret"`
+
+	// Secrets which have been written, as namespace/name
+	// +optional
+	Secrets []string `json:"secrets,omitempty"`
+
+	// FailedSecrets contains the secrets which could not be written
+	// +optional
+	FailedSecrets []SecretError `json:"failedSecrets,omitempty"`
+
+	// Error of the mapping which does not belong to a single secret,
+	// e.g. the namespaces could not be listed
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// SecretError is a secret which could not be written
+type SecretError struct {
+	// Secret as namespace/name
+	Secret string `json:"secret"`
+	Error  string `json:"error"`
 }
 
 type HarborSyncConditionType string
 
 const (
 	HarborSyncReady HarborSyncConditionType = "Ready"
+
+	// HarborSyncConflict is true if the HarborSync shares robot accounts
+	// or secrets with another HarborSync
+	HarborSyncConflict HarborSyncConditionType = "Conflict"
+
+	// HarborSyncRecreationPaused is true if the credentials of many robot accounts
+	// are missing from the store and harbor-sync waits for the user to acknowledge
+	// that the robot accounts are re-created
+	HarborSyncRecreationPaused HarborSyncConditionType = "RecreationPaused"
+
+	// HarborSyncTooManyMatches is true if more projects match the HarborSync
+	// than allowed by maxProjects
+	HarborSyncTooManyMatches HarborSyncConditionType = "TooManyMatches"
+
+	// HarborSyncRotationFailed is true if new credentials failed the verification.
+	// Rotations of the remaining projects are held back until the credentials pass.
+	HarborSyncRotationFailed HarborSyncConditionType = "RotationFailed"
+
+	// HarborSyncPaused is true if the HarborSync is paused with the PausedAnnotation
+	HarborSyncPaused HarborSyncConditionType = "Paused"
+
+	// ProjectCredentialsValid is a condition of a project. It is true if the stored
+	// credentials of the project authenticated at the registry with the last verification
+	ProjectCredentialsValid HarborSyncConditionType = "CredentialsValid"
+
+	// ProjectRobotExpiring is a condition of a project. It is true if the robot account
+	// expires within the rotation interval and has not been rotated.
+	ProjectRobotExpiring HarborSyncConditionType = "RobotExpiring"
 )
 
 type HarborSyncStatusCondition struct {
@@ -150,6 +669,13 @@ type RobotAccountCredential struct {
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:scope=Cluster
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Projects",type=integer,JSONPath=`.status.matchedProjects`
+// +kubebuilder:printcolumn:name="Failed Projects",type=integer,JSONPath=`.status.failedProjects`
+// +kubebuilder:printcolumn:name="Secrets",type=integer,JSONPath=`.status.managedSecrets`
+// +kubebuilder:printcolumn:name="Failed Secrets",type=integer,JSONPath=`.status.failedSecrets`
+// +kubebuilder:printcolumn:name="Last Reconciliation",type=date,JSONPath=`.status.lastReconciliation`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // HarborSync is the Schema for the harborsyncs API
 type HarborSync struct {
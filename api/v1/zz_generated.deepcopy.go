@@ -22,6 +22,7 @@ limitations under the License.
 package v1
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -188,12 +189,21 @@ func (in *HarborSyncSpec) DeepCopyInto(out *HarborSyncSpec) {
 	if in.Mapping != nil {
 		in, out := &in.Mapping, &out.Mapping
 		*out = make([]ProjectMapping, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 	if in.Webhook != nil {
 		in, out := &in.Webhook, &out.Webhook
 		*out = make([]WebhookConfig, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rotation != nil {
+		in, out := &in.Rotation, &out.Rotation
+		*out = new(RotationStrategy)
+		**out = **in
 	}
 }
 
@@ -225,6 +235,13 @@ func (in *HarborSyncStatus) DeepCopyInto(out *HarborSyncStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.WebhookDeliveries != nil {
+		in, out := &in.WebhookDeliveries, &out.WebhookDeliveries
+		*out = make([]WebhookDelivery, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HarborSyncStatus.
@@ -253,9 +270,44 @@ func (in *HarborSyncStatusCondition) DeepCopy() *HarborSyncStatusCondition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MappingStatus) DeepCopyInto(out *MappingStatus) {
+	*out = *in
+	if in.Secrets != nil {
+		in, out := &in.Secrets, &out.Secrets
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FailedSecrets != nil {
+		in, out := &in.FailedSecrets, &out.FailedSecrets
+		*out = make([]SecretError, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MappingStatus.
+func (in *MappingStatus) DeepCopy() *MappingStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(MappingStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ProjectMapping) DeepCopyInto(out *ProjectMapping) {
 	*out = *in
+	if in.ServiceAccounts != nil {
+		in, out := &in.ServiceAccounts, &out.ServiceAccounts
+		*out = new(ServiceAccountSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RolloutRestart != nil {
+		in, out := &in.RolloutRestart, &out.RolloutRestart
+		*out = new(RolloutRestart)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProjectMapping.
@@ -277,6 +329,23 @@ func (in *ProjectStatus) DeepCopyInto(out *ProjectStatus) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	in.RobotCreatedAt.DeepCopyInto(&out.RobotCreatedAt)
+	in.RobotExpiresAt.DeepCopyInto(&out.RobotExpiresAt)
+	in.LastRotation.DeepCopyInto(&out.LastRotation)
+	if in.Mappings != nil {
+		in, out := &in.Mappings, &out.Mappings
+		*out = make([]MappingStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]HarborSyncStatusCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProjectStatus.
@@ -320,9 +389,176 @@ func (in *RobotAccountStatusCondition) DeepCopy() *RobotAccountStatusCondition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RolloutRestart) DeepCopyInto(out *RolloutRestart) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MinInterval != nil {
+		in, out := &in.MinInterval, &out.MinInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RolloutRestart.
+func (in *RolloutRestart) DeepCopy() *RolloutRestart {
+	if in == nil {
+		return nil
+	}
+	out := new(RolloutRestart)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RotationStrategy) DeepCopyInto(out *RotationStrategy) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RotationStrategy.
+func (in *RotationStrategy) DeepCopy() *RotationStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(RotationStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretError) DeepCopyInto(out *SecretError) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretError.
+func (in *SecretError) DeepCopy() *SecretError {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretError)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretKeyReference) DeepCopyInto(out *SecretKeyReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretKeyReference.
+func (in *SecretKeyReference) DeepCopy() *SecretKeyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretKeyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretReference) DeepCopyInto(out *SecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretReference.
+func (in *SecretReference) DeepCopy() *SecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceAccountSelector) DeepCopyInto(out *ServiceAccountSelector) {
+	*out = *in
+	if in.Names != nil {
+		in, out := &in.Names, &out.Names
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceAccountSelector.
+func (in *ServiceAccountSelector) DeepCopy() *ServiceAccountSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceAccountSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookAuth) DeepCopyInto(out *WebhookAuth) {
+	*out = *in
+	if in.Bearer != nil {
+		in, out := &in.Bearer, &out.Bearer
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+	if in.Basic != nil {
+		in, out := &in.Basic, &out.Basic
+		*out = new(SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookAuth.
+func (in *WebhookAuth) DeepCopy() *WebhookAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WebhookConfig) DeepCopyInto(out *WebhookConfig) {
 	*out = *in
+	if in.Events != nil {
+		in, out := &in.Events, &out.Events
+		*out = make([]WebhookEventType, len(*in))
+		copy(*out, *in)
+	}
+	if in.Headers != nil {
+		in, out := &in.Headers, &out.Headers
+		*out = make([]WebhookHeader, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(WebhookAuth)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SigningSecret != nil {
+		in, out := &in.SigningSecret, &out.SigningSecret
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.CABundle != nil {
+		in, out := &in.CABundle, &out.CABundle
+		*out = make([]byte, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookConfig.
@@ -335,10 +571,87 @@ func (in *WebhookConfig) DeepCopy() *WebhookConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookCredentials) DeepCopyInto(out *WebhookCredentials) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookCredentials.
+func (in *WebhookCredentials) DeepCopy() *WebhookCredentials {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookCredentials)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookDelivery) DeepCopyInto(out *WebhookDelivery) {
+	*out = *in
+	if in.Payload != nil {
+		in, out := &in.Payload, &out.Payload
+		*out = new(WebhookEventPayload)
+		**out = **in
+	}
+	in.CreatedAt.DeepCopyInto(&out.CreatedAt)
+	in.NextAttempt.DeepCopyInto(&out.NextAttempt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookDelivery.
+func (in *WebhookDelivery) DeepCopy() *WebhookDelivery {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookDelivery)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookEventPayload) DeepCopyInto(out *WebhookEventPayload) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookEventPayload.
+func (in *WebhookEventPayload) DeepCopy() *WebhookEventPayload {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookEventPayload)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookHeader) DeepCopyInto(out *WebhookHeader) {
+	*out = *in
+	if in.ValueFrom != nil {
+		in, out := &in.ValueFrom, &out.ValueFrom
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookHeader.
+func (in *WebhookHeader) DeepCopy() *WebhookHeader {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookHeader)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *WebhookUpdatePayload) DeepCopyInto(out *WebhookUpdatePayload) {
 	*out = *in
 	out.Credentials = in.Credentials
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookUpdatePayload.
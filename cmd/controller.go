@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -14,13 +15,20 @@ import (
 
 	"github.com/blang/semver"
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/admission"
 	"github.com/moolen/harbor-sync/pkg/controllers"
 	"github.com/moolen/harbor-sync/pkg/harbor"
 	"github.com/moolen/harbor-sync/pkg/harbor/repository"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 	store "github.com/moolen/harbor-sync/pkg/store/crd"
+	"github.com/moolen/harbor-sync/pkg/util"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 )
 
 var (
@@ -59,6 +67,25 @@ func init() {
 	flags.Duration("requeue-interval", time.Minute*5, "set this to prevent reconciling for a specified time")
 	flags.Bool("leader-elect", true, "enable leader election")
 	flags.String("namespace", "kube-system", "namespace in which harbor-sync runs (used for leader-election)")
+	flags.Bool("pod-webhook", false, "enable the mutating admission webhook which injects imagePullSecrets into pods")
+	flags.String("registry-host", "", "host of the harbor registry used by the pod webhook to recognise harbor images. Defaults to the host of the harbor api endpoint")
+	flags.Int("webhook-port", 9443, "port the webhook server listens on")
+	flags.String("webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "directory that contains the webhook server key and certificate (tls.key and tls.crt)")
+	flags.Int("max-projects", 0, "number of projects a HarborSync may match if it does not specify maxProjects. 0 means unlimited")
+	flags.Float64("missing-credentials-ratio", 0.5, "ratio of robot accounts with missing credentials above which the re-creation of robot accounts is paused. Set to 0 to disable")
+	flags.Int("missing-credentials-min", 5, "minimum number of robot accounts with missing credentials before the re-creation of robot accounts is paused")
+	flags.Duration("credential-verify-interval", 0, "interval in which the stored credentials are verified with a login at the harbor registry. Rejected robot accounts are re-created. 0 disables the verification")
+	flags.Float64("robot-rate-limit", 0, "number of robot accounts that may be created or deleted per minute across all HarborSyncs. Rotating a robot account counts twice. 0 means unlimited")
+	flags.Int("robot-rate-burst", 10, "number of robot accounts that may be created or deleted at once if robot-rate-limit is set. At least 2")
+	flags.Float64("secret-rate-limit", 0, "number of secrets that may be written per minute across all HarborSyncs. 0 means unlimited")
+	flags.Int("secret-rate-burst", 50, "number of secrets that may be written at once if secret-rate-limit is set")
+	flags.String("robot-reaper", "off", "find robot accounts created by harbor-sync that no HarborSync claims anymore. One of: off, report, delete")
+	flags.Duration("robot-reaper-interval", time.Hour, "interval in which the robot reaper runs")
+	flags.Duration("robot-reaper-grace-period", time.Hour*24, "time a robot account must be orphaned before the robot reaper deletes it")
+	flags.String("instance-id", "", "identifier of this installation which is added to the description of the robot accounts. The robot reaper only considers robot accounts of this instance. Defaults to the UID of the kube-system namespace")
+	flags.StringSlice("robot-reaper-legacy-suffixes", nil, "suffixes which HarborSyncs used in the past. Robot accounts without description with these suffixes are reported, but never deleted")
+	flags.Duration("webhook-delivery-expiry", time.Hour*24, "time after which webhook events which could not be delivered are dropped")
+	flags.StringSlice("webhook-secret-namespaces", nil, "namespaces of the secrets which webhooks may reference for headers, authentication and signing. Defaults to the namespace of harbor-sync")
 	viper.BindPFlags(flags)
 	viper.BindEnv("harbor-username", "HARBOR_USERNAME")
 	viper.BindEnv("harbor-password", "HARBOR_PASSWORD")
@@ -72,6 +99,25 @@ func init() {
 	viper.BindEnv("force-sync-interval", "FORCE_SYNC_INTERVAL")
 	viper.BindEnv("rotation-interval", "ROTATION_INTERVAL")
 	viper.BindEnv("requeue-interval", "REQUEUE_INTERVAL")
+	viper.BindEnv("pod-webhook", "POD_WEBHOOK")
+	viper.BindEnv("registry-host", "REGISTRY_HOST")
+	viper.BindEnv("webhook-port", "WEBHOOK_PORT")
+	viper.BindEnv("webhook-cert-dir", "WEBHOOK_CERT_DIR")
+	viper.BindEnv("max-projects", "MAX_PROJECTS")
+	viper.BindEnv("missing-credentials-ratio", "MISSING_CREDENTIALS_RATIO")
+	viper.BindEnv("missing-credentials-min", "MISSING_CREDENTIALS_MIN")
+	viper.BindEnv("credential-verify-interval", "CREDENTIAL_VERIFY_INTERVAL")
+	viper.BindEnv("robot-rate-limit", "ROBOT_RATE_LIMIT")
+	viper.BindEnv("robot-rate-burst", "ROBOT_RATE_BURST")
+	viper.BindEnv("secret-rate-limit", "SECRET_RATE_LIMIT")
+	viper.BindEnv("secret-rate-burst", "SECRET_RATE_BURST")
+	viper.BindEnv("robot-reaper", "ROBOT_REAPER")
+	viper.BindEnv("robot-reaper-interval", "ROBOT_REAPER_INTERVAL")
+	viper.BindEnv("robot-reaper-grace-period", "ROBOT_REAPER_GRACE_PERIOD")
+	viper.BindEnv("robot-reaper-legacy-suffixes", "ROBOT_REAPER_LEGACY_SUFFIXES")
+	viper.BindEnv("instance-id", "INSTANCE_ID")
+	viper.BindEnv("webhook-delivery-expiry", "WEBHOOK_DELIVERY_EXPIRY")
+	viper.BindEnv("webhook-secret-namespaces", "WEBHOOK_SECRET_NAMESPACES")
 	rootCmd.AddCommand(controllerCmd)
 }
 
@@ -92,6 +138,11 @@ var controllerCmd = &cobra.Command{
 			"harbor-poll-interval":  viper.GetDuration("harbor-poll-interval"),
 			"skip-tls-verification": viper.GetDuration("skip-tls-verification"),
 			"harbor-api-debug":      viper.GetDuration("harbor-api-debug"),
+			"pod-webhook":           viper.GetBool("pod-webhook"),
+			"registry-host":         viper.GetString("registry-host"),
+			"robot-reaper":          viper.GetString("robot-reaper"),
+			"robot-rate-limit":      viper.GetFloat64("robot-rate-limit"),
+			"secret-rate-limit":     viper.GetFloat64("secret-rate-limit"),
 		}).Info()
 
 		harborClient, err := harbor.New(
@@ -122,7 +173,8 @@ var controllerCmd = &cobra.Command{
 		leaseDuration := 100 * time.Second
 		renewDeadline := 80 * time.Second
 		retryPeriod := 20 * time.Second
-		mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		restConfig := ctrl.GetConfigOrDie()
+		mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 			Scheme:             scheme,
 			MetricsBindAddress: *metricsAddr,
 			LeaderElection:     viper.GetBool("leader-elect"),
@@ -130,12 +182,27 @@ var controllerCmd = &cobra.Command{
 			LeaseDuration:      &leaseDuration,
 			RenewDeadline:      &renewDeadline,
 			RetryPeriod:        &retryPeriod,
+			Port:               viper.GetInt("webhook-port"),
+			CertDir:            viper.GetString("webhook-cert-dir"),
+			// only the secrets managed by harbor-sync are cached,
+			// other secrets are read from the API server
+			NewCache:              controllers.OwnedSecretsCache(),
+			ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 		})
 		if err != nil {
 			log.Error(err, "unable to start manager")
 			os.Exit(1)
 		}
 
+		// installations which share a harbor must not claim each other's robot accounts
+		instanceID, err := getInstanceID(mgr.GetAPIReader())
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		log.Infof("using instance id %s", instanceID)
+		harborClient.InstanceID = instanceID
+
 		// we want to force reconciliation after a certain interval
 		forceSyncChan := make(chan struct{})
 		go func() {
@@ -155,16 +222,79 @@ var controllerCmd = &cobra.Command{
 			log.Fatal(err, "unable to create store")
 		}
 
+		kubeClient, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			log.Error(err, "unable to create kubernetes client")
+			os.Exit(1)
+		}
+
+		// HarborSyncs are cluster-scoped: webhooks may only reference secrets in trusted namespaces
+		webhookSecretNamespaces := viper.GetStringSlice("webhook-secret-namespaces")
+		if len(webhookSecretNamespaces) == 0 {
+			webhookSecretNamespaces = []string{viper.GetString("namespace")}
+		}
+
+		// rotating a robot account needs two tokens at once
+		robotBurst := viper.GetInt("robot-rate-burst")
+		if robotBurst < 2 {
+			robotBurst = 2
+		}
 		if err = (&controllers.HarborSyncConfigReconciler{
-			CredCache:        crdStore,
-			RotationInterval: viper.GetDuration("rotation-interval"),
-			Client:           mgr.GetClient(),
-			RequeueInterval:  viper.GetDuration("requeue-interval"),
-			Harbor:           harborRepo,
+			CredCache:               crdStore,
+			RotationInterval:        viper.GetDuration("rotation-interval"),
+			Client:                  mgr.GetClient(),
+			RequeueInterval:         viper.GetDuration("requeue-interval"),
+			Harbor:                  harborRepo,
+			RemovedProjects:         harborRepo.Removed(),
+			Registry:                harborClient,
+			VerifyInterval:          viper.GetDuration("credential-verify-interval"),
+			WebhookExpiry:           viper.GetDuration("webhook-delivery-expiry"),
+			WebhookSecretNamespaces: webhookSecretNamespaces,
+			Recorder:                util.CreateEventRecorder(kubeClient, scheme),
+			MaxProjects:             viper.GetInt("max-projects"),
+			MissingCredentialsRatio: viper.GetFloat64("missing-credentials-ratio"),
+			MissingCredentialsMin:   viper.GetInt("missing-credentials-min"),
+			RobotBudget:             ratelimit.NewBudget("robot", viper.GetFloat64("robot-rate-limit"), robotBurst),
+			SecretBudget:            ratelimit.NewBudget("secret", viper.GetFloat64("secret-rate-limit"), viper.GetInt("secret-rate-burst")),
 		}).SetupWithManager(mgr, syncCfgChanges); err != nil {
 			log.Error(err, "unable to create controller")
 			os.Exit(1)
 		}
+		if err = (&controllers.ServiceAccountReconciler{
+			Client: mgr.GetClient(),
+		}).SetupWithManager(mgr); err != nil {
+			log.Error(err, "unable to create service account controller")
+			os.Exit(1)
+		}
+		if viper.GetBool("pod-webhook") {
+			registryHost := viper.GetString("registry-host")
+			if registryHost == "" {
+				registryHost = harborClient.APIBaseURL.Host
+			}
+			mgr.GetWebhookServer().Register("/mutate-v1-pod", &webhook.Admission{
+				Handler: &admission.PodInjector{
+					Client:       mgr.GetClient(),
+					RegistryHost: registryHost,
+				},
+			})
+		}
+		switch reaperMode := viper.GetString("robot-reaper"); reaperMode {
+		case "off":
+		case "report", "delete":
+			mgr.Add(&controllers.RobotReaper{
+				Client:         mgr.GetClient(),
+				Harbor:         harborRepo,
+				CredCache:      crdStore,
+				Interval:       viper.GetDuration("robot-reaper-interval"),
+				GracePeriod:    viper.GetDuration("robot-reaper-grace-period"),
+				Delete:         reaperMode == "delete",
+				LegacySuffixes: viper.GetStringSlice("robot-reaper-legacy-suffixes"),
+				InstanceID:     instanceID,
+			})
+		default:
+			log.Errorf("invalid robot reaper mode: %s", reaperMode)
+			os.Exit(1)
+		}
 		// +kubebuilder:scaffold:builder
 		log.Info("starting manager")
 		mgr.Add(harborRepo)
@@ -192,3 +322,17 @@ func checkHarbor(client *harbor.Client) error {
 	}
 	return nil
 }
+
+// getInstanceID returns the configured instance id.
+// It defaults to the UID of the kube-system namespace which identifies the cluster.
+func getInstanceID(reader client.Reader) (string, error) {
+	if id := viper.GetString("instance-id"); id != "" {
+		return id, nil
+	}
+	var ns corev1.Namespace
+	err := reader.Get(context.Background(), client.ObjectKey{Name: "kube-system"}, &ns)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine the instance id, set --instance-id: %w", err)
+	}
+	return string(ns.UID), nil
+}
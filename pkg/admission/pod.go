@@ -0,0 +1,201 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// MissingPullSecretsAnnotation is set on pods which reference harbor projects
+// for which no synced secret exists in the pod's namespace.
+// It contains a comma-separated list of the project names.
+const MissingPullSecretsAnnotation = "harborsync.io/missing-pull-secrets"
+
+// PodInjector is a mutating admission handler which adds the secrets
+// managed by harbor-sync to the imagePullSecrets of pods
+type PodInjector struct {
+	Client       client.Client
+	RegistryHost string
+	decoder      *admission.Decoder
+}
+
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=pods.harborsync.io,admissionReviewVersions=v1
+
+// Handle adds the imagePullSecrets to the pod
+func (p *PodInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &v1.Pod{}
+	err := p.decoder.Decode(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	projects := ImageProjects(*pod, p.RegistryHost)
+	if len(projects) == 0 {
+		return admission.Allowed("pod does not reference harbor images")
+	}
+
+	var syncConfigs crdv1.HarborSyncList
+	err = p.Client.List(ctx, &syncConfigs)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, fmt.Errorf("unable to list sync configs: %s", err.Error()))
+	}
+
+	var missing []string
+	var warnings []string
+	for _, project := range projects {
+		secrets, err := PullSecretsForProject(p.Client, syncConfigs.Items, req.Namespace, project)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if len(secrets) == 0 {
+			missing = append(missing, project)
+			warnings = append(warnings, fmt.Sprintf("harbor-sync: no pull secret synced for harbor project %s in namespace %s", project, req.Namespace))
+			continue
+		}
+		for _, secret := range secrets {
+			if !containsRef(pod.Spec.ImagePullSecrets, secret) {
+				pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, v1.LocalObjectReference{Name: secret})
+			}
+		}
+	}
+	if len(missing) > 0 {
+		if pod.Annotations == nil {
+			pod.Annotations = make(map[string]string)
+		}
+		pod.Annotations[MissingPullSecretsAnnotation] = strings.Join(missing, ",")
+	}
+
+	log.WithFields(log.Fields{
+		"namespace": req.Namespace,
+		"projects":  projects,
+		"missing":   missing,
+	}).Debug("injecting pull secrets")
+
+	marshaledPod, err := json.Marshal(pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(warnings...)
+}
+
+// InjectDecoder injects the decoder
+func (p *PodInjector) InjectDecoder(d *admission.Decoder) error {
+	p.decoder = d
+	return nil
+}
+
+// ImageProjects returns the sorted list of harbor projects
+// which are referenced by the pod's container images
+func ImageProjects(pod v1.Pod, registryHost string) []string {
+	var images []string
+	for _, c := range pod.Spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range pod.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	var projects []string
+	for _, image := range images {
+		// harbor images have the form: host/project/repository[:tag|@digest]
+		parts := strings.Split(image, "/")
+		if len(parts) < 3 || !strings.EqualFold(parts[0], registryHost) {
+			continue
+		}
+		if !contains(projects, parts[1]) {
+			projects = append(projects, parts[1])
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// PullSecretsForProject returns the names of the secrets that harbor-sync manages
+// for the given project in the namespace. Only existing secrets are returned.
+func PullSecretsForProject(cl client.Client, syncConfigs []crdv1.HarborSync, namespace, project string) ([]string, error) {
+	var secrets []string
+	for _, syncConfig := range syncConfigs {
+		if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+		matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config": syncConfig.ObjectMeta.Name,
+			}).Errorf("error compiling regex: %s", err.Error())
+			continue
+		}
+		if !matcher.MatchString(project) {
+			continue
+		}
+		for _, mapping := range syncConfig.Spec.Mapping {
+			targets, err := reconciler.MappingTargets(mapping, syncConfig, harbor.Project{Name: project}, []string{namespace})
+			if err != nil {
+				log.WithFields(log.Fields{
+					"config": syncConfig.ObjectMeta.Name,
+				}).Error(err)
+				continue
+			}
+			for _, target := range targets {
+				var secret v1.Secret
+				err = cl.Get(context.Background(), target, &secret)
+				if apierrs.IsNotFound(err) {
+					continue
+				}
+				if err != nil {
+					return nil, fmt.Errorf("unable to fetch secret %s: %s", target, err.Error())
+				}
+				if !contains(secrets, target.Name) {
+					secrets = append(secrets, target.Name)
+				}
+			}
+		}
+	}
+	return secrets, nil
+}
+
+func contains(arr []string, el string) bool {
+	for _, a := range arr {
+		if a == el {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRef(refs []v1.LocalObjectReference, name string) bool {
+	for _, ref := range refs {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/test"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PodInjector", func() {
+
+	Describe("ImageProjects", func() {
+		It("should find harbor projects", func() {
+			pod := v1.Pod{
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{
+						{Image: "harbor.example.com/team-b/init:1.0"},
+					},
+					Containers: []v1.Container{
+						{Image: "harbor.example.com/team-a/app:1.0"},
+						{Image: "harbor.example.com/team-a/nested/sidecar@sha256:abc"},
+						{Image: "docker.io/library/nginx:latest"},
+						{Image: "harbor.example.com/no-project"},
+						{Image: "nginx"},
+					},
+				},
+			}
+			Expect(ImageProjects(pod, "harbor.example.com")).To(Equal([]string{"team-a", "team-b"}))
+		})
+	})
+
+	Describe("Handle", func() {
+		ns := "admission-pod"
+		var injector *PodInjector
+
+		BeforeEach(func() {
+			test.EnsureNamespace(k8sClient, ns)
+			mapping := crdv1.ProjectMapping{
+				Type:      crdv1.MatchMappingType,
+				Namespace: ns,
+				Secret:    "$1-pull-token",
+			}
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "admission-cfg", "team-(a|b)", &mapping, nil)
+			err := k8sClient.Create(context.Background(), &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "a-pull-token"},
+			})
+			if !apierrs.IsAlreadyExists(err) {
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			decoder, err := admission.NewDecoder(scheme.Scheme)
+			Expect(err).ToNot(HaveOccurred())
+			injector = &PodInjector{Client: k8sClient, RegistryHost: "harbor.example.com"}
+			Expect(injector.InjectDecoder(decoder)).To(Succeed())
+		})
+
+		handle := func(pod v1.Pod) admission.Response {
+			raw, err := json.Marshal(pod)
+			Expect(err).ToNot(HaveOccurred())
+			return injector.Handle(context.Background(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Namespace: ns,
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+		}
+
+		It("should inject synced secrets", func() {
+			res := handle(v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app"},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "app", Image: "harbor.example.com/team-a/app:1.0"}},
+				},
+			})
+			Expect(res.Allowed).To(BeTrue())
+			Expect(res.Warnings).To(BeEmpty())
+			Expect(res.Patches).To(HaveLen(1))
+			Expect(res.Patches[0].Path).To(Equal("/spec/imagePullSecrets"))
+			Expect(res.Patches[0].Value).To(Equal([]interface{}{
+				map[string]interface{}{"name": "a-pull-token"},
+			}))
+		})
+
+		It("should annotate pods with missing secrets", func() {
+			res := handle(v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app"},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "b", Image: "harbor.example.com/team-b/app:1.0"},
+						{Name: "c", Image: "harbor.example.com/team-c/app:1.0"},
+					},
+				},
+			})
+			Expect(res.Allowed).To(BeTrue())
+			Expect(res.Warnings).To(HaveLen(2))
+			Expect(res.Patches).To(HaveLen(1))
+			Expect(res.Patches[0].Path).To(Equal("/metadata/annotations"))
+			Expect(res.Patches[0].Value).To(Equal(map[string]interface{}{
+				MissingPullSecretsAnnotation: "team-b,team-c",
+			}))
+		})
+
+		It("should ignore pods without harbor images", func() {
+			res := handle(v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app"},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "app", Image: "nginx"}},
+				},
+			})
+			Expect(res.Allowed).To(BeTrue())
+			Expect(res.Patches).To(BeEmpty())
+		})
+	})
+})
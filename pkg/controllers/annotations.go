@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+// isPaused returns true if the sync config is paused with the PausedAnnotation
+func isPaused(syncConfig crdv1.HarborSync) bool {
+	return syncConfig.Annotations[crdv1.PausedAnnotation] == "true"
+}
+
+// rotateBefore returns the time of the RotateAtAnnotation once it has passed: the robot accounts
+// which have been created before are rotated. Otherwise it returns a zero time and the duration
+// until the time passes. An error is returned if the annotation is not a RFC3339 timestamp.
+func rotateBefore(syncConfig crdv1.HarborSync, now time.Time) (time.Time, time.Duration, error) {
+	value, ok := syncConfig.Annotations[crdv1.RotateAtAnnotation]
+	if !ok {
+		return time.Time{}, 0, nil
+	}
+	rotateAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid timestamp in annotation %s: %s", crdv1.RotateAtAnnotation, err.Error())
+	}
+	if rotateAt.After(now) {
+		return time.Time{}, rotateAt.Sub(now), nil
+	}
+	return rotateAt, 0, nil
+}
+
+// earlier returns the shorter of the durations, 0 is ignored
+func earlier(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
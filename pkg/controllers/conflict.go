@@ -0,0 +1,175 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// conflict is a robot account or a secret which
+// is managed by the sync config and another one
+type conflict struct {
+	other string
+
+	// project is set if both configs manage the robot account in the project
+	project string
+
+	// refused is true if the sync config does not manage the robot account
+	// because the other config takes precedence
+	refused bool
+
+	// secret is set if both configs write the secret
+	secret types.NamespacedName
+}
+
+func (c conflict) String() string {
+	if c.project != "" && c.refused {
+		return fmt.Sprintf("robot account in project %s is managed by HarborSync %s with the same or an overlapping suffix: not managing it", c.project, c.other)
+	}
+	if c.project != "" {
+		return fmt.Sprintf("robot account in project %s is also managed by HarborSync %s with the same or an overlapping suffix", c.project, c.other)
+	}
+	return fmt.Sprintf("secret %s is also written by HarborSync %s", c.secret, c.other)
+}
+
+// findConflicts returns the robot accounts and secrets that the sync config shares with other configs.
+// Of two configs that manage the same robot account the older one takes precedence, this includes
+// configs whose suffixes overlap, see reconciler.SuffixesOverlap.
+// Secrets are written by the config which owns them, see reconciler.ConflictError.
+func (r *HarborSyncConfigReconciler) findConflicts(syncConfig crdv1.HarborSync, matches []harbor.Project, namespaces []v1.Namespace) ([]conflict, error) {
+	var syncConfigs crdv1.HarborSyncList
+	err := r.List(context.Background(), &syncConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sync configs: %s", err.Error())
+	}
+	desired, err := reconciler.DesiredSecrets(syncConfig, matches, namespaces)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []conflict
+	for _, other := range syncConfigs.Items {
+		if other.ObjectMeta.Name == syncConfig.ObjectMeta.Name || !other.ObjectMeta.DeletionTimestamp.IsZero() {
+			continue
+		}
+		otherMatches, err := findMatches(other, r.Harbor, r.MaxProjects)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config": other.ObjectMeta.Name,
+			}).Errorf("unable to find matches: %s", err.Error())
+			continue
+		}
+		if reconciler.SuffixesOverlap(other.Spec.RobotAccountSuffix, syncConfig.Spec.RobotAccountSuffix) {
+			for _, project := range matches {
+				if !containsProject(otherMatches, project) {
+					continue
+				}
+				conflicts = append(conflicts, conflict{
+					other:   other.ObjectMeta.Name,
+					project: project.Name,
+					refused: takesPrecedence(other, syncConfig),
+				})
+			}
+		}
+		otherDesired, err := reconciler.DesiredSecrets(other, otherMatches, namespaces)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config": other.ObjectMeta.Name,
+			}).Error(err)
+			continue
+		}
+		for _, secret := range desired {
+			if containsSecret(otherDesired, secret) {
+				conflicts = append(conflicts, conflict{
+					other:  other.ObjectMeta.Name,
+					secret: secret,
+				})
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// refusedProjects returns the projects in which the sync config
+// does not manage the robot account because of a conflict
+func refusedProjects(conflicts []conflict) []string {
+	var projects []string
+	for _, c := range conflicts {
+		if c.refused {
+			projects = append(projects, c.project)
+		}
+	}
+	return projects
+}
+
+// conflictMessage returns a message which describes the conflicts
+func conflictMessage(conflicts []conflict) string {
+	var msgs []string
+	for _, c := range conflicts {
+		if !contains(msgs, c.String()) {
+			msgs = append(msgs, c.String())
+		}
+	}
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
+
+// takesPrecedence returns true if config a takes precedence over config b:
+// the older config wins, the name decides if both have been created at the same time
+func takesPrecedence(a, b crdv1.HarborSync) bool {
+	if !a.ObjectMeta.CreationTimestamp.Equal(&b.ObjectMeta.CreationTimestamp) {
+		return a.ObjectMeta.CreationTimestamp.Before(&b.ObjectMeta.CreationTimestamp)
+	}
+	return a.ObjectMeta.Name < b.ObjectMeta.Name
+}
+
+func containsProject(projects []harbor.Project, project harbor.Project) bool {
+	for _, p := range projects {
+		if p.Name == project.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsSecret(secrets []types.NamespacedName, secret types.NamespacedName) bool {
+	for _, s := range secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(arr []string, el string) bool {
+	for _, a := range arr {
+		if a == el {
+			return true
+		}
+	}
+	return false
+}
@@ -17,27 +17,34 @@ limitations under the License.
 package controllers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
 	"regexp"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 	"github.com/moolen/harbor-sync/pkg/reconciler"
 )
 
@@ -48,19 +55,80 @@ type HarborSyncConfigReconciler struct {
 	RequeueInterval  time.Duration
 	CredCache        reconciler.CredentialStore
 	Harbor           harbor.API
+
+	// RemovedProjects receives the projects which have been removed from harbor.
+	// Their credentials are deleted and the affected sync configs are reconciled.
+	RemovedProjects <-chan harbor.Project
+
+	// MaxProjects is the number of projects a sync config may match
+	// if it does not specify maxProjects. 0 means unlimited.
+	MaxProjects int
+
+	// MissingCredentialsRatio is the ratio of robot accounts with missing credentials
+	// above which the re-creation of robot accounts is paused. 0 disables the safeguard.
+	MissingCredentialsRatio float64
+
+	// MissingCredentialsMin is the minimum number of robot accounts with missing credentials
+	// before the re-creation of robot accounts is paused
+	MissingCredentialsMin int
+
+	// Registry verifies new credentials of sync configs which stage the rotation
+	// and the stored credentials every VerifyInterval
+	Registry harbor.Registry
+
+	// VerifyInterval is the interval in which the stored credentials are verified
+	// with a login at the registry. 0 disables the verification.
+	VerifyInterval time.Duration
+
+	// WebhookExpiry is the time after which webhook events which could not be delivered
+	// are dropped. Defaults to 24h.
+	WebhookExpiry time.Duration
+
+	// WebhookSecretNamespaces contains the namespaces of the secrets which webhooks may reference
+	// for headers, authentication and signing. Secrets in other namespaces are not read.
+	WebhookSecretNamespaces []string
+
+	// Recorder records Kubernetes Events on the sync configs and on the secrets they write.
+	// A nil Recorder records nothing.
+	Recorder record.EventRecorder
+
+	// RobotBudget limits the creation and deletion of robot accounts
+	// and SecretBudget limits the writes of secrets. A nil budget is unlimited.
+	RobotBudget  *ratelimit.Budget
+	SecretBudget *ratelimit.Budget
+
+	// forceSync contains the names of sync configs which
+	// must be reconciled regardless of the last reconciliation
+	forceSync sync.Map
+
+	// pendingRestores contains the owned secrets which have been modified or deleted, see syncConfigForSecret
+	pendingRestores sync.Map
+
+	// credentialChecks contains the CredentialsValid conditions
+	// of the projects of each sync config from the last verification
+	credentialChecks sync.Map
+
+	// credentialRejections contains the number of consecutive verifications
+	// whose credentials have been rejected per project of each sync config
+	credentialRejections sync.Map
+
+	// recreateProjects contains the projects of each sync config whose robot accounts
+	// are re-created with the next reconciliation, see verify
+	recreateProjects sync.Map
 }
 
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=create;get;update;watch
 // +kubebuilder:rbac:groups="coordination.k8s.io",resources=leases,verbs=create;get;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups="",resources=events,verbs=create
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="apps",resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
 // +kubebuilder:rbac:groups=crd.harborsync.io,resources=harborrobotaccounts,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=crd.harborsync.io,resources=harborsyncs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=crd.harborsync.io,resources=harborsyncs/status,verbs=get;update;patch
 
 // Reconcile reconciles the desired state in the cluster
-func (r *HarborSyncConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *HarborSyncConfigReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, reterr error) {
 	var syncConfig crdv1.HarborSync
 	if err := r.Get(ctx, req.NamespacedName, &syncConfig); err != nil {
 		if apierrs.IsNotFound(err) {
@@ -71,69 +139,408 @@ func (r *HarborSyncConfigReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{RequeueAfter: time.Second * 15}, err
 	}
 
+	// the projects are unknown until harbor has been synced after a restart.
+	// Reconciling with an empty project list would collect the secrets of all projects
+	if !harbor.HasSynced(r.Harbor) {
+		log.Info("waiting for the harbor projects to be synced")
+		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	}
+
+	if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() {
+		if isPaused(syncConfig) {
+			log.Infof("clean up is paused until the annotation %s is removed", crdv1.PausedAnnotation)
+			return ctrl.Result{}, nil
+		}
+		err := r.finalize(&syncConfig)
+		if err != nil {
+			log.Error(err, "unable to clean up sync config")
+			return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(&syncConfig, crdv1.Finalizer) {
+		controllerutil.AddFinalizer(&syncConfig, crdv1.Finalizer)
+		if err := r.Update(ctx, &syncConfig); err != nil {
+			log.Error(err, "unable to add finalizer")
+			return ctrl.Result{RequeueAfter: time.Second * 15}, err
+		}
+	}
+
+	// the status is only written if it differs from the original
+	original := syncConfig.DeepCopy()
+	wasFailing := isFailing(syncConfig.Status)
+	// skipped is set if the sync config has not been reconciled
+	var skipped bool
 	defer func() {
-		err := r.Status().Update(context.Background(), &syncConfig)
+		if !skipped {
+			syncConfig.Status.ObservedGeneration = syncConfig.Generation
+		}
+		enqueueFailure(&syncConfig, wasFailing)
+		summarizeStatus(&syncConfig.Status)
+		if c := GetSyncCondition(syncConfig.Status, crdv1.HarborSyncReady); !skipped && c != nil && c.Status == v1.ConditionFalse {
+			recordEvent(r.Recorder, &syncConfig, v1.EventTypeWarning, reasonReconcileFailed, "%s: %s", c.Reason, c.Message)
+		}
+		r.applyCredentialChecks(&syncConfig)
+		err := r.patchStatus(original.Status, &syncConfig)
 		if err != nil {
+			// the webhook events of this reconciliation are only kept in memory,
+			// the reconciliation is repeated instead of sending them without persisting them
 			log.Errorf("unable to update status: %s", err.Error())
+			result, reterr = ctrl.Result{}, fmt.Errorf("unable to update status: %s", err.Error())
+			return
+		}
+		// webhook events are sent after they have been persisted
+		persisted := syncConfig.Status.DeepCopy()
+		if r.deliverWebhooks(&syncConfig) {
+			err = r.patchStatus(*persisted, &syncConfig)
+			if err != nil {
+				log.Errorf("unable to update webhook deliveries: %s", err.Error())
+			}
 		}
 	}()
 
-	// return early if cr has been updated recently
-	if !shouldReconcile(syncConfig) {
+	if isPaused(syncConfig) {
+		log.Infof("skipping reconciliation, the sync config is paused")
+		skipped = true
+		c := NewSyncCondition(crdv1.HarborSyncPaused, v1.ConditionTrue, "Paused",
+			fmt.Sprintf("robot accounts and secrets are not changed until the annotation %s is removed", crdv1.PausedAnnotation))
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{}, nil
+	}
+	c := NewSyncCondition(crdv1.HarborSyncPaused, v1.ConditionFalse, "Not paused", "Not paused")
+	SetSyncCondition(&syncConfig.Status, *c)
+
+	// robot accounts created before the time of the rotate-at annotation are rotated
+	rotateAt, rotateWait, err := rotateBefore(syncConfig, time.Now())
+	if err != nil {
+		log.Warn(err)
+		recordEvent(r.Recorder, &syncConfig, v1.EventTypeWarning, reasonInvalidAnnotation, err.Error())
+	}
+	rotationRequested := !rotateAt.IsZero() && syncConfig.Annotations[crdv1.RotateAtAnnotation] != syncConfig.Status.LastRotateAt
+
+	// return early if cr has been reconciled recently, unless the spec changed
+	// or a rotation has been requested since
+	_, forced := r.forceSync.LoadAndDelete(req.Name)
+	specChanged := syncConfig.Status.ObservedGeneration != syncConfig.Generation
+	// modified secrets are restored by the full reconciliation as well
+	restores := r.takePendingRestores(req.Name)
+	if !forced && !specChanged && !rotationRequested && !shouldReconcile(syncConfig) {
+		if len(restores) > 0 {
+			err := r.restoreSecrets(syncConfig, restores)
+			if err != nil {
+				log.Errorf("%s, reconciling the sync config", err.Error())
+				r.forceSync.Store(req.Name, struct{}{})
+				skipped = true
+				return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+			}
+		}
 		log.Infof("skipping reconciliation")
+		skipped = true
+		return ctrl.Result{RequeueAfter: earlier(r.RequeueInterval, rotateWait)}, nil
+	}
+
+	matches, err := findMatches(syncConfig, r.Harbor, r.MaxProjects)
+	var tooManyErr *tooManyMatchesError
+	if errors.As(err, &tooManyErr) {
+		log.Error(err)
+		c := NewSyncCondition(crdv1.HarborSyncTooManyMatches, v1.ConditionTrue, "Too many matches", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
+		c = NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Too many matches", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
 		return ctrl.Result{RequeueAfter: r.RequeueInterval}, nil
 	}
+	if err != nil {
+		log.Error(err)
+		c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Error Reconciling", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	c = NewSyncCondition(crdv1.HarborSyncTooManyMatches, v1.ConditionFalse, "Matches within limit", fmt.Sprintf("%d projects match", len(matches)))
+	SetSyncCondition(&syncConfig.Status, *c)
+	var nsList v1.NamespaceList
+	err = r.List(ctx, &nsList)
+	if err != nil {
+		log.Error(err, "unable to list namespaces")
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	conflicts, err := r.findConflicts(syncConfig, matches, nsList.Items)
+	if err != nil {
+		log.Error(err)
+		c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Error Reconciling", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	refused := refusedProjects(conflicts)
+	paused, err := r.pausedProjects(&syncConfig, excludeProjects(matches, refused))
+	if err != nil {
+		log.Error(err)
+		c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Error Reconciling", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+
+	// deferred is set if changes have been deferred by a rate limit
+	var deferred *ratelimit.DeferredError
+
+	// mappingErrs contains the errors of the mappings of all projects
+	var mappingErrs []string
+
+	// restartAfter is the time until delayed restarts of workloads are due
+	var restartAfter time.Duration
 
 	// mappingFunc calls the Kubernetes-specific mapping functions
+	// and adds their results to the project status
 	mappingFunc := func(
 		mapping crdv1.ProjectMapping,
-		syncConfig crdv1.HarborSync,
+		cfg crdv1.HarborSync,
 		project harbor.Project,
 		credential *crdv1.RobotAccountCredential,
 		baseURL string) {
 		f, err := reconciler.MappingFuncForConfig(mapping)
 		if err != nil {
 			log.Error(err, "failed to get mapping for config")
+			setMappingStatus(&syncConfig.Status, project, mapping, reconciler.MappingResult{}, err)
+			mappingErrs = append(mappingErrs, fmt.Sprintf("project %s: %s", project.Name, err.Error()))
+			return
+		}
+		cl := newRecordingClient(ratelimit.NewClient(r.Client, r.SecretBudget), r.Recorder, cfg.ObjectMeta.Name)
+		result, err := f(cl, mapping, cfg, project, *credential, baseURL)
+		setMappingStatus(&syncConfig.Status, project, mapping, result, err)
+		restartAfter = earlier(restartAfter, result.RestartAfter)
+		var deferredErr *ratelimit.DeferredError
+		if errors.As(err, &deferredErr) {
+			log.Info(err)
+			deferred = laterDeferral(deferred, deferredErr)
+			return
+		}
+		var conflictErr *reconciler.ConflictError
+		if errors.As(err, &conflictErr) {
+			log.Warn(err)
+			for _, c := range conflictErr.Conflicts {
+				conflicts = append(conflicts, conflict{other: c.Owner, secret: c.Secret})
+			}
 			return
 		}
-		err = f(r, mapping, syncConfig, project, *credential, baseURL)
 		if err != nil {
-			c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Mapping failed", err.Error())
 			log.Error(err, "mapping failed")
-			SetSyncCondition(&syncConfig.Status, *c)
+			recordEvent(r.Recorder, &syncConfig, v1.EventTypeWarning, reasonMappingFailed, "Mapping of project %s failed: %s", project.Name, err.Error())
+			mappingErrs = append(mappingErrs, fmt.Sprintf("project %s: %s", project.Name, err.Error()))
 			return
 		}
 	}
-	err := Reconcile(&syncConfig, r.Harbor, r.CredCache, r.RotationInterval, mappingFunc)
+	var recreate []string
+	if val, ok := r.recreateProjects.LoadAndDelete(req.Name); ok {
+		recreate = val.([]string)
+	}
+	err = Reconcile(&syncConfig, matches, ReconcileOptions{
+		Harbor:           r.Harbor,
+		Store:            r.CredCache,
+		Registry:         r.Registry,
+		Recorder:         r.Recorder,
+		RotationInterval: r.RotationInterval,
+		RotateBefore:     rotateAt,
+		RobotBudget:      r.RobotBudget,
+		Excluded:         append(paused, refused...),
+		Recreate:         recreate,
+	}, mappingFunc)
+	var deferredErr *ratelimit.DeferredError
+	if errors.As(err, &deferredErr) {
+		deferred = laterDeferral(deferred, deferredErr)
+		err = nil
+	}
+	if restartAfter > 0 {
+		// the delayed restarts are performed with the next reconciliation, it must not be skipped
+		log.Infof("restarts of workloads have been delayed, reconciling again in %s", restartAfter.Round(time.Second))
+		r.forceSync.Store(req.Name, struct{}{})
+	}
 	if err != nil {
 		log.Error(err)
 		c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Error Reconciling", err.Error())
 		SetSyncCondition(&syncConfig.Status, *c)
 		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
 	}
-	c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionTrue, "Successfully reconciled", "Successfully reconciled")
+	if len(conflicts) > 0 {
+		c = NewSyncCondition(crdv1.HarborSyncConflict, v1.ConditionTrue, "Conflicting configs", conflictMessage(conflicts))
+	} else {
+		c = NewSyncCondition(crdv1.HarborSyncConflict, v1.ConditionFalse, "No conflicts", "No conflicts")
+	}
+	SetSyncCondition(&syncConfig.Status, *c)
+	err = r.collectGarbage(&syncConfig, excludeProjects(matches, refused))
+	if err != nil {
+		log.Error(err)
+		c := NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Garbage collection failed", err.Error())
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	if deferred != nil {
+		// keep the recreate annotation until all robot accounts have been recreated
+		log.Infof("changes have been deferred by the rate limit, retrying in %s", deferred.RetryAfter)
+		r.forceSync.Store(req.Name, struct{}{})
+		return ctrl.Result{RequeueAfter: deferred.RetryAfter}, nil
+	}
+	err = r.removeRecreateAnnotation(&syncConfig)
+	if err != nil {
+		log.Error(err)
+		return ctrl.Result{RequeueAfter: time.Second * 15}, nil
+	}
+	if !rotateAt.IsZero() {
+		syncConfig.Status.LastRotateAt = syncConfig.Annotations[crdv1.RotateAtAnnotation]
+	}
+	if len(mappingErrs) > 0 {
+		c = NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionFalse, "Mapping failed", strings.Join(mappingErrs, " | "))
+		SetSyncCondition(&syncConfig.Status, *c)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	c = NewSyncCondition(crdv1.HarborSyncReady, v1.ConditionTrue, "Successfully reconciled", "Successfully reconciled")
 	syncConfig.Status.LastReconciliation = metav1.Now()
 	SetSyncCondition(&syncConfig.Status, *c)
 	log.Info("successfully reconciled")
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: earlier(rotateWait, restartAfter)}, nil
+}
+
+// patchStatus writes the status of the sync config with a merge patch if it differs from the original status.
+// The patch only contains the changed fields of the status and no resourceVersion,
+// so it does not conflict with concurrent changes of the sync config.
+func (r *HarborSyncConfigReconciler) patchStatus(original crdv1.HarborSyncStatus, syncConfig *crdv1.HarborSync) error {
+	if equality.Semantic.DeepEqual(original, syncConfig.Status) {
+		return nil
+	}
+	base := syncConfig.DeepCopy()
+	base.Status = original
+	// transient errors are retried, the status may contain webhook events which are not persisted otherwise
+	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return !apierrs.IsNotFound(err)
+	}, func() error {
+		return r.Status().Patch(context.Background(), syncConfig, client.MergeFrom(base))
+	})
 }
 
 // SetupWithManager setup the controller with the manager and the event input channel
-// the input chan is used to trigger recon based on external events (harbor API resources changed, forced sync)
+// the input chan is used to trigger recon based on external events (harbor API resources changed, forced sync).
+// Owned secrets and namespaces are watched to restore secrets and to sync new namespaces immediately
 func (r *HarborSyncConfigReconciler) SetupWithManager(mgr ctrl.Manager, input <-chan event.GenericEvent) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&crdv1.HarborSync{}).
 		Watches(&source.Channel{Source: input}, &handler.EnqueueRequestForObject{}).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &v1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.syncConfigForSecret),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isOwnedSecret)),
+		).
+		Watches(
+			&source.Kind{Type: &v1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(r.syncConfigsForNamespace),
+			builder.WithPredicates(namespaceCreated),
+		)
+	if r.RemovedProjects != nil {
+		removed := make(chan event.GenericEvent)
+		err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.watchRemovedProjects(ctx, removed)
+		}))
+		if err != nil {
+			return err
+		}
+		b = b.Watches(&source.Channel{Source: removed}, &handler.EnqueueRequestForObject{})
+	}
+	dispatched := make(chan event.GenericEvent)
+	err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return r.dispatchWebhooks(ctx, dispatched)
+	}))
+	if err != nil {
+		return err
+	}
+	b = b.Watches(&source.Channel{Source: dispatched}, &handler.EnqueueRequestForObject{})
+	if r.VerifyInterval > 0 && r.Registry != nil {
+		verified := make(chan event.GenericEvent)
+		err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.verifyCredentials(ctx, verified)
+		}))
+		if err != nil {
+			return err
+		}
+		b = b.Watches(&source.Channel{Source: verified}, &handler.EnqueueRequestForObject{})
+	}
+	return b.Complete(r)
+}
+
+// collectGarbage removes the secrets owned by the sync config which are no longer desired.
+// projects must contain the projects which are managed by the sync config.
+// An event is added to the status and a Kubernetes Event is recorded for every deleted secret.
+// If no project is managed, e.g. because harbor returned an empty project list,
+// the secrets are kept and an error is returned.
+func (r *HarborSyncConfigReconciler) collectGarbage(syncConfig *crdv1.HarborSync, projects []harbor.Project) error {
+	if len(projects) == 0 {
+		var secrets v1.SecretList
+		err := r.List(context.Background(), &secrets, client.MatchingLabels{
+			crdv1.OwnerLabel: syncConfig.ObjectMeta.Name,
+		})
+		if err != nil {
+			return fmt.Errorf("error listing secrets: %s", err.Error())
+		}
+		if len(secrets.Items) > 0 {
+			return fmt.Errorf("refusing to collect all %d secrets: no project matches, delete the secrets manually if the projects have been removed", len(secrets.Items))
+		}
+		return nil
+	}
+	var nsList v1.NamespaceList
+	err := r.List(context.Background(), &nsList)
+	if err != nil {
+		return fmt.Errorf("error listing namespaces: %s", err.Error())
+	}
+	desired, err := reconciler.DesiredSecrets(*syncConfig, projects, nsList.Items)
+	if err != nil {
+		return err
+	}
+	deleted, err := reconciler.GarbageCollectSecrets(r, *syncConfig, desired)
+	enqueueDeletedSecrets(syncConfig, deleted)
+	recordDeletedSecrets(r.Recorder, syncConfig, deleted)
+	return err
+}
+
+// excludeProjects returns the projects whose names are not contained in names
+func excludeProjects(projects []harbor.Project, names []string) []harbor.Project {
+	var out []harbor.Project
+	for _, project := range projects {
+		if !contains(names, project.Name) {
+			out = append(out, project)
+		}
+	}
+	return out
 }
 
-// Reconcile is a Kubernetes-agnostic function that matches the projects,
-// reconciles the robot accounts and calls mappingFunc if specified.
+// ReconcileOptions contains the dependencies and parameters of Reconcile
+type ReconcileOptions struct {
+	Harbor   harbor.API
+	Store    reconciler.CredentialStore
+	Registry harbor.Registry
+	Recorder record.EventRecorder
+
+	RotationInterval time.Duration
+	// RotateBefore is the time before which robot accounts are rotated, see rotateBefore
+	RotateBefore time.Time
+	// RobotBudget limits the changes of robot accounts
+	RobotBudget *ratelimit.Budget
+
+	// Excluded contains the names of the projects which are skipped, e.g. because of a conflict
+	Excluded []string
+	// Recreate contains the names of the projects whose robot accounts are replaced
+	// with reconciler.RotateRobotAccount, the replacement is verified with the registry
+	Recreate []string
+}
+
+// Reconcile is a Kubernetes-agnostic function that reconciles the robot accounts
+// of the matching projects and calls mappingFunc if specified.
+// matches must contain the projects which match the sync config, see findMatches.
+// Changes of robot accounts are limited by the RobotBudget. If changes have been deferred
+// the other projects are reconciled and a *ratelimit.DeferredError is returned.
+// If the sync config specifies a rotation strategy, new credentials are verified with the registry
+// and are not passed to mappingFunc if they fail, see stagedRotation.
+// Webhook events, e.g. for changed credentials, are added to the status, see deliverWebhooks.
 func Reconcile(
 	cfg *crdv1.HarborSync,
-	harbor harbor.API,
-	store reconciler.CredentialStore,
-	rotationInterval time.Duration,
+	matches []harbor.Project,
+	opts ReconcileOptions,
 	mappingFunc func(
 		crdv1.ProjectMapping,
 		crdv1.HarborSync,
@@ -145,67 +552,202 @@ func Reconcile(
 		"config": cfg.ObjectMeta.Name,
 	}).Info("starting reconcile loop")
 	selector := cfg.Spec
-	matches, err := findMatches(*cfg, harbor)
-	if err != nil {
-		return fmt.Errorf("unable to find matches: %s", err.Error())
-	}
 	log.WithFields(log.Fields{
 		"matching_projects": len(matches),
 	}).Info("found matching projects")
-	matchingProjectsGauge.WithLabelValues(
-		cfg.ObjectMeta.Name,
-		string(selector.Type),
-		selector.ProjectName,
-	).Set(float64(len(matches)))
 
-	// reset projectList
+	// deferred is set if robot account changes have been deferred by the rate limit
+	var deferred *ratelimit.DeferredError
+
+	rotation, err := newStagedRotation(cfg, opts.Harbor, opts.Store, opts.Registry, opts.RotationInterval, opts.RotateBefore, excludeProjects(matches, opts.Excluded))
+	if err != nil {
+		return fmt.Errorf("unable to find robot accounts due for rotation: %s", err.Error())
+	}
+
+	// reset projectList, the status of the projects which are not reconciled is kept
+	previous := cfg.Status.ProjectList
 	cfg.Status.ProjectList = []crdv1.ProjectStatus{}
 
+	// rotated contains the projects whose robot accounts changed
+	var rotated []string
+
 	// reconcile robot accounts
-	for _, project := range matches {
-		credential, changed, err := reconciler.ReconcileRobotAccounts(
-			harbor,
-			store,
-			project,
-			selector.RobotAccountSuffix,
-			cfg.Spec.PushAccess,
-			rotationInterval,
-		)
+	for _, project := range rotation.sort(matches) {
+		if contains(opts.Excluded, project.Name) {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Warn("skipping excluded project")
+			continue
+		}
+		var credential *crdv1.RobotAccountCredential
+		var changed bool
+		// verified is set if the new credentials have been verified
+		var verified bool
+		var err error
+		if credential = rotation.hold(project); credential != nil {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Warn("holding back rotation because credentials failed the verification")
+		} else if rotation.staged(project) {
+			credential, err = reconciler.RotateRobotAccount(
+				opts.Harbor,
+				opts.Store,
+				project,
+				selector.RobotAccountSuffix,
+				cfg.Spec.PushAccess,
+				opts.RobotBudget,
+				func(cred crdv1.RobotAccountCredential) error {
+					return rotation.verify(project, &cred)
+				},
+			)
+			changed, verified = err == nil, true
+		} else if contains(opts.Recreate, project.Name) && opts.Registry != nil {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Info("re-creating robot account because the registry rejected its credentials")
+			credential, err = reconciler.RotateRobotAccount(
+				opts.Harbor,
+				opts.Store,
+				project,
+				selector.RobotAccountSuffix,
+				cfg.Spec.PushAccess,
+				opts.RobotBudget,
+				func(cred crdv1.RobotAccountCredential) error {
+					return opts.Registry.Login(cred.Name, cred.Token)
+				},
+			)
+			changed, verified = err == nil, true
+		}
+		// the robot account has been deleted in harbor, it is re-created below
+		if errors.Is(err, reconciler.ErrNoRobotAccount) {
+			err, verified = nil, false
+		}
+		if credential == nil && err == nil {
+			credential, changed, err = reconciler.ReconcileRobotAccounts(
+				opts.Harbor,
+				opts.Store,
+				project,
+				selector.RobotAccountSuffix,
+				cfg.Spec.PushAccess,
+				opts.RotationInterval,
+				opts.RotateBefore,
+				opts.RobotBudget,
+			)
+		}
+		var deferredErr *ratelimit.DeferredError
+		if errors.As(err, &deferredErr) {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Info(err)
+			deferred = laterDeferral(deferred, deferredErr)
+			continue
+		}
+		// the previous robot account is kept if its replacement failed the verification
+		var verificationErr *reconciler.VerificationError
+		if errors.As(err, &verificationErr) {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Errorf("%s, keeping the previous robot account", err.Error())
+			recordEvent(opts.Recorder, cfg, v1.EventTypeWarning, reasonRotationFailed, "Credentials of project %s failed the verification, the previous robot account is kept: %s", project.Name, verificationErr.Err.Error())
+			err = nil
+		}
 		// set last reconciliation
 		if err != nil {
 			log.Error(err, "error reconciling robot accounts")
+			setProjectError(&cfg.Status, previous, project, err)
+			recordEvent(opts.Recorder, cfg, v1.EventTypeWarning, reasonRotationFailed, "Reconciling the robot account of project %s failed: %s", project.Name, err.Error())
 			continue
 		}
 
+		if changed && !verified {
+			err = rotation.verify(project, credential)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"config":  cfg.ObjectMeta.Name,
+					"project": project.Name,
+				}).Errorf("credentials failed the verification: %s", err.Error())
+				recordEvent(opts.Recorder, cfg, v1.EventTypeWarning, reasonRotationFailed, "Credentials of project %s failed the verification: %s", project.Name, err.Error())
+				setProjectError(&cfg.Status, previous, project, err)
+				// the robot account is re-created and verified again with the next reconciliation
+				err = opts.Store.Delete(project.Name, credential.Name)
+				if err != nil {
+					log.Error(err, "could not delete credentials from store")
+				}
+				continue
+			}
+		}
+
 		UpdateProjectStatusLastReconciliation(&cfg.Status, project)
+		setRobotStatus(&cfg.Status, project, *credential, changed)
+		if verificationErr != nil {
+			setProjectError(&cfg.Status, previous, project, verificationErr)
+		}
 
 		if changed {
 			robotChangedCounter.WithLabelValues(cfg.ObjectMeta.Name, project.Name, selector.RobotAccountSuffix).Inc()
+			rotated = append(rotated, project.Name)
+			recordEvent(opts.Recorder, cfg, v1.EventTypeNormal, reasonRobotRotated, "Rotated robot account %s of project %s", credential.Name, project.Name)
 		}
 
 		if changed && len(cfg.Spec.Webhook) > 0 {
 			log.WithFields(log.Fields{
 				"robot_name": credential.Name,
 				"project":    project.Name,
-			}).Info("robot account changed. sending webhook")
-			err = runWebhook(cfg.ObjectMeta.Name, cfg.Spec.Webhook, project, credential)
-			if err != nil {
-				log.Error(err, "error calling webhook")
-			}
+			}).Info("robot account changed. queueing webhook")
+			enqueueRotation(cfg, project, credential)
 		}
 
 		// reconcile secrets in namespaces
 		for _, mapping := range selector.Mapping {
 			if mappingFunc != nil {
-				mappingFunc(mapping, *cfg, project, credential, harbor.BaseURL())
+				mappingFunc(mapping, *cfg, project, credential, opts.Harbor.BaseURL())
 			}
 		}
 	}
+	if c := rotation.condition(deferred != nil); c != nil {
+		SetSyncCondition(&cfg.Status, *c)
+	}
+	keepProjectStatus(&cfg.Status, previous, matches)
+	updateRobotStatus(cfg, opts.Harbor, opts.Store, opts.Recorder, excludeProjects(matches, opts.Excluded), rotated, opts.RotationInterval)
+	enqueueMatchEvents(cfg, opts.Recorder, previous)
+	if deferred != nil {
+		return deferred
+	}
 	return nil
 }
 
-// findMatches filters from a list of projects those projects that match the given syncConfig
-func findMatches(syncConfig crdv1.HarborSync, api harbor.API) ([]harbor.Project, error) {
+// keepProjectConditions copies the conditions and the last rotation of the previous project status
+func keepProjectConditions(status *crdv1.HarborSyncStatus, previous []crdv1.ProjectStatus) {
+	for i, project := range status.ProjectList {
+		for _, p := range previous {
+			if p.Name == project.Name {
+				status.ProjectList[i].Conditions = p.Conditions
+				if status.ProjectList[i].LastRotation.IsZero() {
+					status.ProjectList[i].LastRotation = p.LastRotation
+				}
+				break
+			}
+		}
+	}
+}
+
+// laterDeferral returns the deferral which must be waited for longer
+func laterDeferral(a, b *ratelimit.DeferredError) *ratelimit.DeferredError {
+	if a == nil || (b != nil && b.RetryAfter > a.RetryAfter) {
+		return b
+	}
+	return a
+}
+
+// findMatches filters from a list of projects those projects that match the given syncConfig.
+// It returns a tooManyMatchesError if more projects match than the maxProjects of the syncConfig allow.
+// defaultMaxProjects applies if the syncConfig does not specify maxProjects, 0 means unlimited.
+func findMatches(syncConfig crdv1.HarborSync, api harbor.API, defaultMaxProjects int) ([]harbor.Project, error) {
 	var matchingProjects []harbor.Project
 	allProjects, err := api.ListProjects()
 	if err != nil {
@@ -228,44 +770,24 @@ func findMatches(syncConfig crdv1.HarborSync, api harbor.API) ([]harbor.Project,
 		string(syncConfig.Spec.Type),
 		syncConfig.Spec.ProjectName,
 	).Set(float64(len(matchingProjects)))
+	maxProjects := syncConfig.Spec.MaxProjects
+	if maxProjects == 0 {
+		maxProjects = defaultMaxProjects
+	}
+	if maxProjects > 0 && len(matchingProjects) > maxProjects {
+		return nil, &tooManyMatchesError{matches: len(matchingProjects), max: maxProjects}
+	}
 	return matchingProjects, nil
 }
 
-// runWebhook issues HTTP Requests for the configured webhooks
-func runWebhook(
-	syncConfigName string,
-	webhookCfg []crdv1.WebhookConfig,
-	project harbor.Project,
-	credential *crdv1.RobotAccountCredential,
-) error {
-	payload := crdv1.WebhookUpdatePayload{
-		Project:     project.Name,
-		Credentials: *credential,
-	}
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("failed to encode webhook payload: %s", err.Error())
-	}
-	var errs []string
-	for _, wh := range webhookCfg {
-		req, err := http.NewRequest("POST", wh.Endpoint, bytes.NewReader(data))
-		req.Header.Set("Content-Type", "application/json")
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			webhookCounter.WithLabelValues(syncConfigName, wh.Endpoint, "error").Inc()
-			errs = append(errs, fmt.Sprintf("error sending webhook to %s: %s", wh.Endpoint, err.Error()))
-			continue
-		}
-		webhookCounter.WithLabelValues(syncConfigName, wh.Endpoint, strconv.Itoa(res.StatusCode)).Inc()
-		if res.StatusCode > 300 {
-			errs = append(errs, fmt.Sprintf("unexpected http response code: %d for %s", res.StatusCode, wh.Endpoint))
-			continue
-		}
-	}
-	if len(errs) == 0 {
-		return nil
-	}
-	return fmt.Errorf("webhook errors: %#v", errs)
+// tooManyMatchesError is returned by findMatches if more projects match than allowed
+type tooManyMatchesError struct {
+	matches int
+	max     int
+}
+
+func (e *tooManyMatchesError) Error() string {
+	return fmt.Sprintf("%d projects match, at most %d are allowed: raise maxProjects or change the project name", e.matches, e.max)
 }
 
 func shouldReconcile(syncConfig crdv1.HarborSync) bool {
@@ -18,24 +18,40 @@ package controllers
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"github.com/moolen/harbor-sync/pkg/harbor"
 	harborfake "github.com/moolen/harbor-sync/pkg/harbor/fake"
+	"github.com/moolen/harbor-sync/pkg/harbor/repository"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
 	store "github.com/moolen/harbor-sync/pkg/store/disk"
 	"github.com/moolen/harbor-sync/pkg/test"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	jose "gopkg.in/square/go-jose.v2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 )
 
 const defaultRobotSecretData = `{"auths":{"":{"username":"robot$sync-bot","password":"1234","auth":"cm9ib3Qkc3luYy1ib3Q6MTIzNA=="}}}`
@@ -50,11 +66,11 @@ var _ = Describe("Controller", func() {
 		fakeHarbor = &harborfake.Client{}
 		credStore, _ = store.NewTemp()
 		hscr = &HarborSyncConfigReconciler{
-			k8sClient,
-			time.Hour * 24,
-			time.Second * 15,
-			credStore,
-			fakeHarbor,
+			Client:           k8sClient,
+			RotationInterval: time.Hour * 24,
+			RequeueInterval:  time.Second * 15,
+			CredCache:        credStore,
+			Harbor:           fakeHarbor,
 		}
 	})
 
@@ -62,6 +78,18 @@ var _ = Describe("Controller", func() {
 		credStore.Reset()
 	})
 
+	// deleteSyncConfig deletes the sync config and reconciles it.
+	// The clean up must have finished and the finalizer must have been removed.
+	deleteSyncConfig := func(name string) {
+		test.DeleteHarborSyncConfig(k8sClient, name)
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}
+		_, err := hscr.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		var hs crdv1.HarborSync
+		err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+		Expect(errors.IsNotFound(err)).To(BeTrue(), "sync config %s has not been cleaned up", name)
+	}
+
 	Describe("Reconcile", func() {
 
 		listProjectsResponse := []harbor.Project{
@@ -108,7 +136,7 @@ var _ = Describe("Controller", func() {
 				Secret:    "$1-pull-secret",
 				Type:      crdv1.MatchMappingType,
 			}, nil)
-			defer test.DeleteHarborSyncConfig(k8sClient, "my-rcm-cfg")
+			defer deleteSyncConfig("my-rcm-cfg")
 
 			_, err := hscr.Reconcile(context.Background(), ctrl.Request{
 				NamespacedName: types.NamespacedName{
@@ -182,6 +210,220 @@ var _ = Describe("Controller", func() {
 			}, time.Second*15, time.Second).Should(BeTrue())
 		})
 
+		It("should record Kubernetes events", func() {
+			test.EnsureNamespace(k8sClient, "team-ev-foo")
+			defer test.DeleteNamespace(k8sClient, "team-ev-foo")
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-ev-cfg", "team-(.*)", &crdv1.ProjectMapping{
+				Namespace: "team-ev-$1",
+				Secret:    "pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-ev-cfg")
+			recorder := &testRecorder{}
+			hscr.Recorder = recorder
+
+			_, err := hscr.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{
+					Name: "my-ev-cfg",
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(recorder.reasons("HarborSync", "")).To(ConsistOf(
+				"ProjectMatched", "ProjectMatched", "RobotRotated", "RobotRotated"))
+			Expect(recorder.reasons("Secret", "team-ev-foo")).To(ConsistOf("SecretCreated"))
+			Expect(recorder.events[0].eventtype).To(Equal(v1.EventTypeNormal))
+
+			// a failing reconciliation is recorded as warning
+			recorder.events = nil
+			fakeHarbor.ListProjectsFunc = func() ([]harbor.Project, error) {
+				return nil, fmt.Errorf("harbor is down")
+			}
+			hscr.forceSync.Store("my-ev-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{
+					Name: "my-ev-cfg",
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(recorder.reasons("HarborSync", "")).To(ConsistOf("ReconcileFailed"))
+			Expect(recorder.events[0].eventtype).To(Equal(v1.EventTypeWarning))
+			Expect(recorder.events[0].message).To(ContainSubstring("harbor is down"))
+		})
+
+		It("should report the status of the projects and mappings", func() {
+			test.EnsureNamespace(k8sClient, "team-st-a")
+			test.EnsureNamespace(k8sClient, "team-st-b")
+			defer test.DeleteNamespace(k8sClient, "team-st-a")
+			defer test.DeleteNamespace(k8sClient, "team-st-b")
+			owned := v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "team-st-b",
+					Name:      "foo-pull-secret",
+					Labels:    map[string]string{crdv1.OwnerLabel: "other-cfg"},
+				},
+			}
+			Expect(k8sClient.Create(context.Background(), &owned)).To(Succeed())
+			defer k8sClient.Delete(context.Background(), &owned)
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-st-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-st-.*",
+				Secret:    "$1-pull-secret",
+				Type:      crdv1.MatchMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-st-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-st-cfg"}}
+
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Status.MatchedProjects).To(Equal(1))
+			Expect(hs.Status.FailedProjects).To(Equal(1))
+			Expect(hs.Status.ManagedSecrets).To(Equal(1))
+			Expect(hs.Status.FailedSecrets).To(Equal(1))
+			Expect(GetSyncCondition(hs.Status, crdv1.HarborSyncConflict).Status).To(Equal(v1.ConditionTrue))
+
+			Expect(hs.Status.ProjectList).To(HaveLen(1))
+			project := hs.Status.ProjectList[0]
+			Expect(project.Name).To(Equal("team-foo"))
+			Expect(project.RobotAccount).To(Equal("robot$sync-bot"))
+			Expect(project.RobotCreatedAt.IsZero()).To(BeFalse())
+			Expect(project.RobotExpiresAt.Unix()).To(Equal(getRobotAccountsResponse[0].ExpiresAt))
+			Expect(project.LastRotation.IsZero()).To(BeFalse())
+			Expect(project.LastError).To(ContainSubstring("owned by other-cfg"))
+			Expect(project.ManagedNamespaces).To(Equal([]string{"team-st-a"}))
+			Expect(project.Mappings).To(HaveLen(1))
+			Expect(project.Mappings[0].Type).To(Equal(crdv1.MatchMappingType))
+			Expect(project.Mappings[0].Secrets).To(Equal([]string{"team-st-a/foo-pull-secret"}))
+			Expect(project.Mappings[0].FailedSecrets).To(HaveLen(1))
+			Expect(project.Mappings[0].FailedSecrets[0].Secret).To(Equal("team-st-b/foo-pull-secret"))
+			Expect(project.Mappings[0].Error).To(BeEmpty())
+
+			// the project recovers once the conflicting secret is gone
+			Expect(k8sClient.Delete(context.Background(), &owned)).To(Succeed())
+			hscr.forceSync.Store("my-st-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Status.FailedProjects).To(Equal(0))
+			Expect(hs.Status.ManagedSecrets).To(Equal(2))
+			Expect(hs.Status.FailedSecrets).To(Equal(0))
+			Expect(GetSyncCondition(hs.Status, crdv1.HarborSyncConflict).Status).To(Equal(v1.ConditionFalse))
+			Expect(hs.Status.ProjectList[0].LastError).To(BeEmpty())
+			Expect(hs.Status.ProjectList[0].LastRotation.IsZero()).To(BeFalse())
+		})
+
+		It("should bypass the debounce for spec changes and only write changed status", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-gen-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-gen-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-gen-cfg"}}
+			var created int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+			var hs crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(hs.Status.ObservedGeneration).To(Equal(hs.Generation))
+
+			// the debounce skips the reconciliation and the status is not written
+			resourceVersion := hs.ResourceVersion
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(hs.ResourceVersion).To(Equal(resourceVersion))
+
+			// a spec change is reconciled right away
+			hs.Spec.PushAccess = true
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			Expect(hs.Status.ObservedGeneration).To(BeNumerically("<", hs.Generation))
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(4))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(hs.Status.ObservedGeneration).To(Equal(hs.Generation))
+		})
+
+		It("should not write anything while paused", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-paused-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-paused-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-paused-cfg"}}
+			var hs crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			hs.Annotations = map[string]string{crdv1.PausedAnnotation: "true"}
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			var created int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+
+			hscr.forceSync.Store("my-paused-cfg", struct{}{})
+			res, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.RequeueAfter).To(BeZero())
+			Expect(created).To(Equal(0))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(GetSyncCondition(hs.Status, crdv1.HarborSyncPaused).Status).To(Equal(v1.ConditionTrue))
+			Expect(hs.Status.ObservedGeneration).To(BeZero())
+			Expect(hs.Status.ProjectList).To(BeEmpty())
+
+			// removing the annotation resumes the reconciliation
+			delete(hs.Annotations, crdv1.PausedAnnotation)
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(GetSyncCondition(hs.Status, crdv1.HarborSyncPaused).Status).To(Equal(v1.ConditionFalse))
+			Expect(hs.Status.ObservedGeneration).To(Equal(hs.Generation))
+		})
+
+		It("should rotate robot accounts once the rotate-at annotation passed", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rotate-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-rotate-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rotate-cfg"}}
+			var created int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+
+			// a rotation in the future is requeued and does not bypass the debounce
+			var hs crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			hs.Annotations = map[string]string{crdv1.RotateAtAnnotation: time.Now().Add(time.Hour).Format(time.RFC3339)}
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			res, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+			Expect(res.RequeueAfter).To(BeNumerically("<=", time.Hour))
+
+			// a passed rotation bypasses the debounce once
+			rotateAt := time.Now().Add(-time.Minute).Format(time.RFC3339)
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			hs.Annotations = map[string]string{crdv1.RotateAtAnnotation: rotateAt}
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(4))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(hs.Status.LastRotateAt).To(Equal(rotateAt))
+
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(4))
+		})
+
 		It("should reconcile robot accounts by translating", func() {
 			test.EnsureNamespace(k8sClient, "team-rt-foo")
 			test.EnsureNamespace(k8sClient, "team-rt-bar")
@@ -193,7 +435,7 @@ var _ = Describe("Controller", func() {
 				Secret:    "default-pull-secret",
 				Type:      crdv1.TranslateMappingType,
 			}, nil)
-			defer test.DeleteHarborSyncConfig(k8sClient, "my-rt-cfg")
+			defer deleteSyncConfig("my-rt-cfg")
 			_, err := hscr.Reconcile(context.Background(), ctrl.Request{
 				NamespacedName: types.NamespacedName{
 					Name: "my-rt-cfg",
@@ -253,6 +495,730 @@ var _ = Describe("Controller", func() {
 			}, time.Second*15, time.Second).Should(BeTrue())
 		})
 
+		It("should restore owned secrets", func() {
+			test.EnsureNamespace(k8sClient, "team-rs-foo")
+			defer test.DeleteNamespace(k8sClient, "team-rs-foo")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rs-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-rs-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-rs-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rs-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			var secret v1.Secret
+			key := types.NamespacedName{Namespace: "team-rs-foo", Name: "default-pull-secret"}
+			err = k8sClient.Get(context.Background(), key, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secret.Labels[crdv1.OwnerLabel]).To(Equal("my-rs-cfg"))
+			Expect(secret.Annotations[crdv1.ProjectAnnotation]).To(Equal("team-foo"))
+
+			// modify the secret out-of-band
+			secret.Data[v1.DockerConfigJsonKey] = []byte("{}")
+			err = k8sClient.Update(context.Background(), &secret)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the secret event is mapped to the owner, only the secret is restored
+			Expect(hscr.syncConfigForSecret(&secret)).To(Equal([]ctrl.Request{req}))
+			_, forced := hscr.forceSync.Load("my-rs-cfg")
+			Expect(forced).To(BeFalse())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = k8sClient.Get(context.Background(), key, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(Equal(defaultRobotSecretData))
+			Expect(hscr.takePendingRestores("my-rs-cfg")).To(BeEmpty())
+
+			// delete the secret out-of-band
+			err = k8sClient.Delete(context.Background(), &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hscr.syncConfigForSecret(&secret)).To(Equal([]ctrl.Request{req}))
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = k8sClient.Get(context.Background(), key, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(Equal(defaultRobotSecretData))
+			Expect(secret.Labels[crdv1.OwnerLabel]).To(Equal("my-rs-cfg"))
+		})
+
+		It("should not restore secrets which are no longer desired", func() {
+			test.EnsureNamespace(k8sClient, "team-rs-bar")
+			defer test.DeleteNamespace(k8sClient, "team-rs-bar")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rs-gone-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-rs-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-rs-gone-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rs-gone-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			// a secret event of a secret which is not written by any mapping
+			secret := v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "team-rs-bar",
+					Name:      "default-pull-secret",
+					Labels:    map[string]string{crdv1.OwnerLabel: "my-rs-gone-cfg"},
+				},
+			}
+			Expect(hscr.syncConfigForSecret(&secret)).To(Equal([]ctrl.Request{req}))
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rs-bar", Name: "default-pull-secret"}, &secret)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should enqueue sync configs for namespaces", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-ns-cfg", "team-(.*)", &crdv1.ProjectMapping{
+				Namespace: "team-ns-.*",
+				Secret:    "$1-pull-secret",
+				Type:      crdv1.MatchMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-ns-cfg")
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-other-ns-cfg", "team-(.*)", &crdv1.ProjectMapping{
+				Namespace: "other-.*",
+				Secret:    "$1-pull-secret",
+				Type:      crdv1.MatchMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-other-ns-cfg")
+
+			ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unrelated-ns-foo"}}
+			Expect(hscr.syncConfigsForNamespace(ns)).To(BeEmpty())
+
+			ns = &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-ns-foo"}}
+			Expect(hscr.syncConfigsForNamespace(ns)).To(Equal([]ctrl.Request{
+				{NamespacedName: types.NamespacedName{Name: "my-ns-cfg"}},
+			}))
+			_, forced := hscr.forceSync.Load("my-ns-cfg")
+			Expect(forced).To(BeTrue())
+		})
+
+		It("should clean up when the config is deleted", func() {
+			test.EnsureNamespace(k8sClient, "team-fin-foo")
+			defer test.DeleteNamespace(k8sClient, "team-fin-foo")
+
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-fin-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-fin-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-fin-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.ObjectMeta.Finalizers).To(ContainElement(crdv1.Finalizer))
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+
+			var deletedRobots []string
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deletedRobots = append(deletedRobots, project.Name)
+				return nil
+			}
+			hs.Spec.RobotDeletionPolicy = crdv1.DeletionPolicyDelete
+			Expect(k8sClient.Update(context.Background(), &hs)).To(Succeed())
+			err = k8sClient.Delete(context.Background(), &cfg)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(deletedRobots).To(Equal([]string{"team-foo"}))
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeFalse())
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-fin-foo", Name: "default-pull-secret"}, &secret)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should keep the robot accounts by default when the config is deleted", func() {
+			test.EnsureNamespace(k8sClient, "team-fin-foo")
+			defer test.DeleteNamespace(k8sClient, "team-fin-foo")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-fin-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-fin-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-fin-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+
+			var deletedRobots []string
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deletedRobots = append(deletedRobots, project.Name)
+				return nil
+			}
+			deleteSyncConfig("my-fin-cfg")
+			Expect(deletedRobots).To(BeEmpty())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+			// the secrets are deleted according to the deletion policy
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-fin-foo", Name: "default-pull-secret"}, &secret)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should clean up when a project is removed from harbor", func() {
+			test.EnsureNamespace(k8sClient, "team-rm-foo")
+			defer test.DeleteNamespace(k8sClient, "team-rm-foo")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rm-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-rm-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-rm-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rm-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+
+			// team-foo is deleted in harbor
+			fakeHarbor.ListProjectsFunc = func() ([]harbor.Project, error) {
+				return []harbor.Project{{ID: 2, Name: "team-bar"}}, nil
+			}
+			removed := make(chan harbor.Project)
+			events := make(chan event.GenericEvent)
+			hscr.RemovedProjects = removed
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go hscr.watchRemovedProjects(ctx, events)
+			removed <- harbor.Project{ID: 1, Name: "team-foo"}
+
+			var evt event.GenericEvent
+			Eventually(events).Should(Receive(&evt))
+			Expect(evt.Object.GetName()).To(Equal("my-rm-cfg"))
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeFalse())
+
+			// the reconciliation is not debounced
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rm-foo", Name: "default-pull-secret"}, &secret)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Status.ProjectList).To(BeEmpty())
+		})
+
+		It("should not clean up paused configs when a project is removed from harbor", func() {
+			test.EnsureNamespace(k8sClient, "team-rmp-foo")
+			defer test.DeleteNamespace(k8sClient, "team-rmp-foo")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rmp-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-rmp-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-rmp-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rmp-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			hs.Annotations = map[string]string{crdv1.PausedAnnotation: "true"}
+			err = k8sClient.Update(context.Background(), &hs)
+			Expect(err).ToNot(HaveOccurred())
+
+			// team-foo is deleted in harbor
+			affected, err := hscr.removeProject(harbor.Project{ID: 1, Name: "team-foo"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(affected).To(BeEmpty())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rmp-foo", Name: "default-pull-secret"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the paused annotation must be removed, otherwise the config can not be deleted
+			delete(hs.Annotations, crdv1.PausedAnnotation)
+			err = k8sClient.Update(context.Background(), &hs)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should not collect secrets before harbor has been synced", func() {
+			test.EnsureNamespace(k8sClient, "team-us-foo")
+			defer test.DeleteNamespace(k8sClient, "team-us-foo")
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-us-cfg", "team-(foo)", &crdv1.ProjectMapping{
+				Namespace: "team-us-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-us-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-us-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			key := types.NamespacedName{Namespace: "team-us-foo", Name: "default-pull-secret"}
+			var secret v1.Secret
+			Expect(k8sClient.Get(context.Background(), key, &secret)).To(Succeed())
+
+			// the controller restarts with an empty cache which has not been synced yet
+			repo, err := repository.New(fakeHarbor, time.Hour)
+			Expect(err).ToNot(HaveOccurred())
+			hscr.Harbor = repo
+			hscr.forceSync.Store("my-us-cfg", struct{}{})
+			res, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.RequeueAfter).ToNot(BeZero())
+			Expect(k8sClient.Get(context.Background(), key, &secret)).To(Succeed())
+
+			// harbor returns an empty project list
+			fakeHarbor.ListProjectsFunc = func() ([]harbor.Project, error) {
+				return nil, nil
+			}
+			Expect(repo.Update()).To(Succeed())
+			hscr.forceSync.Store("my-us-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(k8sClient.Get(context.Background(), key, &secret)).To(Succeed())
+			var hs crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			c := GetSyncCondition(hs.Status, crdv1.HarborSyncReady)
+			Expect(c.Status).To(Equal(v1.ConditionFalse))
+			Expect(c.Reason).To(Equal("Garbage collection failed"))
+		})
+
+		It("should detect conflicts between configs", func() {
+			test.EnsureNamespace(k8sClient, "team-cf-foo")
+			defer test.DeleteNamespace(k8sClient, "team-cf-foo")
+
+			mapping := &crdv1.ProjectMapping{
+				Namespace: "team-cf-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cf-a", "team-(foo)", mapping, nil)
+			defer deleteSyncConfig("my-cf-a")
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cf-b", "team-(foo)", mapping, nil)
+			defer deleteSyncConfig("my-cf-b")
+
+			var created int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+
+			// my-cf-a takes precedence
+			reqB := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-cf-b"}}
+			_, err := hscr.Reconcile(context.Background(), reqB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(0))
+			var secret v1.Secret
+			key := types.NamespacedName{Namespace: "team-cf-foo", Name: "default-pull-secret"}
+			err = k8sClient.Get(context.Background(), key, &secret)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), reqB.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond := GetSyncCondition(hs.Status, crdv1.HarborSyncConflict)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("robot account in project team-foo is managed by HarborSync my-cf-a with the same or an overlapping suffix: not managing it"))
+			Expect(cond.Message).To(ContainSubstring("secret team-cf-foo/default-pull-secret is also written by HarborSync my-cf-a"))
+
+			reqA := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-cf-a"}}
+			_, err = hscr.Reconcile(context.Background(), reqA)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(1))
+			err = k8sClient.Get(context.Background(), key, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secret.Labels[crdv1.OwnerLabel]).To(Equal("my-cf-a"))
+
+			err = k8sClient.Get(context.Background(), reqA.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond = GetSyncCondition(hs.Status, crdv1.HarborSyncConflict)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("robot account in project team-foo is also managed by HarborSync my-cf-b"))
+		})
+
+		It("should detect conflicts between configs whose suffixes overlap", func() {
+			// the robot accounts of my-ov-a are named sync-bot and sync-bot-next during a rotation
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-ov-a", "team-(foo)", nil, nil)
+			defer deleteSyncConfig("my-ov-a")
+			b := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-ov-b", "team-(foo)", nil, nil)
+			defer deleteSyncConfig("my-ov-b")
+			b.Spec.RobotAccountSuffix = "sync-bot-next"
+			err := k8sClient.Update(context.Background(), &b)
+			Expect(err).ToNot(HaveOccurred())
+
+			var changes int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				changes++
+				return &harbor.CreateRobotResponse{Name: "robot$" + name, Token: "1234"}, nil
+			}
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				changes++
+				return nil
+			}
+
+			// my-ov-a takes precedence, my-ov-b does not touch its robot accounts
+			reqB := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-ov-b"}}
+			_, err = hscr.Reconcile(context.Background(), reqB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal(0))
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), reqB.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond := GetSyncCondition(hs.Status, crdv1.HarborSyncConflict)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("robot account in project team-foo is managed by HarborSync my-ov-a with the same or an overlapping suffix: not managing it"))
+
+			reqA := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-ov-a"}}
+			_, err = hscr.Reconcile(context.Background(), reqA)
+			Expect(err).ToNot(HaveOccurred())
+			err = k8sClient.Get(context.Background(), reqA.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond = GetSyncCondition(hs.Status, crdv1.HarborSyncConflict)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(ContainSubstring("robot account in project team-foo is also managed by HarborSync my-ov-b"))
+		})
+
+		It("should pause the re-creation of robot accounts if credentials are missing", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-pause-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-pause-cfg")
+			hscr.MissingCredentialsRatio = 0.5
+			hscr.MissingCredentialsMin = 2
+
+			var changes int
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				changes++
+				return nil
+			}
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				changes++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+
+			// the robot accounts exist in both projects but the store is empty
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-pause-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal(0))
+			Expect(testutil.ToFloat64(missingCredentialsGauge.WithLabelValues("my-pause-cfg"))).To(Equal(2.0))
+			Expect(testutil.ToFloat64(recreationPausedGauge.WithLabelValues("my-pause-cfg"))).To(Equal(1.0))
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond := GetSyncCondition(hs.Status, crdv1.HarborSyncRecreationPaused)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+
+			// acknowledge
+			hs.Annotations = map[string]string{crdv1.RecreateRobotsAnnotation: "true"}
+			err = k8sClient.Update(context.Background(), &hs)
+			Expect(err).ToNot(HaveOccurred())
+			hscr.forceSync.Store("my-pause-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(Equal(4))
+
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Annotations).ToNot(HaveKey(crdv1.RecreateRobotsAnnotation))
+			cond = GetSyncCondition(hs.Status, crdv1.HarborSyncRecreationPaused)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionFalse))
+			Expect(hs.Status.ProjectList).To(HaveLen(2))
+		})
+
+		It("should refuse to act if too many projects match", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-max-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-max-cfg")
+			hscr.MaxProjects = 1
+
+			var created int
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-max-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(0))
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond := GetSyncCondition(hs.Status, crdv1.HarborSyncTooManyMatches)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(Equal("2 projects match, at most 1 are allowed: raise maxProjects or change the project name"))
+
+			// raise the limit
+			hs.Spec.MaxProjects = 2
+			err = k8sClient.Update(context.Background(), &hs)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(2))
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond = GetSyncCondition(hs.Status, crdv1.HarborSyncTooManyMatches)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionFalse))
+		})
+
+		It("should requeue robot accounts deferred by the rate limit", func() {
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rl-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-rl-cfg")
+			hscr.RobotBudget = ratelimit.NewBudget("robot", 1, 2)
+
+			var created int
+			fakeHarbor.GetRobotAccountsFunc = func(project harbor.Project) ([]harbor.Robot, error) {
+				return nil, nil
+			}
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created++
+				return &harbor.CreateRobotResponse{Name: "robot$sync-bot", Token: "1234"}, nil
+			}
+			Expect(hscr.RobotBudget.Allow(1)).To(BeTrue())
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rl-cfg"}}
+			res, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal(1))
+			Expect(res.RequeueAfter).To(BeNumerically(">", 30*time.Second))
+			_, forced := hscr.forceSync.Load("my-rl-cfg")
+			Expect(forced).To(BeTrue())
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Status.ProjectList).To(HaveLen(1))
+		})
+
+		It("should hold back the rotation if the canary fails the verification", func() {
+			test.EnsureNamespace(k8sClient, "team-rot-foo")
+			test.EnsureNamespace(k8sClient, "team-rot-bar")
+			defer test.DeleteNamespace(k8sClient, "team-rot-foo")
+			defer test.DeleteNamespace(k8sClient, "team-rot-bar")
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-rot-cfg", "team-(.*)", &crdv1.ProjectMapping{
+				Namespace: "team-rot-$1",
+				Secret:    "default-pull-secret",
+				Type:      crdv1.TranslateMappingType,
+			}, nil)
+			defer deleteSyncConfig("my-rot-cfg")
+			cfg.Spec.Rotation = &crdv1.RotationStrategy{CanaryPercent: 10}
+			Expect(k8sClient.Update(context.Background(), &cfg)).To(Succeed())
+
+			// both robot accounts are due for rotation
+			created := time.Now().Add(-time.Hour * 48).Format(time.RFC3339Nano)
+			robots := map[string][]harbor.Robot{
+				"team-foo": {{ID: 1, Name: "robot$sync-bot", CreationTime: created, ExpiresAt: time.Now().Add(time.Hour * 48).Unix()}},
+				"team-bar": {{ID: 2, Name: "robot$sync-bot", CreationTime: created, ExpiresAt: time.Now().Add(time.Hour * 48).Unix()}},
+			}
+			nextID := 10
+			fakeHarbor.GetRobotAccountsFunc = func(project harbor.Project) ([]harbor.Robot, error) {
+				return robots[project.Name], nil
+			}
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				robots[project.Name] = append(robots[project.Name], harbor.Robot{
+					ID:           nextID,
+					Name:         "robot$" + name,
+					CreationTime: time.Now().Format(time.RFC3339Nano),
+					ExpiresAt:    time.Now().Add(time.Hour * 48).Unix(),
+				})
+				nextID++
+				return &harbor.CreateRobotResponse{Name: "robot$" + name, Token: fmt.Sprintf("new-%s-%d", project.Name, nextID-1)}, nil
+			}
+			var deleted []int
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, robotID)
+				var kept []harbor.Robot
+				for _, robot := range robots[project.Name] {
+					if robot.ID != robotID {
+						kept = append(kept, robot)
+					}
+				}
+				robots[project.Name] = kept
+				return nil
+			}
+			credStore.Set("team-foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "old-foo", CreatedAt: 1})
+			credStore.Set("team-bar", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "old-bar", CreatedAt: 1})
+			var loginErr error
+			hscr.Registry = harborfake.Registry{
+				LoginFunc: func(username, password string) error {
+					return loginErr
+				},
+			}
+
+			loginErr = fmt.Errorf("registry rejected the credentials")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-rot-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			// team-foo is the canary: its replacement is deleted, the previous robot account is kept
+			Expect(deleted).To(Equal([]int{10}))
+			Expect(robots["team-foo"]).To(HaveLen(1))
+			Expect(robots["team-foo"][0].ID).To(Equal(1))
+
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond := GetSyncCondition(hs.Status, crdv1.HarborSyncRotationFailed)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+			Expect(cond.Message).To(Equal("credentials of project team-foo failed verification: registry rejected the credentials. Rotation of 1 projects is held back"))
+
+			// the unverified credentials are not distributed, both projects keep their working credentials
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rot-foo", Name: "default-pull-secret"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(ContainSubstring("old-foo"))
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rot-bar", Name: "default-pull-secret"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(ContainSubstring("old-bar"))
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+			Expect(credStore.Has("team-foo", "robot$sync-bot-next")).To(BeFalse())
+
+			// the canary is retried and passes, then the remaining project is rotated.
+			// The previous robot accounts are deleted once their replacements have been verified
+			loginErr = nil
+			hscr.forceSync.Store("my-rot-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleted).To(Equal([]int{10, 1, 2}))
+			Expect(robots["team-foo"]).To(ConsistOf(HaveField("Name", "robot$sync-bot-next")))
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			cond = GetSyncCondition(hs.Status, crdv1.HarborSyncRotationFailed)
+			Expect(cond.Status).To(Equal(v1.ConditionFalse))
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rot-foo", Name: "default-pull-secret"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(ContainSubstring("new-team-foo-11"))
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-rot-bar", Name: "default-pull-secret"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data[v1.DockerConfigJsonKey])).To(ContainSubstring("new-team-bar-12"))
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeFalse())
+			Expect(credStore.Has("team-foo", "robot$sync-bot-next")).To(BeTrue())
+		})
+
+		It("should verify the stored credentials", func() {
+			// stand-in for the token flow of the harbor registry
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/v2/" {
+					res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/service/token",service="harbor-registry"`, srv.URL))
+					res.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if _, pass, _ := req.BasicAuth(); pass != "valid" {
+					res.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				res.Write([]byte(`{"token":"abc"}`))
+			}))
+			defer srv.Close()
+			registry, err := harbor.New(srv.URL, "/api/", "admin", "admin", false, false)
+			Expect(err).ToNot(HaveOccurred())
+			hscr.Registry = registry
+			fakeHarbor.GetRobotAccountsFunc = func(project harbor.Project) ([]harbor.Robot, error) {
+				return []harbor.Robot{{
+					Name:         "robot$sync-bot",
+					CreationTime: time.Now().Format(time.RFC3339Nano),
+					ExpiresAt:    time.Now().Add(time.Hour * 24 * 30).Unix(),
+				}}, nil
+			}
+
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-verify-cfg", "team-(.*)", nil, nil)
+			defer deleteSyncConfig("my-verify-cfg")
+			// the robot account in team-bar has been disabled in harbor
+			credStore.Set("team-foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "valid"})
+			credStore.Set("team-bar", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "disabled"})
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-verify-cfg"}}
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			changed, err := hscr.verify()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(HaveLen(1))
+			Expect(changed[0].Name).To(Equal("my-verify-cfg"))
+			Expect(testutil.ToFloat64(credentialsValidGauge.WithLabelValues("my-verify-cfg", "team-foo"))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(credentialsValidGauge.WithLabelValues("my-verify-cfg", "team-bar"))).To(Equal(0.0))
+			// a single rejection does not re-create the robot account, the credentials are kept
+			Expect(credStore.Has("team-bar", "robot$sync-bot")).To(BeTrue())
+			_, forced := hscr.forceSync.Load("my-verify-cfg")
+			Expect(forced).To(BeFalse())
+			_, err = hscr.verify()
+			Expect(err).ToNot(HaveOccurred())
+			_, forced = hscr.forceSync.Load("my-verify-cfg")
+			Expect(forced).To(BeFalse())
+			changed, err = hscr.verify()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(HaveLen(1))
+			_, forced = hscr.forceSync.Load("my-verify-cfg")
+			Expect(forced).To(BeTrue())
+			Expect(credStore.Has("team-foo", "robot$sync-bot")).To(BeTrue())
+			Expect(credStore.Has("team-bar", "robot$sync-bot")).To(BeTrue())
+
+			// the reconciliation creates a replacement robot account, verifies it and deletes the previous one
+			var created []string
+			fakeHarbor.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				created = append(created, project.Name)
+				return &harbor.CreateRobotResponse{Name: "robot$" + name, Token: "valid"}, nil
+			}
+			var deleted []string
+			fakeHarbor.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, project.Name)
+				return nil
+			}
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(created).To(Equal([]string{"team-bar"}))
+			Expect(deleted).To(Equal([]string{"team-bar"}))
+			Expect(credStore.Has("team-bar", "robot$sync-bot")).To(BeFalse())
+			Expect(credStore.Has("team-bar", "robot$sync-bot-next")).To(BeTrue())
+			var hs crdv1.HarborSync
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(hs.Status.ProjectList).To(HaveLen(2))
+			for _, project := range hs.Status.ProjectList {
+				cond := getCondition(project.Conditions, crdv1.ProjectCredentialsValid)
+				Expect(cond).ToNot(BeNil())
+				if project.Name == "team-foo" {
+					Expect(cond.Status).To(Equal(v1.ConditionTrue))
+				} else {
+					Expect(cond.Status).To(Equal(v1.ConditionFalse))
+					Expect(cond.Reason).To(Equal("Re-creating robot account"))
+				}
+			}
+
+			// the next verification succeeds
+			changed, err = hscr.verify()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(HaveLen(1))
+			Expect(testutil.ToFloat64(credentialsValidGauge.WithLabelValues("my-verify-cfg", "team-bar"))).To(Equal(1.0))
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			err = k8sClient.Get(context.Background(), req.NamespacedName, &hs)
+			Expect(err).ToNot(HaveOccurred())
+			for _, project := range hs.Status.ProjectList {
+				Expect(getCondition(project.Conditions, crdv1.ProjectCredentialsValid).Status).To(Equal(v1.ConditionTrue))
+			}
+			changed, err = hscr.verify()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeEmpty())
+		})
+
 		It("should call the webhook", func() {
 			var fooWebhookCalled bool
 			var barWebhookCalled bool
@@ -271,11 +1237,13 @@ var _ = Describe("Controller", func() {
 				if msg.Project == "team-foo" {
 					Expect(msg.Credentials.Name).To(Equal("robot$sync-bot"))
 					Expect(msg.Credentials.Token).To(Equal("1234"))
+					Expect(msg.Namespaces).To(Equal([]string{"team-wh-foo"}))
 					fooWebhookCalled = true
 					return
 				} else if msg.Project == "team-bar" {
 					Expect(msg.Credentials.Name).To(Equal("robot$sync-bot"))
 					Expect(msg.Credentials.Token).To(Equal("1234"))
+					Expect(msg.Namespaces).To(BeEmpty())
 					barWebhookCalled = true
 					return
 				}
@@ -284,7 +1252,7 @@ var _ = Describe("Controller", func() {
 			test.EnsureNamespace(k8sClient, "team-wh-foo")
 			defer test.DeleteNamespace(k8sClient, "team-wh-foo")
 			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-wh-cfg", "team-(.*)", &crdv1.ProjectMapping{
-				Namespace: "team-recon-$1",
+				Namespace: "team-wh-$1",
 				Secret:    "default-pull-secret",
 				Type:      crdv1.TranslateMappingType,
 			}, []crdv1.WebhookConfig{
@@ -292,7 +1260,7 @@ var _ = Describe("Controller", func() {
 					Endpoint: srv.URL,
 				},
 			})
-			defer test.DeleteHarborSyncConfig(k8sClient, "my-wh-cfg")
+			defer deleteSyncConfig("my-wh-cfg")
 			_, err := hscr.Reconcile(context.Background(), ctrl.Request{
 				NamespacedName: types.NamespacedName{
 					Name: "my-wh-cfg",
@@ -339,7 +1307,7 @@ var _ = Describe("Controller", func() {
 					Endpoint: srv.URL,
 				},
 			})
-			defer test.DeleteHarborSyncConfig(k8sClient, "my-whmp-cfg")
+			defer deleteSyncConfig("my-whmp-cfg")
 			_, err := hscr.Reconcile(context.Background(), ctrl.Request{
 				NamespacedName: types.NamespacedName{
 					Name: "my-whmp-cfg",
@@ -350,6 +1318,280 @@ var _ = Describe("Controller", func() {
 			Expect(fooWebhookCalled).To(BeTrue())
 			Expect(barWebhookCalled).To(BeTrue())
 		})
+
+		It("should retry undelivered webhook events", func() {
+			available := false
+			delivered := map[string]string{}
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				var msg crdv1.WebhookUpdatePayload
+				body, err := ioutil.ReadAll(req.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(body, &msg)).To(Succeed())
+				if !available {
+					res.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				delivered[msg.Project] = req.Header.Get("ce-id")
+			}))
+			defer srv.Close()
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-whq-cfg", "team-(.*)", nil, []crdv1.WebhookConfig{
+				{
+					Endpoint: srv.URL,
+					Format:   crdv1.CloudEventsBinaryWebhookFormat,
+				},
+			})
+			defer deleteSyncConfig("my-whq-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-whq-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			// the events are kept in the status
+			var syncConfig crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &syncConfig)).To(Succeed())
+			Expect(syncConfig.Status.WebhookDeliveries).To(HaveLen(2))
+			for _, delivery := range syncConfig.Status.WebhookDeliveries {
+				Expect(delivery.Endpoint).To(Equal(srv.URL))
+				Expect(delivery.RobotAccount).To(Equal("robot$sync-bot"))
+				Expect(delivery.Attempts).To(Equal(1))
+				Expect(delivery.LastError).To(ContainSubstring("503"))
+				Expect(delivery.ID).ToNot(BeEmpty())
+			}
+			ids := map[string]string{}
+			for _, delivery := range syncConfig.Status.WebhookDeliveries {
+				ids[delivery.Project] = delivery.ID
+			}
+			Expect(hasDueWebhooks(syncConfig, time.Now())).To(BeFalse())
+			Expect(hasDueWebhooks(syncConfig, time.Now().Add(webhookRetryBackoff+time.Second))).To(BeTrue())
+			Expect(testutil.ToFloat64(pendingWebhooksGauge.WithLabelValues("my-whq-cfg"))).To(Equal(2.0))
+
+			// due events are delivered without a full reconciliation
+			for i := range syncConfig.Status.WebhookDeliveries {
+				syncConfig.Status.WebhookDeliveries[i].NextAttempt = metav1.NewTime(time.Now().Add(-time.Minute))
+			}
+			Expect(k8sClient.Status().Update(context.Background(), &syncConfig)).To(Succeed())
+			available = true
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			// the event keeps its id when it is sent again
+			Expect(delivered).To(Equal(ids))
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &syncConfig)).To(Succeed())
+			Expect(syncConfig.Status.WebhookDeliveries).To(BeEmpty())
+			Expect(testutil.ToFloat64(pendingWebhooksGauge.WithLabelValues("my-whq-cfg"))).To(Equal(0.0))
+		})
+
+		It("should send the subscribed events", func() {
+			var received []crdv1.WebhookEventPayload
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				var msg crdv1.WebhookEventPayload
+				body, err := ioutil.ReadAll(req.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(body, &msg)).To(Succeed())
+				Expect(msg.Version).To(Equal("v1"))
+				Expect(msg.HarborSync).To(Equal("my-whev-cfg"))
+				received = append(received, msg)
+			}))
+			defer srv.Close()
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-whev-cfg", "team-(.*)", nil, []crdv1.WebhookConfig{
+				{
+					Endpoint: srv.URL,
+					Events: []crdv1.WebhookEventType{
+						crdv1.ProjectMatchedEvent,
+						crdv1.ProjectUnmatchedEvent,
+						crdv1.RobotExpiringEvent,
+						crdv1.ReconcileFailedEvent,
+					},
+				},
+			})
+			defer deleteSyncConfig("my-whev-cfg")
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-whev-cfg"}}
+			eventTypes := func() []string {
+				var out []string
+				for _, msg := range received {
+					out = append(out, fmt.Sprintf("%s %s", msg.Type, msg.Project))
+				}
+				received = nil
+				return out
+			}
+
+			// the projects start matching
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(eventTypes()).To(ConsistOf(
+				"io.harborsync.project.matched team-foo",
+				"io.harborsync.project.matched team-bar",
+			))
+
+			// team-bar stops matching and the rotation of team-foo is deferred
+			fakeHarbor.ListProjectsFunc = func() ([]harbor.Project, error) {
+				return listProjectsResponse[:1], nil
+			}
+			hscr.RobotBudget = ratelimit.NewBudget("robot", 1, 2)
+			Expect(hscr.RobotBudget.Allow(2)).To(BeTrue())
+			hscr.forceSync.Store("my-whev-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(eventTypes()).To(ConsistOf(
+				"io.harborsync.robot.expiring team-foo",
+				"io.harborsync.project.unmatched team-bar",
+			))
+			var hs crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &hs)).To(Succeed())
+			Expect(hs.Status.ProjectList).To(HaveLen(1))
+			cond := getCondition(hs.Status.ProjectList[0].Conditions, crdv1.ProjectRobotExpiring)
+			Expect(cond).ToNot(BeNil())
+			Expect(cond.Status).To(Equal(v1.ConditionTrue))
+
+			// the expiring robot account is only reported once
+			hscr.forceSync.Store("my-whev-cfg", struct{}{})
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(eventTypes()).To(BeEmpty())
+
+			// the reconciliation starts failing
+			fakeHarbor.ListProjectsFunc = func() ([]harbor.Project, error) {
+				return nil, fmt.Errorf("harbor is down")
+			}
+			for i := 0; i < 2; i++ {
+				hscr.forceSync.Store("my-whev-cfg", struct{}{})
+				_, err = hscr.Reconcile(context.Background(), req)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(received).To(HaveLen(1))
+			Expect(received[0].Type).To(Equal(crdv1.ReconcileFailedEvent))
+			Expect(received[0].Error).To(ContainSubstring("harbor is down"))
+		})
+
+		It("should drop expired webhook events", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer srv.Close()
+			test.EnsureHarborSyncConfigWithParams(k8sClient, "my-whx-cfg", "team-(.*)", nil, []crdv1.WebhookConfig{
+				{
+					Endpoint: srv.URL,
+				},
+			})
+			defer deleteSyncConfig("my-whx-cfg")
+			hscr.WebhookExpiry = time.Hour
+			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "my-whx-cfg"}}
+			_, err := hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+
+			var syncConfig crdv1.HarborSync
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &syncConfig)).To(Succeed())
+			Expect(syncConfig.Status.WebhookDeliveries).To(HaveLen(2))
+			for i := range syncConfig.Status.WebhookDeliveries {
+				syncConfig.Status.WebhookDeliveries[i].CreatedAt = metav1.NewTime(time.Now().Add(-time.Hour * 2))
+				syncConfig.Status.WebhookDeliveries[i].NextAttempt = metav1.NewTime(time.Now().Add(-time.Minute))
+			}
+			Expect(k8sClient.Status().Update(context.Background(), &syncConfig)).To(Succeed())
+			_, err = hscr.Reconcile(context.Background(), req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(k8sClient.Get(context.Background(), req.NamespacedName, &syncConfig)).To(Succeed())
+			Expect(syncConfig.Status.WebhookDeliveries).To(BeEmpty())
+			Expect(testutil.ToFloat64(expiredWebhooksCounter.WithLabelValues("my-whx-cfg", srv.URL))).To(Equal(2.0))
+		})
+	})
+})
+
+var _ = Describe("ServiceAccountReconciler", func() {
+	It("should only attach existing secrets", func() {
+		ns := "team-sa-foo"
+		test.EnsureNamespace(k8sClient, ns)
+		defer test.DeleteNamespace(k8sClient, ns)
+		cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-sa-cfg", "team-(.*)", &crdv1.ProjectMapping{
+			Namespace: "team-sa-$1",
+			Secret:    "$1-pull-token",
+			Type:      crdv1.TranslateMappingType,
+			ServiceAccounts: &crdv1.ServiceAccountSelector{
+				Names: []string{"builder"},
+			},
+		}, nil)
+		defer test.DeleteHarborSyncConfig(k8sClient, "my-sa-cfg")
+		sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "builder"}}
+		Expect(k8sClient.Create(context.Background(), &sa)).To(Succeed())
+		sar := &ServiceAccountReconciler{Client: k8sClient}
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ns, Name: "builder"}}
+
+		// a selected ServiceAccount in a namespace without secrets of the config
+		test.EnsureNamespace(k8sClient, "team-sa-other")
+		defer test.DeleteNamespace(k8sClient, "team-sa-other")
+		other := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team-sa-other", Name: "builder"}}
+		Expect(k8sClient.Create(context.Background(), &other)).To(Succeed())
+		Expect(sar.serviceAccountsForSyncConfig(&cfg)).To(BeEmpty())
+
+		// the secret has not been written yet
+		res, err := sar.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.RequeueAfter).To(BeZero())
+		Expect(k8sClient.Get(context.Background(), req.NamespacedName, &sa)).To(Succeed())
+		Expect(sa.ImagePullSecrets).To(BeEmpty())
+
+		secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   ns,
+			Name:        "foo-pull-token",
+			Labels:      map[string]string{crdv1.OwnerLabel: "my-sa-cfg"},
+			Annotations: map[string]string{crdv1.ProjectAnnotation: "team-foo"},
+		}}
+		Expect(k8sClient.Create(context.Background(), &secret)).To(Succeed())
+		Expect(sar.serviceAccountsForSecret(&secret)).To(Equal([]ctrl.Request{req}))
+		Expect(sar.serviceAccountsForSyncConfig(&cfg)).To(Equal([]ctrl.Request{req}))
+		_, err = sar.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(context.Background(), req.NamespacedName, &sa)).To(Succeed())
+		Expect(sa.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{{Name: "foo-pull-token"}}))
+
+		// the secret is garbage collected
+		test.DeleteSecret(k8sClient, ns, "foo-pull-token")
+		Expect(sar.serviceAccountsForSecret(&secret)).To(Equal([]ctrl.Request{req}))
+		_, err = sar.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(context.Background(), req.NamespacedName, &sa)).To(Succeed())
+		Expect(sa.ImagePullSecrets).To(BeEmpty())
+	})
+
+	It("should not update ServiceAccounts of paused configs", func() {
+		ns := "team-sa-bar"
+		test.EnsureNamespace(k8sClient, ns)
+		defer test.DeleteNamespace(k8sClient, ns)
+		cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-sa-paused-cfg", "team-(.*)", &crdv1.ProjectMapping{
+			Namespace: "team-sa-$1",
+			Secret:    "$1-pull-token",
+			Type:      crdv1.TranslateMappingType,
+			ServiceAccounts: &crdv1.ServiceAccountSelector{
+				Names: []string{"builder"},
+			},
+		}, nil)
+		defer test.DeleteHarborSyncConfig(k8sClient, "my-sa-paused-cfg")
+		cfg.Annotations = map[string]string{crdv1.PausedAnnotation: "true"}
+		Expect(k8sClient.Update(context.Background(), &cfg)).To(Succeed())
+		sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "builder"}}
+		Expect(k8sClient.Create(context.Background(), &sa)).To(Succeed())
+		secret := v1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   ns,
+			Name:        "bar-pull-token",
+			Labels:      map[string]string{crdv1.OwnerLabel: "my-sa-paused-cfg"},
+			Annotations: map[string]string{crdv1.ProjectAnnotation: "team-bar"},
+		}}
+		Expect(k8sClient.Create(context.Background(), &secret)).To(Succeed())
+		sar := &ServiceAccountReconciler{Client: k8sClient}
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ns, Name: "builder"}}
+
+		_, err := sar.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(context.Background(), req.NamespacedName, &sa)).To(Succeed())
+		Expect(sa.ImagePullSecrets).To(BeEmpty())
+
+		// the ServiceAccount is updated once the config is resumed
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{Name: "my-sa-paused-cfg"}, &cfg)).To(Succeed())
+		resumed := cfg.DeepCopy()
+		delete(resumed.Annotations, crdv1.PausedAnnotation)
+		Expect(pausedChanged.Update(event.UpdateEvent{ObjectOld: &cfg, ObjectNew: resumed})).To(BeTrue())
+		Expect(k8sClient.Update(context.Background(), resumed)).To(Succeed())
+		_, err = sar.Reconcile(context.Background(), req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(context.Background(), req.NamespacedName, &sa)).To(Succeed())
+		Expect(sa.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{{Name: "bar-pull-token"}}))
 	})
 })
 
@@ -376,3 +1618,188 @@ var _ = Describe("Reconciler", func() {
 		})).To(BeTrue())
 	})
 })
+
+var _ = Describe("Project status", func() {
+	It("should record the results of the mappings", func() {
+		status := &crdv1.HarborSyncStatus{}
+		project := harbor.Project{Name: "foo"}
+		mapping := crdv1.ProjectMapping{Type: crdv1.MatchMappingType, Namespace: "team-.*", Secret: "pull-secret"}
+		UpdateProjectStatusLastReconciliation(status, project)
+		setMappingStatus(status, project, mapping, reconciler.MappingResult{
+			Written: []types.NamespacedName{{Namespace: "team-a", Name: "pull-secret"}},
+		}, &ratelimit.DeferredError{Budget: "secret", RetryAfter: time.Second})
+		setMappingStatus(status, project, mapping, reconciler.MappingResult{}, fmt.Errorf("error listing namespaces"))
+		summarizeStatus(status)
+
+		p := status.ProjectList[0]
+		Expect(p.ManagedNamespaces).To(Equal([]string{"team-a"}))
+		Expect(p.Mappings).To(HaveLen(2))
+		Expect(p.Mappings[0].Secrets).To(Equal([]string{"team-a/pull-secret"}))
+		Expect(p.Mappings[0].Error).To(BeEmpty())
+		Expect(p.Mappings[1].Error).To(Equal("error listing namespaces"))
+		Expect(p.LastError).To(Equal("error listing namespaces"))
+		Expect(status.MatchedProjects).To(Equal(1))
+		Expect(status.FailedProjects).To(Equal(1))
+		Expect(status.ManagedSecrets).To(Equal(1))
+		Expect(status.FailedSecrets).To(Equal(0))
+	})
+})
+
+var _ = Describe("Webhook deliveries", func() {
+	It("should back off exponentially", func() {
+		Expect(webhookBackoff(1)).To(Equal(webhookRetryBackoff))
+		Expect(webhookBackoff(2)).To(Equal(webhookRetryBackoff * 2))
+		Expect(webhookBackoff(3)).To(Equal(webhookRetryBackoff * 4))
+		Expect(webhookBackoff(100)).To(Equal(webhookMaxRetryBackoff))
+	})
+
+	It("should replace pending rotations of the project", func() {
+		cfg := &crdv1.HarborSync{Spec: crdv1.HarborSyncSpec{
+			Webhook: []crdv1.WebhookConfig{
+				{Endpoint: "http://a"},
+				{Endpoint: "http://b", Events: []crdv1.WebhookEventType{crdv1.RobotRotatedEvent, crdv1.ProjectMatchedEvent}},
+			},
+		}}
+		cred := &crdv1.RobotAccountCredential{Name: "robot$sync-bot"}
+		enqueueRotation(cfg, harbor.Project{Name: "foo"}, cred)
+		cfg.Status.WebhookDeliveries[0].Attempts = 3
+		enqueueRotation(cfg, harbor.Project{Name: "foo"}, cred)
+		enqueueRotation(cfg, harbor.Project{Name: "bar"}, cred)
+		Expect(cfg.Status.WebhookDeliveries).To(HaveLen(4))
+		Expect(cfg.Status.WebhookDeliveries[0].Attempts).To(Equal(0))
+		Expect(cfg.Status.WebhookDeliveries[2].Project).To(Equal("bar"))
+	})
+
+	It("should only enqueue subscribed events", func() {
+		cfg := &crdv1.HarborSync{Spec: crdv1.HarborSyncSpec{
+			Webhook: []crdv1.WebhookConfig{
+				{Endpoint: "http://a"},
+				{Endpoint: "http://b", Events: []crdv1.WebhookEventType{crdv1.ProjectMatchedEvent}},
+			},
+		}}
+		cfg.ObjectMeta.Name = "my-cfg"
+		enqueueEvent(cfg, crdv1.WebhookEventPayload{Type: crdv1.ProjectMatchedEvent, Project: "foo"})
+		enqueueEvent(cfg, crdv1.WebhookEventPayload{Type: crdv1.SecretDeletedEvent, Project: "foo"})
+		Expect(cfg.Status.WebhookDeliveries).To(HaveLen(1))
+		delivery := cfg.Status.WebhookDeliveries[0]
+		Expect(delivery.Endpoint).To(Equal("http://b"))
+		Expect(delivery.Type).To(Equal(crdv1.ProjectMatchedEvent))
+		Expect(delivery.Payload).To(Equal(&crdv1.WebhookEventPayload{
+			Version:    crdv1.WebhookPayloadVersion,
+			Type:       crdv1.ProjectMatchedEvent,
+			HarborSync: "my-cfg",
+			Project:    "foo",
+		}))
+	})
+
+	It("should send the credentials in the payload mode of the webhook", func() {
+		cred := crdv1.RobotAccountCredential{Name: "robot$sync-bot", CreatedAt: 42, Token: "1234"}
+		creds, err := webhookCredentials(crdv1.WebhookConfig{}, cred)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(crdv1.WebhookCredentials{Name: "robot$sync-bot", CreatedAt: 42, Token: "1234"}))
+
+		creds, err = webhookCredentials(crdv1.WebhookConfig{PayloadMode: crdv1.RedactedPayloadMode}, cred)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds).To(Equal(crdv1.WebhookCredentials{Name: "robot$sync-bot", CreatedAt: 42}))
+
+		_, err = webhookCredentials(crdv1.WebhookConfig{PayloadMode: crdv1.EncryptedPayloadMode}, cred)
+		Expect(err).To(HaveOccurred())
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+		creds, err = webhookCredentials(crdv1.WebhookConfig{
+			PayloadMode:   crdv1.EncryptedPayloadMode,
+			EncryptionKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		}, cred)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(creds.Token).To(BeEmpty())
+		obj, err := jose.ParseEncrypted(creds.Encrypted)
+		Expect(err).ToNot(HaveOccurred())
+		plaintext, err := obj.Decrypt(key)
+		Expect(err).ToNot(HaveOccurred())
+		var decrypted crdv1.RobotAccountCredential
+		Expect(json.Unmarshal(plaintext, &decrypted)).To(Succeed())
+		Expect(decrypted).To(Equal(cred))
+	})
+
+	It("should limit the pending events", func() {
+		cfg := &crdv1.HarborSync{Spec: crdv1.HarborSyncSpec{
+			Webhook: []crdv1.WebhookConfig{
+				{Endpoint: "http://a", Events: []crdv1.WebhookEventType{crdv1.SecretDeletedEvent}},
+			},
+		}}
+		for i := 0; i < maxWebhookDeliveries+10; i++ {
+			enqueueEvent(cfg, crdv1.WebhookEventPayload{Type: crdv1.SecretDeletedEvent, Secret: fmt.Sprintf("secret-%d", i)})
+		}
+		Expect(cfg.Status.WebhookDeliveries).To(HaveLen(maxWebhookDeliveries))
+		Expect(cfg.Status.WebhookDeliveries[0].Payload.Secret).To(Equal("secret-10"))
+	})
+
+	It("should limit the events sent in a reconciliation", func() {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+		}))
+		defer srv.Close()
+		cfg := &crdv1.HarborSync{Spec: crdv1.HarborSyncSpec{
+			Webhook: []crdv1.WebhookConfig{
+				{Endpoint: srv.URL, Events: []crdv1.WebhookEventType{crdv1.SecretDeletedEvent}},
+			},
+		}}
+		cfg.ObjectMeta.Name = "my-cfg"
+		for i := 0; i < maxWebhookSends+2; i++ {
+			enqueueEvent(cfg, crdv1.WebhookEventPayload{Type: crdv1.SecretDeletedEvent, Secret: fmt.Sprintf("secret-%d", i)})
+		}
+		r := &HarborSyncConfigReconciler{Client: k8sClient}
+		Expect(r.deliverWebhooks(cfg)).To(BeTrue())
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(maxWebhookSends))
+		Expect(cfg.Status.WebhookDeliveries).To(HaveLen(2))
+		Expect(cfg.Status.WebhookDeliveries[0].Payload.Secret).To(Equal(fmt.Sprintf("secret-%d", maxWebhookSends)))
+		Expect(cfg.Status.WebhookDeliveries[0].Attempts).To(Equal(0))
+		Expect(hasDueWebhooks(*cfg, time.Now())).To(BeTrue())
+
+		Expect(r.deliverWebhooks(cfg)).To(BeTrue())
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(maxWebhookSends + 2))
+		Expect(cfg.Status.WebhookDeliveries).To(BeEmpty())
+	})
+})
+
+// testRecorder records the Kubernetes events
+type testRecorder struct {
+	events []testEvent
+}
+
+type testEvent struct {
+	kind      string
+	namespace string
+	eventtype string
+	reason    string
+	message   string
+}
+
+func (r *testRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	obj := object.(client.Object)
+	kind := reflect.TypeOf(object).Elem().Name()
+	r.events = append(r.events, testEvent{kind: kind, namespace: obj.GetNamespace(), eventtype: eventtype, reason: reason, message: message})
+}
+
+func (r *testRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *testRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// reasons returns the reasons of the events recorded on objects of the kind in the namespace
+func (r *testRecorder) reasons(kind, namespace string) []string {
+	var reasons []string
+	for _, ev := range r.events {
+		if ev.kind == kind && ev.namespace == namespace {
+			reasons = append(reasons, ev.reason)
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+	"github.com/moolen/harbor-sync/pkg/webhook"
+)
+
+const (
+	// defaultWebhookExpiry is the time after which webhook events
+	// which could not be delivered are dropped
+	defaultWebhookExpiry = time.Hour * 24
+
+	// webhookRetryBackoff is the time to wait before a failed webhook event is sent again.
+	// It doubles with every attempt up to webhookMaxRetryBackoff.
+	webhookRetryBackoff    = time.Second * 30
+	webhookMaxRetryBackoff = time.Hour
+
+	// webhookDispatchInterval is the interval in which the sync configs are checked for webhook events which are due
+	webhookDispatchInterval = time.Second * 10
+
+	// maxWebhookDeliveries is the number of pending webhook events per sync config.
+	// It limits the size of the status if a webhook is not available for a long time.
+	maxWebhookDeliveries = 100
+
+	// maxWebhookSends is the number of webhook events which are sent in a single reconciliation.
+	// It limits the time a worker is blocked by unavailable webhooks, the remaining events are sent
+	// when the sync config is dispatched again.
+	maxWebhookSends = 5
+)
+
+// enqueueRotation adds an io.harborsync.robot.rotated event to the pending deliveries of the webhooks.
+// Pending rotations of the project are replaced, the receivers only need the latest credentials.
+func enqueueRotation(cfg *crdv1.HarborSync, project harbor.Project, credential *crdv1.RobotAccountCredential) {
+	now := metav1.Now()
+	id := string(uuid.NewUUID())
+	for _, wh := range cfg.Spec.Webhook {
+		if !subscribed(wh, crdv1.RobotRotatedEvent) {
+			continue
+		}
+		delivery := crdv1.WebhookDelivery{
+			ID:           id,
+			Endpoint:     wh.Endpoint,
+			Type:         crdv1.RobotRotatedEvent,
+			Project:      project.Name,
+			RobotAccount: credential.Name,
+			CreatedAt:    now,
+			NextAttempt:  now,
+		}
+		replaced := false
+		for i, pending := range cfg.Status.WebhookDeliveries {
+			if pending.Endpoint == wh.Endpoint && pending.Project == project.Name && eventType(pending) == crdv1.RobotRotatedEvent {
+				cfg.Status.WebhookDeliveries[i] = delivery
+				replaced = true
+			}
+		}
+		if !replaced {
+			addDelivery(cfg, delivery)
+		}
+	}
+}
+
+// enqueueEvent adds the event to the pending deliveries of the webhooks which subscribed to its type
+func enqueueEvent(cfg *crdv1.HarborSync, payload crdv1.WebhookEventPayload) {
+	payload.Version = crdv1.WebhookPayloadVersion
+	payload.HarborSync = cfg.ObjectMeta.Name
+	now := metav1.Now()
+	id := string(uuid.NewUUID())
+	for _, wh := range cfg.Spec.Webhook {
+		if !subscribed(wh, payload.Type) {
+			continue
+		}
+		p := payload
+		addDelivery(cfg, crdv1.WebhookDelivery{
+			ID:           id,
+			Endpoint:     wh.Endpoint,
+			Type:         payload.Type,
+			Project:      payload.Project,
+			RobotAccount: payload.RobotAccount,
+			Payload:      &p,
+			CreatedAt:    now,
+			NextAttempt:  now,
+		})
+	}
+}
+
+// addDelivery appends the delivery to the pending deliveries.
+// The oldest deliveries are dropped if there are more than maxWebhookDeliveries.
+func addDelivery(cfg *crdv1.HarborSync, delivery crdv1.WebhookDelivery) {
+	cfg.Status.WebhookDeliveries = append(cfg.Status.WebhookDeliveries, delivery)
+	for len(cfg.Status.WebhookDeliveries) > maxWebhookDeliveries {
+		dropped := cfg.Status.WebhookDeliveries[0]
+		log.WithFields(log.Fields{
+			"config":   cfg.ObjectMeta.Name,
+			"project":  dropped.Project,
+			"endpoint": dropped.Endpoint,
+			"type":     eventType(dropped),
+		}).Errorf("dropping webhook event, more than %d events are pending", maxWebhookDeliveries)
+		expiredWebhooksCounter.WithLabelValues(cfg.ObjectMeta.Name, dropped.Endpoint).Inc()
+		cfg.Status.WebhookDeliveries = cfg.Status.WebhookDeliveries[1:]
+	}
+}
+
+// subscribed returns true if the webhook receives events of the given type
+func subscribed(wh crdv1.WebhookConfig, eventType crdv1.WebhookEventType) bool {
+	if len(wh.Events) == 0 {
+		return eventType == crdv1.RobotRotatedEvent
+	}
+	for _, t := range wh.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// eventType returns the type of the delivery, deliveries without type are rotations
+func eventType(delivery crdv1.WebhookDelivery) crdv1.WebhookEventType {
+	if delivery.Type == "" {
+		return crdv1.RobotRotatedEvent
+	}
+	return delivery.Type
+}
+
+// deliverWebhooks sends the pending webhook events of the sync config which are due, at most maxWebhookSends.
+// Delivered and expired events are removed, failed events are sent again with exponential backoff.
+// The events must have been persisted in the status before, so that they are not lost if the controller stops.
+// It returns true if the pending deliveries changed.
+func (r *HarborSyncConfigReconciler) deliverWebhooks(syncConfig *crdv1.HarborSync) bool {
+	name := syncConfig.ObjectMeta.Name
+	expiry := r.WebhookExpiry
+	if expiry == 0 {
+		expiry = defaultWebhookExpiry
+	}
+	sender := webhook.NewSender(r.Client, r.WebhookSecretNamespaces)
+	now := time.Now()
+	changed := false
+	sent := 0
+	pending := []crdv1.WebhookDelivery{}
+	for _, delivery := range syncConfig.Status.WebhookDeliveries {
+		if delivery.NextAttempt.Time.After(now) || sent >= maxWebhookSends {
+			pending = append(pending, delivery)
+			continue
+		}
+		changed = true
+		logger := log.WithFields(log.Fields{
+			"config":   name,
+			"project":  delivery.Project,
+			"endpoint": delivery.Endpoint,
+		})
+		if now.Sub(delivery.CreatedAt.Time) > expiry {
+			logger.Errorf("dropping webhook event which could not be delivered within %s: %s", expiry, delivery.LastError)
+			expiredWebhooksCounter.WithLabelValues(name, delivery.Endpoint).Inc()
+			continue
+		}
+		wh := webhookConfig(syncConfig.Spec.Webhook, delivery.Endpoint)
+		if wh == nil || !subscribed(*wh, eventType(delivery)) {
+			logger.Info("dropping webhook event, the webhook has been removed")
+			continue
+		}
+		if delivery.ID == "" {
+			delivery.ID = string(uuid.NewUUID())
+		}
+		data, err := r.eventData(*syncConfig, *wh, delivery)
+		if err == nil && data == nil {
+			logger.Info("dropping webhook event, the credentials have been removed")
+			continue
+		}
+		if err == nil {
+			sent++
+			err = sendWebhook(sender, name, *wh, delivery, data)
+		}
+		if err == nil {
+			logger.Info("delivered webhook")
+			continue
+		}
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = metav1.NewTime(now.Add(webhookBackoff(delivery.Attempts)))
+		logger.Errorf("could not deliver webhook, retrying at %s: %s", delivery.NextAttempt.Format(time.RFC3339), err.Error())
+		pending = append(pending, delivery)
+	}
+	syncConfig.Status.WebhookDeliveries = pending
+	pendingWebhooksGauge.WithLabelValues(name).Set(float64(len(pending)))
+	return changed
+}
+
+// eventData returns the payload of the delivery. The payload of rotations contains the current credentials
+// in the payload mode of the webhook. It is nil if the credentials have been removed:
+// a new event is created when the robot account is re-created.
+func (r *HarborSyncConfigReconciler) eventData(syncConfig crdv1.HarborSync, wh crdv1.WebhookConfig, delivery crdv1.WebhookDelivery) (interface{}, error) {
+	if eventType(delivery) != crdv1.RobotRotatedEvent {
+		if delivery.Payload == nil {
+			return nil, nil
+		}
+		return delivery.Payload, nil
+	}
+	credential, err := reconciler.GetCredentials(r.CredCache, harbor.Project{Name: delivery.Project}, syncConfig.Spec.RobotAccountSuffix)
+	if err != nil || credential == nil {
+		return nil, err
+	}
+	creds, err := webhookCredentials(wh, *credential)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := r.targetNamespaces(syncConfig, delivery.Project)
+	if err != nil {
+		return nil, err
+	}
+	return crdv1.WebhookUpdatePayload{
+		Version:     crdv1.WebhookPayloadVersion,
+		Type:        crdv1.RobotRotatedEvent,
+		HarborSync:  syncConfig.ObjectMeta.Name,
+		Project:     delivery.Project,
+		Credentials: creds,
+		Namespaces:  namespaces,
+	}, nil
+}
+
+// targetNamespaces returns the sorted namespaces into which the mappings write the credentials of the project
+func (r *HarborSyncConfigReconciler) targetNamespaces(syncConfig crdv1.HarborSync, project string) ([]string, error) {
+	var nsList v1.NamespaceList
+	err := r.List(context.Background(), &nsList)
+	if err != nil {
+		return nil, fmt.Errorf("error listing namespaces: %s", err.Error())
+	}
+	targets, err := reconciler.DesiredSecrets(syncConfig, []harbor.Project{{Name: project}}, nsList.Items)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, target := range targets {
+		if seen[target.Namespace] {
+			continue
+		}
+		seen[target.Namespace] = true
+		namespaces = append(namespaces, target.Namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// webhookCredentials returns the credentials in the payload mode of the webhook
+func webhookCredentials(wh crdv1.WebhookConfig, credential crdv1.RobotAccountCredential) (crdv1.WebhookCredentials, error) {
+	creds := crdv1.WebhookCredentials{
+		Name:      credential.Name,
+		CreatedAt: credential.CreatedAt,
+	}
+	switch wh.PayloadMode {
+	case "", crdv1.FullPayloadMode:
+		creds.Token = credential.Token
+	case crdv1.EncryptedPayloadMode:
+		if wh.EncryptionKey == "" {
+			return creds, fmt.Errorf("webhook %s has payload mode %s but no encryption key", wh.Endpoint, wh.PayloadMode)
+		}
+		data, err := json.Marshal(credential)
+		if err != nil {
+			return creds, fmt.Errorf("failed to encode credentials: %s", err.Error())
+		}
+		creds.Encrypted, err = webhook.Encrypt(wh.EncryptionKey, data)
+		if err != nil {
+			return creds, err
+		}
+	}
+	return creds, nil
+}
+
+// sendWebhook sends the event of the delivery with the given payload to the webhook
+func sendWebhook(sender *webhook.Sender, syncConfigName string, wh crdv1.WebhookConfig, delivery crdv1.WebhookDelivery, data interface{}) error {
+	code, err := sender.Send(wh, webhook.Event{
+		ID:      delivery.ID,
+		Type:    eventType(delivery),
+		Source:  webhook.Source(syncConfigName),
+		Subject: delivery.Project,
+		Time:    delivery.CreatedAt.Time,
+		Data:    data,
+	})
+	if code == 0 {
+		webhookCounter.WithLabelValues(syncConfigName, wh.Endpoint, "error").Inc()
+	} else {
+		webhookCounter.WithLabelValues(syncConfigName, wh.Endpoint, strconv.Itoa(code)).Inc()
+	}
+	return err
+}
+
+// webhookConfig returns the webhook with the given endpoint
+func webhookConfig(webhooks []crdv1.WebhookConfig, endpoint string) *crdv1.WebhookConfig {
+	for i := range webhooks {
+		if webhooks[i].Endpoint == endpoint {
+			return &webhooks[i]
+		}
+	}
+	return nil
+}
+
+// webhookBackoff returns the time to wait after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookRetryBackoff
+	for i := 1; i < attempts && backoff < webhookMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxRetryBackoff {
+		return webhookMaxRetryBackoff
+	}
+	return backoff
+}
+
+// hasDueWebhooks returns true if the sync config has pending webhook events which are due
+func hasDueWebhooks(syncConfig crdv1.HarborSync, now time.Time) bool {
+	for _, delivery := range syncConfig.Status.WebhookDeliveries {
+		if !delivery.NextAttempt.Time.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchWebhooks emits an event for every sync config with pending webhook events which are due,
+// the events are delivered with the reconciliation. The pending events are read from the status,
+// so that a new leader continues where the previous one stopped. It blocks until the context is done.
+func (r *HarborSyncConfigReconciler) dispatchWebhooks(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(webhookDispatchInterval):
+		}
+		var syncConfigs crdv1.HarborSyncList
+		err := r.List(ctx, &syncConfigs)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"component": "webhook-dispatcher",
+			}).Errorf("unable to list sync configs: %s", err.Error())
+			continue
+		}
+		for i := range syncConfigs.Items {
+			if !hasDueWebhooks(syncConfigs.Items[i], time.Now()) {
+				continue
+			}
+			select {
+			case events <- event.GenericEvent{Object: &syncConfigs.Items[i]}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
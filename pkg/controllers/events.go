@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+// reasons of the Kubernetes Events recorded on HarborSyncs and on the secrets they write
+const (
+	reasonRobotRotated      = "RobotRotated"
+	reasonRobotExpiring     = "RobotExpiring"
+	reasonRotationFailed    = "RotationFailed"
+	reasonMappingFailed     = "MappingFailed"
+	reasonReconcileFailed   = "ReconcileFailed"
+	reasonProjectMatched    = "ProjectMatched"
+	reasonProjectUnmatched  = "ProjectUnmatched"
+	reasonSecretCreated     = "SecretCreated"
+	reasonSecretUpdated     = "SecretUpdated"
+	reasonSecretDeleted     = "SecretDeleted"
+	reasonInvalidAnnotation = "InvalidAnnotation"
+)
+
+// recordEvent records a Kubernetes Event on the object. A nil recorder records nothing.
+func recordEvent(recorder record.EventRecorder, obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if recorder == nil {
+		return
+	}
+	recorder.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// recordingClient records an Event on every secret it creates or updates,
+// so that the owners of the namespaces see when their pull secrets changed.
+// Other objects are written without an Event.
+type recordingClient struct {
+	client.Client
+	recorder   record.EventRecorder
+	syncConfig string
+}
+
+// newRecordingClient returns a client which records the writes of secrets
+func newRecordingClient(cl client.Client, recorder record.EventRecorder, syncConfig string) client.Client {
+	if recorder == nil {
+		return cl
+	}
+	return &recordingClient{Client: cl, recorder: recorder, syncConfig: syncConfig}
+}
+
+// Create implements client.Writer
+func (c *recordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	err := c.Client.Create(ctx, obj, opts...)
+	if err == nil {
+		c.record(obj, reasonSecretCreated, "created")
+	}
+	return err
+}
+
+// Update implements client.Writer
+func (c *recordingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	err := c.Client.Update(ctx, obj, opts...)
+	if err == nil {
+		c.record(obj, reasonSecretUpdated, "updated")
+	}
+	return err
+}
+
+func (c *recordingClient) record(obj client.Object, reason, action string) {
+	if _, ok := obj.(*v1.Secret); !ok {
+		return
+	}
+	c.recorder.Eventf(obj, v1.EventTypeNormal, reason, "%s by HarborSync %s", secretMessage(obj, action), c.syncConfig)
+}
+
+// recordDeletedSecrets records an Event on every secret which has been deleted by the garbage collection
+func recordDeletedSecrets(recorder record.EventRecorder, cfg *crdv1.HarborSync, secrets []v1.Secret) {
+	for i := range secrets {
+		recordEvent(recorder, &secrets[i], v1.EventTypeNormal, reasonSecretDeleted, "%s by HarborSync %s", secretMessage(&secrets[i], "deleted"), cfg.ObjectMeta.Name)
+		recordEvent(recorder, cfg, v1.EventTypeNormal, reasonSecretDeleted, "Deleted secret %s/%s", secrets[i].Namespace, secrets[i].Name)
+	}
+}
+
+// secretMessage describes the change of a pull secret
+func secretMessage(obj client.Object, action string) string {
+	if project := obj.GetAnnotations()[crdv1.ProjectAnnotation]; project != "" {
+		return fmt.Sprintf("Pull secret for harbor project %s %s", project, action)
+	}
+	return fmt.Sprintf("Pull secret %s", action)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// finalize cleans up after a HarborSync has been deleted and removes the finalizer.
+// The secrets are deleted or released according to the deletion policy. The robot accounts
+// are revoked and their credentials are deleted only with robot deletion policy Delete.
+// In all cases the metrics of the config are deleted.
+func (r *HarborSyncConfigReconciler) finalize(syncConfig *crdv1.HarborSync) error {
+	if !controllerutil.ContainsFinalizer(syncConfig, crdv1.Finalizer) {
+		return nil
+	}
+	logger := log.WithFields(log.Fields{
+		"config": syncConfig.ObjectMeta.Name,
+	})
+	logger.Info("cleaning up deleted config")
+	if syncConfig.Spec.RobotDeletionPolicy == crdv1.DeletionPolicyDelete {
+		err := r.deleteRobotAccounts(*syncConfig)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := reconciler.GarbageCollectSecrets(r, *syncConfig, nil)
+	if err != nil {
+		return err
+	}
+	deleteConfigMetrics(syncConfig.ObjectMeta.Name)
+	r.credentialChecks.Delete(syncConfig.ObjectMeta.Name)
+	r.credentialRejections.Delete(syncConfig.ObjectMeta.Name)
+	r.recreateProjects.Delete(syncConfig.ObjectMeta.Name)
+
+	controllerutil.RemoveFinalizer(syncConfig, crdv1.Finalizer)
+	err = r.Update(context.Background(), syncConfig)
+	if err != nil {
+		return fmt.Errorf("unable to remove finalizer: %s", err.Error())
+	}
+	logger.Info("removed finalizer")
+	return nil
+}
+
+// deleteRobotAccounts revokes the robot accounts of the config in all matching projects.
+// Robot accounts which are also used by another config are kept.
+func (r *HarborSyncConfigReconciler) deleteRobotAccounts(syncConfig crdv1.HarborSync) error {
+	// the limit of matching projects does not apply:
+	// only robot accounts with the suffix of the config are deleted
+	matches, err := findMatches(syncConfig, r.Harbor, 0)
+	if err != nil {
+		return fmt.Errorf("unable to find matches: %s", err.Error())
+	}
+	var syncConfigs crdv1.HarborSyncList
+	err = r.List(context.Background(), &syncConfigs)
+	if err != nil {
+		return fmt.Errorf("unable to list sync configs: %s", err.Error())
+	}
+	var errs []string
+	for _, project := range matches {
+		if sharedRobotAccount(syncConfig, syncConfigs.Items, project) {
+			log.WithFields(log.Fields{
+				"config":  syncConfig.ObjectMeta.Name,
+				"project": project.Name,
+			}).Info("robot account is used by another config, not deleting it")
+			continue
+		}
+		err = reconciler.DeleteRobotAccounts(r.Harbor, r.CredCache, project, syncConfig.Spec.RobotAccountSuffix)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("error deleting robot accounts: %s", strings.Join(errs, " | "))
+}
+
+// sharedRobotAccount returns true if another config which is not being deleted
+// manages the robot account with the same or an overlapping suffix in the project
+func sharedRobotAccount(syncConfig crdv1.HarborSync, syncConfigs []crdv1.HarborSync, project harbor.Project) bool {
+	for _, other := range syncConfigs {
+		if other.ObjectMeta.Name == syncConfig.ObjectMeta.Name ||
+			!other.ObjectMeta.DeletionTimestamp.IsZero() ||
+			!reconciler.SuffixesOverlap(other.Spec.RobotAccountSuffix, syncConfig.Spec.RobotAccountSuffix) {
+			continue
+		}
+		matcher, err := regexp.Compile(other.Spec.ProjectName)
+		if err != nil {
+			continue
+		}
+		if matcher.MatchString(project.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -19,6 +19,7 @@ package controllers
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
@@ -35,10 +36,84 @@ var (
 		Name: "harbor_sync_robot_updated",
 		Help: "The number of robot account updates",
 	}, []string{"config", "project", "suffix"})
+	missingCredentialsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "harbor_sync_missing_credentials",
+		Help: "The number of existing robot accounts whose credentials are missing from the store per HarborSync",
+	}, []string{"config"})
+	recreationPausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "harbor_sync_recreation_paused",
+		Help: "Is 1 if the re-creation of robot accounts is paused because too many credentials are missing",
+	}, []string{"config"})
+	orphanedRobotsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "harbor_sync_orphaned_robot_accounts",
+		Help: "The number of robot accounts created by harbor-sync which are not claimed by any HarborSync",
+	}, []string{"project"})
+	reapedRobotsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harbor_sync_reaped_robot_accounts",
+		Help: "The number of orphaned robot accounts which have been deleted",
+	}, []string{"project"})
+	credentialsValidGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "harbor_sync_credentials_valid",
+		Help: "Is 1 if the stored credentials of the project authenticated at the registry with the last verification, 0 if they were rejected",
+	}, []string{"config", "project"})
+	pendingWebhooksGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "harbor_sync_pending_webhooks",
+		Help: "The number of webhook events which have not been delivered yet",
+	}, []string{"config"})
+	expiredWebhooksCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harbor_sync_expired_webhooks",
+		Help: "The number of webhook events which expired before they could be delivered",
+	}, []string{"config", "target"})
 )
 
 func init() {
 	metrics.Registry.Register(matchingProjectsGauge)
 	metrics.Registry.Register(webhookCounter)
 	metrics.Registry.Register(robotChangedCounter)
+	metrics.Registry.Register(missingCredentialsGauge)
+	metrics.Registry.Register(recreationPausedGauge)
+	metrics.Registry.Register(orphanedRobotsGauge)
+	metrics.Registry.Register(reapedRobotsCounter)
+	metrics.Registry.Register(credentialsValidGauge)
+	metrics.Registry.Register(pendingWebhooksGauge)
+	metrics.Registry.Register(expiredWebhooksCounter)
+}
+
+// metricVec is a GaugeVec or CounterVec
+type metricVec interface {
+	prometheus.Collector
+	Delete(prometheus.Labels) bool
+}
+
+// deleteConfigMetrics deletes all series which belong to the given config
+func deleteConfigMetrics(config string) {
+	for _, vec := range []metricVec{matchingProjectsGauge, webhookCounter, robotChangedCounter, missingCredentialsGauge, recreationPausedGauge, credentialsValidGauge, pendingWebhooksGauge, expiredWebhooksCounter} {
+		deleteSeries(vec, "config", config)
+	}
+}
+
+// deleteSeries deletes all series of the vector with the given label value
+func deleteSeries(vec metricVec, label, value string) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	var matches []prometheus.Labels
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			continue
+		}
+		labels := prometheus.Labels{}
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels[label] == value {
+			matches = append(matches, labels)
+		}
+	}
+	for _, labels := range matches {
+		vec.Delete(labels)
+	}
 }
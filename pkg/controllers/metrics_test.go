@@ -0,0 +1,37 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	It("should delete the series of a config", func() {
+		webhookCounter.WithLabelValues("metrics-a", "http://example.com", "200").Inc()
+		webhookCounter.WithLabelValues("metrics-a", "http://example.com", "500").Inc()
+		webhookCounter.WithLabelValues("metrics-b", "http://example.com", "200").Inc()
+		before := testutil.CollectAndCount(webhookCounter)
+
+		deleteConfigMetrics("metrics-a")
+		Expect(testutil.CollectAndCount(webhookCounter)).To(Equal(before - 2))
+		Expect(testutil.ToFloat64(webhookCounter.WithLabelValues("metrics-b", "http://example.com", "200"))).To(Equal(1.0))
+	})
+})
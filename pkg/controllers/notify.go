@@ -0,0 +1,167 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// keepProjectStatus keeps the status of the projects which still match but have not been reconciled,
+// e.g. because their robot accounts have been deferred by the rate limit. It copies the conditions
+// of the previous project status.
+func keepProjectStatus(status *crdv1.HarborSyncStatus, previous []crdv1.ProjectStatus, matches []harbor.Project) {
+	for _, p := range previous {
+		if findProjectStatus(status.ProjectList, p.Name) == nil && findProject(matches, p.Name) != nil {
+			status.ProjectList = append(status.ProjectList, p)
+		}
+	}
+	keepProjectConditions(status, previous)
+}
+
+// enqueueMatchEvents adds an event and records a Kubernetes Event for every project
+// which started or stopped matching the sync config
+func enqueueMatchEvents(cfg *crdv1.HarborSync, recorder record.EventRecorder, previous []crdv1.ProjectStatus) {
+	for _, p := range cfg.Status.ProjectList {
+		if findProjectStatus(previous, p.Name) == nil {
+			recordEvent(recorder, cfg, v1.EventTypeNormal, reasonProjectMatched, "Project %s matches", p.Name)
+			enqueueEvent(cfg, crdv1.WebhookEventPayload{
+				Type:    crdv1.ProjectMatchedEvent,
+				Project: p.Name,
+			})
+		}
+	}
+	for _, p := range previous {
+		if findProjectStatus(cfg.Status.ProjectList, p.Name) == nil {
+			recordEvent(recorder, cfg, v1.EventTypeNormal, reasonProjectUnmatched, "Project %s no longer matches", p.Name)
+			enqueueEvent(cfg, crdv1.WebhookEventPayload{
+				Type:    crdv1.ProjectUnmatchedEvent,
+				Project: p.Name,
+			})
+		}
+	}
+}
+
+// updateRobotStatus sets the expiry of the robot accounts in the project status and the RobotExpiring condition
+// of the projects whose robot accounts expire within the rotation interval. It adds an event and records
+// a Kubernetes Event if a robot account starts expiring.
+// The rotated projects get no condition, their robot accounts have just been created.
+func updateRobotStatus(cfg *crdv1.HarborSync, api harbor.API, store reconciler.CredentialStore, recorder record.EventRecorder, projects []harbor.Project, rotated []string, rotationInterval time.Duration) {
+	for i, status := range cfg.Status.ProjectList {
+		project := findProject(projects, status.Name)
+		if project == nil {
+			continue
+		}
+		robot, err := reconciler.FindRobotAccount(api, store, *project, cfg.Spec.RobotAccountSuffix)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config":  cfg.ObjectMeta.Name,
+				"project": project.Name,
+			}).Error(err)
+			continue
+		}
+		cfg.Status.ProjectList[i].RobotExpiresAt = metav1.Time{}
+		if robot != nil && robot.ExpiresAt > 0 {
+			cfg.Status.ProjectList[i].RobotExpiresAt = metav1.Unix(robot.ExpiresAt, 0)
+		}
+		if contains(rotated, status.Name) {
+			continue
+		}
+		if robot == nil || !reconciler.ExpiresWithin(*robot, rotationInterval) {
+			cfg.Status.ProjectList[i].Conditions = filterOutCondition(status.Conditions, crdv1.ProjectRobotExpiring)
+			continue
+		}
+		expiresAt := time.Unix(robot.ExpiresAt, 0).UTC()
+		c := NewSyncCondition(crdv1.ProjectRobotExpiring, v1.ConditionTrue, "Expiring",
+			fmt.Sprintf("robot account %s expires at %s and has not been rotated", robot.Name, expiresAt.Format(time.RFC3339)))
+		cfg.Status.ProjectList[i].Conditions = setCondition(status.Conditions, *c)
+		if current := getCondition(status.Conditions, crdv1.ProjectRobotExpiring); current != nil && current.Status == v1.ConditionTrue {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"config":        cfg.ObjectMeta.Name,
+			"project":       project.Name,
+			"robot_account": robot.Name,
+			"expires_at":    expiresAt,
+		}).Warn("robot account expires soon and has not been rotated")
+		recordEvent(recorder, cfg, v1.EventTypeWarning, reasonRobotExpiring, "Robot account %s of project %s expires at %s and has not been rotated",
+			robot.Name, project.Name, expiresAt.Format(time.RFC3339))
+		enqueueEvent(cfg, crdv1.WebhookEventPayload{
+			Type:         crdv1.RobotExpiringEvent,
+			Project:      project.Name,
+			RobotAccount: robot.Name,
+			ExpiresAt:    robot.ExpiresAt,
+		})
+	}
+}
+
+// enqueueFailure adds an event if the reconciliation of the sync config started failing
+func enqueueFailure(cfg *crdv1.HarborSync, wasFailing bool) {
+	c := GetSyncCondition(cfg.Status, crdv1.HarborSyncReady)
+	if wasFailing || c == nil || c.Status != v1.ConditionFalse {
+		return
+	}
+	enqueueEvent(cfg, crdv1.WebhookEventPayload{
+		Type:  crdv1.ReconcileFailedEvent,
+		Error: c.Message,
+	})
+}
+
+// enqueueDeletedSecrets adds an event for every deleted secret
+func enqueueDeletedSecrets(cfg *crdv1.HarborSync, secrets []v1.Secret) {
+	for _, secret := range secrets {
+		enqueueEvent(cfg, crdv1.WebhookEventPayload{
+			Type:      crdv1.SecretDeletedEvent,
+			Project:   secret.Annotations[crdv1.ProjectAnnotation],
+			Namespace: secret.Namespace,
+			Secret:    secret.Name,
+		})
+	}
+}
+
+// isFailing returns true if the Ready condition of the status is false
+func isFailing(status crdv1.HarborSyncStatus) bool {
+	c := GetSyncCondition(status, crdv1.HarborSyncReady)
+	return c != nil && c.Status == v1.ConditionFalse
+}
+
+func findProject(projects []harbor.Project, name string) *harbor.Project {
+	for i := range projects {
+		if projects[i].Name == name {
+			return &projects[i]
+		}
+	}
+	return nil
+}
+
+func findProjectStatus(projects []crdv1.ProjectStatus, name string) *crdv1.ProjectStatus {
+	for i := range projects {
+		if projects[i].Name == name {
+			return &projects[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// watchRemovedProjects reads the projects which have been removed from harbor,
+// cleans up after them and emits an event for every affected sync config.
+// It blocks until the context is done.
+func (r *HarborSyncConfigReconciler) watchRemovedProjects(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case project := <-r.RemovedProjects:
+			syncConfigs, err := r.removeProject(project)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"project": project.Name,
+				}).Error(err)
+			}
+			for i := range syncConfigs {
+				select {
+				case events <- event.GenericEvent{Object: &syncConfigs[i]}:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// removeProject deletes the credentials and the secrets of the removed project and
+// returns the sync configs which managed the project. They are marked to be reconciled
+// regardless of the last reconciliation: the reconciliation removes the project
+// from the status. The secrets are collected here because the garbage collection of the
+// reconciliation refuses to collect all secrets of a sync config if no project matches.
+// Paused sync configs are not changed, their secrets are collected once they are resumed.
+func (r *HarborSyncConfigReconciler) removeProject(project harbor.Project) ([]crdv1.HarborSync, error) {
+	var syncConfigs crdv1.HarborSyncList
+	err := r.List(context.Background(), &syncConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sync configs: %s", err.Error())
+	}
+	var affected []crdv1.HarborSync
+	for _, syncConfig := range syncConfigs.Items {
+		if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() || !managesProject(syncConfig, project) {
+			continue
+		}
+		if isPaused(syncConfig) {
+			log.WithFields(log.Fields{
+				"config":  syncConfig.ObjectMeta.Name,
+				"project": project.Name,
+			}).Infof("project has been removed from harbor, not cleaning up until the annotation %s is removed", crdv1.PausedAnnotation)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"config":  syncConfig.ObjectMeta.Name,
+			"project": project.Name,
+		}).Info("project has been removed from harbor, cleaning up")
+		err = reconciler.DeleteCredentials(r.CredCache, project, syncConfig.Spec.RobotAccountSuffix)
+		if err != nil {
+			return affected, err
+		}
+		deleted, err := reconciler.GarbageCollectProjectSecrets(r, syncConfig, project)
+		recordDeletedSecrets(r.Recorder, &syncConfig, deleted)
+		if err != nil {
+			return affected, err
+		}
+		r.forceSync.Store(syncConfig.ObjectMeta.Name, struct{}{})
+		affected = append(affected, syncConfig)
+	}
+	return affected, nil
+}
+
+// managesProject returns true if the project matches the sync config
+// or if the sync config reported it in its status
+func managesProject(syncConfig crdv1.HarborSync, project harbor.Project) bool {
+	for _, p := range syncConfig.Status.ProjectList {
+		if p.Name == project.Name {
+			return true
+		}
+	}
+	matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
+	if err != nil {
+		return false
+	}
+	return matcher.MatchString(project.Name)
+}
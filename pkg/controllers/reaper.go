@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// RobotReaper finds robot accounts which have been created by harbor-sync
+// but are not claimed by any HarborSync anymore, e.g. because the suffix changed
+// or the HarborSync has been deleted with deletion policy Retain.
+// Orphaned robot accounts are reported. If Delete is set they are deleted
+// once they have been orphaned for longer than the GracePeriod.
+// Only robot accounts with the description of the InstanceID are considered,
+// the robot accounts of other installations which share the harbor are ignored.
+type RobotReaper struct {
+	client.Client
+	Harbor      harbor.API
+	CredCache   reconciler.CredentialStore
+	Interval    time.Duration
+	GracePeriod time.Duration
+	Delete      bool
+	InstanceID  string
+
+	// LegacySuffixes contains suffixes which have been used by HarborSyncs in the past.
+	// Earlier versions of harbor-sync created robot accounts without description, see legacyRobotAccount.
+	LegacySuffixes []string
+
+	// orphanedSince contains the time when a robot account
+	// has been found to be orphaned for the first time
+	orphanedSince map[string]time.Time
+}
+
+// Start runs the reaper until the context is done
+func (r *RobotReaper) Start(ctx context.Context) error {
+	for {
+		err := r.Reap()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"component": "reaper",
+			}).Error(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+// Reap reports the orphaned robot accounts and deletes those
+// whose grace period has expired if Delete is set
+func (r *RobotReaper) Reap() error {
+	var syncConfigs crdv1.HarborSyncList
+	err := r.List(context.Background(), &syncConfigs)
+	if err != nil {
+		return fmt.Errorf("unable to list sync configs: %s", err.Error())
+	}
+	projects, err := r.Harbor.ListProjects()
+	if err != nil {
+		return fmt.Errorf("could not list harbor projects: %s", err.Error())
+	}
+	if r.orphanedSince == nil {
+		r.orphanedSince = make(map[string]time.Time)
+	}
+	orphanedSince := make(map[string]time.Time)
+	orphanedRobotsGauge.Reset()
+	suffixes := append([]string{}, r.LegacySuffixes...)
+	for _, syncConfig := range syncConfigs.Items {
+		suffixes = append(suffixes, syncConfig.Spec.RobotAccountSuffix)
+	}
+	description := harbor.InstanceRobotDescription(r.InstanceID)
+	for _, project := range projects {
+		robots, err := r.Harbor.GetRobotAccounts(project)
+		if err != nil {
+			return fmt.Errorf("could not get robot accounts from harbor: %s", err.Error())
+		}
+		for _, robot := range robots {
+			legacy := legacyRobotAccount(robot, project, suffixes)
+			if (robot.Description != description && !legacy) || claimsRobotAccount(syncConfigs.Items, project, robot) {
+				continue
+			}
+			logger := log.WithFields(log.Fields{
+				"component":     "reaper",
+				"project_name":  project.Name,
+				"robot_account": robot.Name,
+			})
+			// robot accounts without description may have been created by someone else, they are never deleted
+			if legacy {
+				logger.Warn("found orphaned robot account without description, it must be deleted manually")
+				orphanedRobotsGauge.WithLabelValues(project.Name).Inc()
+				continue
+			}
+			key := fmt.Sprintf("%s/%s", project.Name, robot.Name)
+			since, ok := r.orphanedSince[key]
+			if !ok {
+				since = time.Now()
+			}
+			if !r.Delete || since.Add(r.GracePeriod).After(time.Now()) {
+				logger.Warn("found orphaned robot account")
+				orphanedSince[key] = since
+				orphanedRobotsGauge.WithLabelValues(project.Name).Inc()
+				continue
+			}
+			logger.Info("deleting orphaned robot account")
+			err = r.Harbor.DeleteRobotAccount(project, robot.ID)
+			if err != nil {
+				return fmt.Errorf("could not delete robot account: %s", err.Error())
+			}
+			err = r.CredCache.Delete(project.Name, robot.Name)
+			if err != nil {
+				return fmt.Errorf("could not delete credentials from store: %s", err.Error())
+			}
+			reapedRobotsCounter.WithLabelValues(project.Name).Inc()
+		}
+	}
+	r.orphanedSince = orphanedSince
+	return nil
+}
+
+// claimsRobotAccount returns true if a sync config which is not being deleted
+// matches the project and manages the robot account
+func claimsRobotAccount(syncConfigs []crdv1.HarborSync, project harbor.Project, robot harbor.Robot) bool {
+	for _, syncConfig := range syncConfigs {
+		if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() ||
+			!reconciler.MatchRobotAccount(robot, project, syncConfig.Spec.RobotAccountSuffix) {
+			continue
+		}
+		matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
+		if err != nil {
+			// be conservative: the config may match once it has been fixed
+			return true
+		}
+		if matcher.MatchString(project.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyRobotAccount returns true if the robot account may have been created by an earlier version
+// of harbor-sync which did not set the description: it has no description and its name
+// has the robot account prefix and one of the suffixes.
+func legacyRobotAccount(robot harbor.Robot, project harbor.Project, suffixes []string) bool {
+	if robot.Description != "" {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if reconciler.MatchRobotAccount(robot, project, suffix) {
+			return true
+		}
+	}
+	return false
+}
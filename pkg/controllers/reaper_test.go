@@ -0,0 +1,162 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	harborfake "github.com/moolen/harbor-sync/pkg/harbor/fake"
+	store "github.com/moolen/harbor-sync/pkg/store/disk"
+	"github.com/moolen/harbor-sync/pkg/test"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("RobotReaper", func() {
+	It("should report and delete orphaned robot accounts", func() {
+		test.EnsureHarborSyncConfigWithParams(k8sClient, "my-reaper-cfg", "team-(foo)", nil, nil)
+		defer test.DeleteHarborSyncConfig(k8sClient, "my-reaper-cfg")
+
+		credStore, _ := store.NewTemp()
+		defer credStore.Reset()
+		credStore.Set("team-foo", crdv1.RobotAccountCredential{Name: "robot$team-foo+old-bot", Token: "1234"})
+
+		var deleted []string
+		fakeHarbor := &harborfake.Client{
+			ListProjectsFunc: func() ([]harbor.Project, error) {
+				return []harbor.Project{{ID: 1, Name: "team-foo"}}, nil
+			},
+			GetRobotAccountsFunc: func(project harbor.Project) ([]harbor.Robot, error) {
+				return []harbor.Robot{
+					// claimed by my-reaper-cfg
+					{ID: 1, Name: "robot$sync-bot", Description: harbor.RobotDescription},
+					// suffix has changed
+					{ID: 2, Name: "robot$team-foo+old-bot", Description: harbor.RobotDescription},
+					// not created by harbor-sync
+					{ID: 3, Name: "robot$ci"},
+				}, nil
+			},
+			DeleteRobotAccountFunc: func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, project.Name)
+				return nil
+			},
+		}
+		reaper := &RobotReaper{
+			Client:      k8sClient,
+			Harbor:      fakeHarbor,
+			CredCache:   credStore,
+			GracePeriod: time.Hour,
+		}
+
+		// report only
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(deleted).To(BeEmpty())
+		Expect(credStore.Has("team-foo", "robot$team-foo+old-bot")).To(BeTrue())
+		Expect(testutil.ToFloat64(orphanedRobotsGauge.WithLabelValues("team-foo"))).To(Equal(1.0))
+
+		// grace period has not expired
+		reaper.Delete = true
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(deleted).To(BeEmpty())
+
+		reaper.orphanedSince["team-foo/robot$team-foo+old-bot"] = time.Now().Add(-time.Hour * 2)
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(deleted).To(Equal([]string{"team-foo"}))
+		Expect(credStore.Has("team-foo", "robot$team-foo+old-bot")).To(BeFalse())
+		Expect(testutil.CollectAndCount(orphanedRobotsGauge)).To(Equal(0))
+	})
+
+	It("should report but not delete orphaned robot accounts of earlier versions", func() {
+		test.EnsureHarborSyncConfigWithParams(k8sClient, "my-reaper-cfg", "team-(foo)", nil, nil)
+		defer test.DeleteHarborSyncConfig(k8sClient, "my-reaper-cfg")
+
+		credStore, _ := store.NewTemp()
+		defer credStore.Reset()
+
+		var deleted []string
+		fakeHarbor := &harborfake.Client{
+			ListProjectsFunc: func() ([]harbor.Project, error) {
+				return []harbor.Project{{ID: 1, Name: "team-foo"}, {ID: 2, Name: "team-bar"}}, nil
+			},
+			GetRobotAccountsFunc: func(project harbor.Project) ([]harbor.Robot, error) {
+				return []harbor.Robot{
+					// claimed by my-reaper-cfg in team-foo, orphaned in team-bar
+					{ID: 1, Name: "robot$sync-bot"},
+					// created with a historical suffix
+					{ID: 2, Name: "robot$" + project.Name + "+old-bot"},
+					// not created by harbor-sync
+					{ID: 3, Name: "robot$ci"},
+				}, nil
+			},
+			DeleteRobotAccountFunc: func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, project.Name)
+				return nil
+			},
+		}
+		reaper := &RobotReaper{
+			Client:         k8sClient,
+			Harbor:         fakeHarbor,
+			CredCache:      credStore,
+			GracePeriod:    0,
+			Delete:         true,
+			LegacySuffixes: []string{"old-bot"},
+		}
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(deleted).To(BeEmpty())
+		Expect(testutil.ToFloat64(orphanedRobotsGauge.WithLabelValues("team-foo"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(orphanedRobotsGauge.WithLabelValues("team-bar"))).To(Equal(2.0))
+	})
+
+	It("should ignore the robot accounts of other instances", func() {
+		credStore, _ := store.NewTemp()
+		defer credStore.Reset()
+
+		var deleted []int
+		fakeHarbor := &harborfake.Client{
+			ListProjectsFunc: func() ([]harbor.Project, error) {
+				return []harbor.Project{{ID: 1, Name: "team-foo"}}, nil
+			},
+			GetRobotAccountsFunc: func(project harbor.Project) ([]harbor.Robot, error) {
+				return []harbor.Robot{
+					// created by this instance
+					{ID: 1, Name: "robot$team-foo+old-bot", Description: harbor.InstanceRobotDescription("cluster-a")},
+					// created by another instance which shares the harbor
+					{ID: 2, Name: "robot$team-foo+other-bot", Description: harbor.InstanceRobotDescription("cluster-b")},
+					{ID: 3, Name: "robot$team-foo+unnamed-bot", Description: harbor.RobotDescription},
+				}, nil
+			},
+			DeleteRobotAccountFunc: func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, robotID)
+				return nil
+			},
+		}
+		reaper := &RobotReaper{
+			Client:     k8sClient,
+			Harbor:     fakeHarbor,
+			CredCache:  credStore,
+			Delete:     true,
+			InstanceID: "cluster-a",
+		}
+		Expect(reaper.Reap()).To(Succeed())
+		Expect(deleted).To(Equal([]int{1}))
+		Expect(testutil.ToFloat64(orphanedRobotsGauge.WithLabelValues("team-foo"))).To(Equal(0.0))
+	})
+})
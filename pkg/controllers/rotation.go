@@ -0,0 +1,165 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// stagedRotation rotates the robot accounts of a sync config in stages, see crdv1.RotationStrategy.
+// The canaries are rotated first, the remaining projects which are due for rotation
+// are held back if credentials failed the verification. The robot accounts of projects
+// whose new credentials failed keep working, see reconciler.RotateRobotAccount.
+// The canaries are retried with the next reconciliation.
+type stagedRotation struct {
+	registry harbor.Registry
+
+	// due contains the current credentials of the projects which are due for rotation
+	due map[string]*crdv1.RobotAccountCredential
+
+	// canaries is the number of due projects which are rotated first
+	canaries int
+
+	rotated  int
+	held     int
+	verified int
+
+	// failed contains the verification error of each project
+	failed []string
+}
+
+// newStagedRotation returns nil if the sync config does not specify a rotation strategy
+func newStagedRotation(
+	cfg *crdv1.HarborSync,
+	api harbor.API,
+	store reconciler.CredentialStore,
+	registry harbor.Registry,
+	rotationInterval time.Duration,
+	rotateBefore time.Time,
+	projects []harbor.Project,
+) (*stagedRotation, error) {
+	if cfg.Spec.Rotation == nil || registry == nil {
+		return nil, nil
+	}
+	s := &stagedRotation{
+		registry: registry,
+		due:      make(map[string]*crdv1.RobotAccountCredential),
+	}
+	for _, project := range projects {
+		cred, err := reconciler.RotationDue(api, store, project, cfg.Spec.RobotAccountSuffix, rotationInterval, rotateBefore)
+		if err != nil {
+			return nil, err
+		}
+		if cred != nil {
+			s.due[project.Name] = cred
+		}
+	}
+	if len(s.due) > 0 {
+		s.canaries = int(math.Ceil(float64(len(s.due)) * float64(cfg.Spec.Rotation.CanaryPercent) / 100))
+		if s.canaries < 1 {
+			s.canaries = 1
+		}
+	}
+	return s, nil
+}
+
+// sort orders the projects so that the projects which are due for rotation come first
+func (s *stagedRotation) sort(projects []harbor.Project) []harbor.Project {
+	if s == nil {
+		return projects
+	}
+	sorted := make([]harbor.Project, len(projects))
+	copy(sorted, projects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		_, dueI := s.due[sorted[i].Name]
+		_, dueJ := s.due[sorted[j].Name]
+		return dueI && !dueJ
+	})
+	return sorted
+}
+
+// hold returns the current credentials of the project if its rotation must be held back.
+// It returns nil if the project may be reconciled.
+func (s *stagedRotation) hold(project harbor.Project) *crdv1.RobotAccountCredential {
+	if s == nil {
+		return nil
+	}
+	cred, ok := s.due[project.Name]
+	if !ok {
+		return nil
+	}
+	if s.rotated < s.canaries || len(s.failed) == 0 {
+		s.rotated++
+		return nil
+	}
+	s.held++
+	return cred
+}
+
+// staged returns true if the robot account of the project is due for rotation and must be replaced
+// with reconciler.RotateRobotAccount: the previous robot account is kept until the new one is verified.
+// Robot accounts which are re-created for another reason, e.g. because they are disabled, are not staged.
+func (s *stagedRotation) staged(project harbor.Project) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.due[project.Name]
+	return ok
+}
+
+// verify logs in at the registry with the new credentials of the project
+func (s *stagedRotation) verify(project harbor.Project, cred *crdv1.RobotAccountCredential) error {
+	if s == nil {
+		return nil
+	}
+	err := s.registry.Login(cred.Name, cred.Token)
+	if err != nil {
+		s.failed = append(s.failed, fmt.Sprintf("credentials of project %s failed verification: %s", project.Name, err.Error()))
+		return err
+	}
+	s.verified++
+	return nil
+}
+
+// condition returns the RotationFailed condition. It returns nil if the condition must not change:
+// if no credentials have been verified because the changes have been deferred.
+func (s *stagedRotation) condition(deferred bool) *crdv1.HarborSyncStatusCondition {
+	if s == nil {
+		return NewSyncCondition(crdv1.HarborSyncRotationFailed, v1.ConditionFalse, "Rotation not staged", "Rotation not staged")
+	}
+	if len(s.failed) > 0 {
+		msg := strings.Join(s.failed, "; ")
+		if s.held > 0 {
+			msg = fmt.Sprintf("%s. Rotation of %d projects is held back", msg, s.held)
+		}
+		return NewSyncCondition(crdv1.HarborSyncRotationFailed, v1.ConditionTrue, "Verification failed", msg)
+	}
+	if s.verified == 0 && deferred {
+		return nil
+	}
+	return NewSyncCondition(crdv1.HarborSyncRotationFailed, v1.ConditionFalse, "Credentials verified", "Credentials verified")
+}
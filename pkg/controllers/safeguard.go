@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// pausedProjects returns the projects in which the robot accounts must not be re-created.
+// If the credentials of many existing robot accounts are missing from the store,
+// e.g. because the HarborRobotAccounts have been deleted, the re-creation of these
+// robot accounts is paused until the user acknowledges it with the RecreateRobotsAnnotation.
+// The RecreationPaused condition and the metrics of the sync config are updated.
+func (r *HarborSyncConfigReconciler) pausedProjects(syncConfig *crdv1.HarborSync, projects []harbor.Project) ([]string, error) {
+	missing, existing, err := reconciler.MissingCredentials(r.Harbor, r.CredCache, projects, syncConfig.Spec.RobotAccountSuffix)
+	if err != nil {
+		return nil, err
+	}
+	name := syncConfig.ObjectMeta.Name
+	missingCredentialsGauge.WithLabelValues(name).Set(float64(len(missing)))
+
+	if !r.shouldPauseRecreation(len(missing), existing) || syncConfig.Annotations[crdv1.RecreateRobotsAnnotation] == "true" {
+		recreationPausedGauge.WithLabelValues(name).Set(0)
+		c := NewSyncCondition(crdv1.HarborSyncRecreationPaused, v1.ConditionFalse, "Credentials available", "Credentials available")
+		SetSyncCondition(&syncConfig.Status, *c)
+		return nil, nil
+	}
+
+	msg := fmt.Sprintf("the credentials of %d of %d robot accounts are missing from the store. "+
+		"Set the annotation %s=true to re-create the robot accounts", len(missing), existing, crdv1.RecreateRobotsAnnotation)
+	log.WithFields(log.Fields{
+		"config": name,
+	}).Warn(msg)
+	recreationPausedGauge.WithLabelValues(name).Set(1)
+	c := NewSyncCondition(crdv1.HarborSyncRecreationPaused, v1.ConditionTrue, "Credentials missing", msg)
+	SetSyncCondition(&syncConfig.Status, *c)
+	var paused []string
+	for _, project := range missing {
+		paused = append(paused, project.Name)
+	}
+	return paused, nil
+}
+
+// shouldPauseRecreation returns true if the ratio of missing credentials is abnormal
+func (r *HarborSyncConfigReconciler) shouldPauseRecreation(missing, existing int) bool {
+	if r.MissingCredentialsRatio <= 0 || missing == 0 || missing < r.MissingCredentialsMin {
+		return false
+	}
+	return float64(missing)/float64(existing) >= r.MissingCredentialsRatio
+}
+
+// removeRecreateAnnotation removes the acknowledgement once the robot accounts have been re-created
+func (r *HarborSyncConfigReconciler) removeRecreateAnnotation(syncConfig *crdv1.HarborSync) error {
+	if _, ok := syncConfig.Annotations[crdv1.RecreateRobotsAnnotation]; !ok {
+		return nil
+	}
+	// the patch overwrites the status with the persisted one
+	status := syncConfig.Status
+	patch := client.MergeFrom(syncConfig.DeepCopy())
+	delete(syncConfig.Annotations, crdv1.RecreateRobotsAnnotation)
+	err := r.Patch(context.Background(), syncConfig, patch)
+	syncConfig.Status = status
+	if err != nil {
+		return fmt.Errorf("unable to remove annotation %s: %s", crdv1.RecreateRobotsAnnotation, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// ServiceAccountReconciler attaches the synced secrets to ServiceAccounts
+// as imagePullSecrets. Only secrets which have been written by harbor-sync are attached,
+// so the ServiceAccounts never reference a secret that does not exist yet.
+type ServiceAccountReconciler struct {
+	client.Client
+}
+
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update;patch
+
+// Reconcile reconciles the imagePullSecrets of a ServiceAccount
+func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var sa v1.ServiceAccount
+	if err := r.Get(ctx, req.NamespacedName, &sa); err != nil {
+		if apierrs.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "unable to fetch service account")
+		return ctrl.Result{RequeueAfter: time.Second * 15}, err
+	}
+
+	var syncConfigs crdv1.HarborSyncList
+	if err := r.List(ctx, &syncConfigs); err != nil {
+		log.Error(err, "unable to list sync configs")
+		return ctrl.Result{RequeueAfter: time.Second * 15}, err
+	}
+
+	var secrets v1.SecretList
+	if err := r.List(ctx, &secrets, client.InNamespace(sa.Namespace), client.HasLabels{crdv1.OwnerLabel}); err != nil {
+		log.Error(err, "unable to list secrets")
+		return ctrl.Result{RequeueAfter: time.Second * 15}, err
+	}
+
+	var desired []string
+	for _, syncConfig := range syncConfigs.Items {
+		if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() || !selectsServiceAccount(syncConfig, sa) {
+			continue
+		}
+		// the imagePullSecrets can not be updated without removing those of the paused config
+		if isPaused(syncConfig) {
+			log.WithFields(log.Fields{
+				"config":    syncConfig.ObjectMeta.Name,
+				"namespace": sa.Namespace,
+				"name":      sa.Name,
+			}).Infof("not updating service account until the annotation %s is removed", crdv1.PausedAnnotation)
+			return ctrl.Result{}, nil
+		}
+		names, err := reconciler.ServiceAccountPullSecrets(syncConfig, secrets.Items, sa)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config": syncConfig.ObjectMeta.Name,
+			}).Errorf("unable to get pull secrets for service account: %s", err.Error())
+			return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+		}
+		desired = append(desired, names...)
+	}
+
+	err := reconciler.UpdateServiceAccountPullSecrets(r, sa, desired)
+	if err != nil {
+		log.Error(err)
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager setup the controller with the manager.
+// ServiceAccounts are reconciled when they change, when the spec of a HarborSync changes or it is resumed and
+// when a secret written by harbor-sync is created or deleted in their namespace.
+// The secrets follow the namespaces: a new namespace gets its secrets
+// from the HarborSync controller, which in turn triggers its ServiceAccounts.
+func (r *ServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1.ServiceAccount{}, builder.WithPredicates(serviceAccountChanged)).
+		Watches(
+			&source.Kind{Type: &crdv1.HarborSync{}},
+			handler.EnqueueRequestsFromMapFunc(r.serviceAccountsForSyncConfig),
+			builder.WithPredicates(predicate.Or(predicate.GenerationChangedPredicate{}, pausedChanged)),
+		).
+		Watches(
+			&source.Kind{Type: &v1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.serviceAccountsForSecret),
+			builder.WithPredicates(ownedSecretAddedOrRemoved),
+		).
+		Complete(r)
+}
+
+// serviceAccountChanged filters ServiceAccount events: only new ServiceAccounts and
+// changes of the labels, annotations or imagePullSecrets are relevant
+var serviceAccountChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldSA, ok := e.ObjectOld.(*v1.ServiceAccount)
+		if !ok {
+			return false
+		}
+		newSA, ok := e.ObjectNew.(*v1.ServiceAccount)
+		if !ok {
+			return false
+		}
+		return !reflect.DeepEqual(oldSA.Labels, newSA.Labels) ||
+			!reflect.DeepEqual(oldSA.Annotations, newSA.Annotations) ||
+			!reflect.DeepEqual(oldSA.ImagePullSecrets, newSA.ImagePullSecrets)
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		return false
+	},
+	GenericFunc: func(e event.GenericEvent) bool {
+		return false
+	},
+}
+
+// pausedChanged filters HarborSync events: only HarborSyncs which are paused or resumed are relevant
+var pausedChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.ObjectOld.GetAnnotations()[crdv1.PausedAnnotation] != e.ObjectNew.GetAnnotations()[crdv1.PausedAnnotation]
+	},
+}
+
+// ownedSecretAddedOrRemoved filters secret events: only secrets owned by a HarborSync
+// which are created, deleted or change their owner are relevant
+var ownedSecretAddedOrRemoved = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		return isOwnedSecret(e.Object)
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.ObjectOld.GetLabels()[crdv1.OwnerLabel] != e.ObjectNew.GetLabels()[crdv1.OwnerLabel]
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		return isOwnedSecret(e.Object)
+	},
+	GenericFunc: func(e event.GenericEvent) bool {
+		return false
+	},
+}
+
+// serviceAccountsForSyncConfig returns the ServiceAccounts that may be affected by a change of a HarborSync:
+// those which are selected by one of its mappings and those which reference secrets added by harbor-sync.
+// Only namespaces which contain secrets of the HarborSync are considered: ServiceAccounts are only attached
+// to existing secrets, new and deleted secrets trigger the ServiceAccounts in their namespace, see serviceAccountsForSecret.
+func (r *ServiceAccountReconciler) serviceAccountsForSyncConfig(obj client.Object) []reconcile.Request {
+	syncConfig, ok := obj.(*crdv1.HarborSync)
+	if !ok {
+		return nil
+	}
+	var secrets v1.SecretList
+	if err := r.List(context.Background(), &secrets, client.MatchingLabels{crdv1.OwnerLabel: syncConfig.ObjectMeta.Name}); err != nil {
+		log.Error(err, "unable to list secrets")
+		return nil
+	}
+	var namespaces []string
+	for _, secret := range secrets.Items {
+		if !contains(namespaces, secret.Namespace) {
+			namespaces = append(namespaces, secret.Namespace)
+		}
+	}
+	var reqs []reconcile.Request
+	for _, namespace := range namespaces {
+		var saList v1.ServiceAccountList
+		if err := r.List(context.Background(), &saList, client.InNamespace(namespace)); err != nil {
+			log.Error(err, "unable to list service accounts")
+			return nil
+		}
+		reqs = append(reqs, serviceAccountRequests(saList.Items, []crdv1.HarborSync{*syncConfig})...)
+	}
+	return reqs
+}
+
+// serviceAccountsForSecret returns the ServiceAccounts in the namespace of the secret
+// which may reference it: those which are selected by a mapping of the owning HarborSync
+// and those which reference secrets added by harbor-sync
+func (r *ServiceAccountReconciler) serviceAccountsForSecret(obj client.Object) []reconcile.Request {
+	var syncConfig crdv1.HarborSync
+	var syncConfigs []crdv1.HarborSync
+	err := r.Get(context.Background(), types.NamespacedName{Name: obj.GetLabels()[crdv1.OwnerLabel]}, &syncConfig)
+	if err != nil && !apierrs.IsNotFound(err) {
+		log.Error(err, "unable to fetch sync config")
+		return nil
+	}
+	if err == nil {
+		syncConfigs = append(syncConfigs, syncConfig)
+	}
+	var saList v1.ServiceAccountList
+	if err := r.List(context.Background(), &saList, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.Error(err, "unable to list service accounts")
+		return nil
+	}
+	return serviceAccountRequests(saList.Items, syncConfigs)
+}
+
+// serviceAccountRequests returns the requests for the ServiceAccounts which are selected
+// by one of the sync configs or which reference secrets added by harbor-sync
+func serviceAccountRequests(serviceAccounts []v1.ServiceAccount, syncConfigs []crdv1.HarborSync) []reconcile.Request {
+	var reqs []reconcile.Request
+	for _, sa := range serviceAccounts {
+		_, managed := sa.Annotations[crdv1.ImagePullSecretsAnnotation]
+		selected := false
+		for _, syncConfig := range syncConfigs {
+			selected = selected || selectsServiceAccount(syncConfig, sa)
+		}
+		if !managed && !selected {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name},
+		})
+	}
+	return reqs
+}
+
+// selectsServiceAccount returns true if any of the mappings selects the ServiceAccount
+func selectsServiceAccount(syncConfig crdv1.HarborSync, sa v1.ServiceAccount) bool {
+	for _, mapping := range syncConfig.Spec.Mapping {
+		ok, err := reconciler.MatchServiceAccount(mapping.ServiceAccounts, sa)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"config": syncConfig.ObjectMeta.Name,
+			}).Error(err)
+			continue
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
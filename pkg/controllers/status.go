@@ -0,0 +1,124 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// setRobotStatus sets the robot account of the project status.
+// The project status must exist, see UpdateProjectStatusLastReconciliation.
+func setRobotStatus(status *crdv1.HarborSyncStatus, project harbor.Project, credential crdv1.RobotAccountCredential, rotated bool) {
+	p := findProjectStatus(status.ProjectList, project.Name)
+	if p == nil {
+		return
+	}
+	p.RobotAccount = credential.Name
+	p.RobotCreatedAt = metav1.Time{}
+	if credential.CreatedAt > 0 {
+		p.RobotCreatedAt = metav1.Unix(credential.CreatedAt, 0)
+	}
+	if rotated {
+		p.LastRotation = metav1.Now()
+	}
+}
+
+// setProjectError sets the last error of the project. If the project has not been reconciled
+// the previous status of the project is kept.
+func setProjectError(status *crdv1.HarborSyncStatus, previous []crdv1.ProjectStatus, project harbor.Project, err error) {
+	p := findProjectStatus(status.ProjectList, project.Name)
+	if p == nil {
+		s := crdv1.ProjectStatus{Name: project.Name}
+		if prev := findProjectStatus(previous, project.Name); prev != nil {
+			s = *prev
+		}
+		status.ProjectList = append(status.ProjectList, s)
+		p = &status.ProjectList[len(status.ProjectList)-1]
+	}
+	p.LastError = err.Error()
+}
+
+// setMappingStatus adds the result of the mapping to the project status, which must exist. The namespaces of the
+// written secrets are added to the managed namespaces and errors are added to the last error of the project.
+// Deferred writes are neither written nor failed.
+func setMappingStatus(status *crdv1.HarborSyncStatus, project harbor.Project, mapping crdv1.ProjectMapping, result reconciler.MappingResult, err error) {
+	ms := crdv1.MappingStatus{
+		Type:      mapping.Type,
+		Namespace: mapping.Namespace,
+		Secret:    mapping.Secret,
+	}
+	for _, secret := range result.Written {
+		ms.Secrets = append(ms.Secrets, secret.String())
+		reconciler.UpdateProjectStatusNamespace(status, project, secret.Namespace)
+	}
+	for _, failed := range result.Failed {
+		ms.FailedSecrets = append(ms.FailedSecrets, crdv1.SecretError{
+			Secret: failed.Secret.String(),
+			Error:  failed.Err.Error(),
+		})
+	}
+	var deferredErr *ratelimit.DeferredError
+	if errors.As(err, &deferredErr) {
+		err = nil
+	}
+	if err != nil && len(ms.FailedSecrets) == 0 {
+		ms.Error = err.Error()
+	}
+	p := findProjectStatus(status.ProjectList, project.Name)
+	if p == nil {
+		return
+	}
+	p.Mappings = append(p.Mappings, ms)
+	if err != nil {
+		p.LastError = joinErrors(p.LastError, err.Error())
+	}
+}
+
+// summarizeStatus counts the projects and secrets in the status
+func summarizeStatus(status *crdv1.HarborSyncStatus) {
+	status.MatchedProjects = len(status.ProjectList)
+	status.FailedProjects = 0
+	status.ManagedSecrets = 0
+	status.FailedSecrets = 0
+	for _, p := range status.ProjectList {
+		if p.LastError != "" {
+			status.FailedProjects++
+		}
+		for _, m := range p.Mappings {
+			status.ManagedSecrets += len(m.Secrets)
+			status.FailedSecrets += len(m.FailedSecrets)
+		}
+	}
+}
+
+func joinErrors(errs ...string) string {
+	var out []string
+	for _, err := range errs {
+		if err != "" {
+			out = append(out, err)
+		}
+	}
+	return strings.Join(out, " | ")
+}
@@ -51,8 +51,18 @@ func NewSyncCondition(condType crdv1.HarborSyncConditionType, status v1.Conditio
 
 // GetSyncCondition returns the condition with the provided type.
 func GetSyncCondition(status crdv1.HarborSyncStatus, condType crdv1.HarborSyncConditionType) *crdv1.HarborSyncStatusCondition {
-	for i := range status.Conditions {
-		c := status.Conditions[i]
+	return getCondition(status.Conditions, condType)
+}
+
+// SetSyncCondition updates the HarborSync resource to include the provided
+// condition.
+func SetSyncCondition(status *crdv1.HarborSyncStatus, condition crdv1.HarborSyncStatusCondition) {
+	status.Conditions = setCondition(status.Conditions, condition)
+}
+
+func getCondition(conditions []crdv1.HarborSyncStatusCondition, condType crdv1.HarborSyncConditionType) *crdv1.HarborSyncStatusCondition {
+	for i := range conditions {
+		c := conditions[i]
 		if c.Type == condType {
 			return &c
 		}
@@ -60,18 +70,17 @@ func GetSyncCondition(status crdv1.HarborSyncStatus, condType crdv1.HarborSyncCo
 	return nil
 }
 
-// SetSyncCondition updates the HarborSync resource to include the provided
-// condition.
-func SetSyncCondition(status *crdv1.HarborSyncStatus, condition crdv1.HarborSyncStatusCondition) {
-	currentCond := GetSyncCondition(*status, condition.Type)
+// setCondition returns the conditions which include the provided condition
+func setCondition(conditions []crdv1.HarborSyncStatusCondition, condition crdv1.HarborSyncStatusCondition) []crdv1.HarborSyncStatusCondition {
+	currentCond := getCondition(conditions, condition.Type)
 	if currentCond != nil && currentCond.Status == condition.Status && currentCond.Reason == condition.Reason {
-		return
+		return conditions
 	}
 	// Do not update lastTransitionTime if the status of the condition doesn't change.
 	if currentCond != nil && currentCond.Status == condition.Status {
 		condition.LastTransitionTime = currentCond.LastTransitionTime
 	}
-	status.Conditions = append(filterOutCondition(status.Conditions, condition.Type), condition)
+	return append(filterOutCondition(conditions, condition.Type), condition)
 }
 
 func filterOutCondition(conditions []crdv1.HarborSyncStatusCondition, condType crdv1.HarborSyncConditionType) []crdv1.HarborSyncStatusCondition {
@@ -0,0 +1,199 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// credentialRejectionThreshold is the number of consecutive verifications whose credentials
+// must have been rejected before the robot account is re-created. A single rejection may be caused
+// by an outage of the token service of the registry.
+const credentialRejectionThreshold = 3
+
+// verifyCredentials verifies the stored credentials of all sync configs every VerifyInterval
+// and emits an event for every sync config whose verification results changed.
+// It blocks until the context is done.
+func (r *HarborSyncConfigReconciler) verifyCredentials(ctx context.Context, events chan<- event.GenericEvent) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.VerifyInterval):
+		}
+		syncConfigs, err := r.verify()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"component": "verifier",
+			}).Error(err)
+		}
+		for i := range syncConfigs {
+			select {
+			case events <- event.GenericEvent{Object: &syncConfigs[i]}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// verify logs in at the registry with the stored credentials of every project of every sync config.
+// If the credentials of a project have been rejected credentialRejectionThreshold times in a row,
+// e.g. because the robot account has been disabled or deleted in harbor, the robot account is re-created
+// with the next reconciliation. The credentials are kept in the store until the replacement has been verified.
+// It returns the sync configs whose verification results changed, the results are
+// written into the status of the projects with the next reconciliation.
+func (r *HarborSyncConfigReconciler) verify() ([]crdv1.HarborSync, error) {
+	var syncConfigs crdv1.HarborSyncList
+	err := r.List(context.Background(), &syncConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sync configs: %s", err.Error())
+	}
+	var changed []crdv1.HarborSync
+	for _, syncConfig := range syncConfigs.Items {
+		if !syncConfig.ObjectMeta.DeletionTimestamp.IsZero() || isPaused(syncConfig) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"component": "verifier",
+			"config":    syncConfig.ObjectMeta.Name,
+		})
+		matches, err := findMatches(syncConfig, r.Harbor, r.MaxProjects)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		checks := make(map[string]crdv1.HarborSyncStatusCondition)
+		rejections := make(map[string]int)
+		if val, ok := r.credentialRejections.Load(syncConfig.ObjectMeta.Name); ok {
+			for project, n := range val.(map[string]int) {
+				rejections[project] = n
+			}
+		}
+		var recreate []string
+		for _, project := range matches {
+			c, err := r.verifyProject(syncConfig, project)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"project": project.Name,
+				}).Error(err)
+				continue
+			}
+			if c == nil {
+				continue
+			}
+			switch c.Status {
+			case v1.ConditionTrue:
+				delete(rejections, project.Name)
+			case v1.ConditionFalse:
+				rejections[project.Name]++
+				if rejections[project.Name] >= credentialRejectionThreshold {
+					logger.WithFields(log.Fields{
+						"project": project.Name,
+					}).Warnf("registry rejected the credentials %d times in a row, re-creating the robot account", rejections[project.Name])
+					c.Reason = "Re-creating robot account"
+					c.Message = fmt.Sprintf("%s %d times in a row, the robot account is re-created", c.Message, rejections[project.Name])
+					recreate = append(recreate, project.Name)
+				}
+			}
+			checks[project.Name] = *c
+		}
+		r.credentialChecks.Store(syncConfig.ObjectMeta.Name, checks)
+		r.credentialRejections.Store(syncConfig.ObjectMeta.Name, rejections)
+		if len(recreate) > 0 {
+			r.recreateProjects.Store(syncConfig.ObjectMeta.Name, recreate)
+			r.forceSync.Store(syncConfig.ObjectMeta.Name, struct{}{})
+		}
+		if len(recreate) > 0 || credentialChecksChanged(syncConfig.Status, checks) {
+			changed = append(changed, syncConfig)
+		}
+	}
+	return changed, nil
+}
+
+// verifyProject verifies the stored credentials of the project and returns the CredentialsValid condition.
+// It returns nil if the store has no credentials for the project.
+func (r *HarborSyncConfigReconciler) verifyProject(syncConfig crdv1.HarborSync, project harbor.Project) (*crdv1.HarborSyncStatusCondition, error) {
+	cred, err := reconciler.GetCredentials(r.CredCache, project, syncConfig.Spec.RobotAccountSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if cred == nil {
+		return nil, nil
+	}
+	name := syncConfig.ObjectMeta.Name
+	err = r.Registry.Login(cred.Name, cred.Token)
+	if errors.Is(err, harbor.ErrCredentialsRejected) {
+		log.WithFields(log.Fields{
+			"component":     "verifier",
+			"config":        name,
+			"project":       project.Name,
+			"robot_account": cred.Name,
+		}).Warn("registry rejected the credentials")
+		credentialsValidGauge.WithLabelValues(name, project.Name).Set(0)
+		return NewSyncCondition(crdv1.ProjectCredentialsValid, v1.ConditionFalse, "Login failed",
+			fmt.Sprintf("registry rejected the credentials of %s", cred.Name)), nil
+	}
+	if err != nil {
+		return NewSyncCondition(crdv1.ProjectCredentialsValid, v1.ConditionUnknown, "Verification failed", err.Error()), nil
+	}
+	credentialsValidGauge.WithLabelValues(name, project.Name).Set(1)
+	return NewSyncCondition(crdv1.ProjectCredentialsValid, v1.ConditionTrue, "Login succeeded", "Login succeeded"), nil
+}
+
+// credentialChecksChanged returns true if the checks differ from the conditions of the projects in the status
+func credentialChecksChanged(status crdv1.HarborSyncStatus, checks map[string]crdv1.HarborSyncStatusCondition) bool {
+	for _, project := range status.ProjectList {
+		check, ok := checks[project.Name]
+		if !ok {
+			continue
+		}
+		current := getCondition(project.Conditions, crdv1.ProjectCredentialsValid)
+		if current == nil || current.Status != check.Status || current.Reason != check.Reason {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCredentialChecks sets the CredentialsValid condition of the projects in the status
+// to the results of the last verification
+func (r *HarborSyncConfigReconciler) applyCredentialChecks(syncConfig *crdv1.HarborSync) {
+	val, ok := r.credentialChecks.Load(syncConfig.ObjectMeta.Name)
+	if !ok {
+		return
+	}
+	checks := val.(map[string]crdv1.HarborSyncStatusCondition)
+	for i, project := range syncConfig.Status.ProjectList {
+		check, ok := checks[project.Name]
+		if !ok {
+			continue
+		}
+		syncConfig.Status.ProjectList[i].Conditions = setCondition(project.Conditions, check)
+	}
+}
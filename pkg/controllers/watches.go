@@ -0,0 +1,247 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
+	"github.com/moolen/harbor-sync/pkg/reconciler"
+)
+
+// OwnedSecretsCache returns a cache which only contains the secrets managed by harbor-sync.
+// Other secrets are not cached, they must be read from the API server,
+// e.g. by disabling the cache of the manager's client for secrets.
+func OwnedSecretsCache() cache.NewCacheFunc {
+	owned, _ := labels.NewRequirement(crdv1.OwnerLabel, selection.Exists, nil)
+	return cache.BuilderWithOptions(cache.Options{
+		SelectorsByObject: cache.SelectorsByObject{
+			&v1.Secret{}: {Label: labels.NewSelector().Add(*owned)},
+		},
+	})
+}
+
+// pendingRestore is a secret of a sync config which must be restored
+type pendingRestore struct {
+	owner  string
+	secret types.NamespacedName
+}
+
+// isOwnedSecret returns true if the object is managed by harbor-sync
+func isOwnedSecret(obj client.Object) bool {
+	_, ok := obj.GetLabels()[crdv1.OwnerLabel]
+	return ok
+}
+
+// syncConfigForSecret maps a secret to the HarborSync that owns it.
+// The owner is reconciled immediately to restore the secret if it has been modified or deleted,
+// only the secret is restored unless the owner is due for a full reconciliation, see restoreSecrets.
+func (r *HarborSyncConfigReconciler) syncConfigForSecret(obj client.Object) []reconcile.Request {
+	owner, ok := obj.GetLabels()[crdv1.OwnerLabel]
+	if !ok || owner == "" {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"config":    owner,
+		"namespace": obj.GetNamespace(),
+		"secret":    obj.GetName(),
+	}).Debug("owned secret changed")
+	r.pendingRestores.Store(pendingRestore{
+		owner:  owner,
+		secret: types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()},
+	}, struct{}{})
+	return []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: owner}},
+	}
+}
+
+// takePendingRestores removes and returns the secrets of the sync config which must be restored
+func (r *HarborSyncConfigReconciler) takePendingRestores(name string) []types.NamespacedName {
+	var secrets []types.NamespacedName
+	r.pendingRestores.Range(func(key, _ interface{}) bool {
+		restore := key.(pendingRestore)
+		if restore.owner == name {
+			r.pendingRestores.Delete(key)
+			secrets = append(secrets, restore.secret)
+		}
+		return true
+	})
+	return secrets
+}
+
+// restoreSecrets writes the given secrets of the sync config with the stored credentials
+// of their project. The robot accounts are not reconciled.
+// Secrets which are no longer desired, e.g. because they have been collected, are not restored.
+func (r *HarborSyncConfigReconciler) restoreSecrets(syncConfig crdv1.HarborSync, secrets []types.NamespacedName) error {
+	matches, err := findMatches(syncConfig, r.Harbor, r.MaxProjects)
+	if err != nil {
+		return fmt.Errorf("unable to find matches: %s", err.Error())
+	}
+	cl := newRecordingClient(ratelimit.NewClient(r.Client, r.SecretBudget), r.Recorder, syncConfig.ObjectMeta.Name)
+	var errs []string
+	for _, secret := range secrets {
+		var ns v1.Namespace
+		err := r.Get(context.Background(), types.NamespacedName{Name: secret.Namespace}, &ns)
+		if apierrs.IsNotFound(err) || (err == nil && !ns.ObjectMeta.DeletionTimestamp.IsZero()) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error fetching namespace %s: %s", secret.Namespace, err.Error()))
+			continue
+		}
+		err = r.restoreSecret(cl, syncConfig, matches, ns, secret)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error restoring secrets: %s", strings.Join(errs, " | "))
+	}
+	return nil
+}
+
+// restoreSecret writes the secret if a mapping of the sync config writes it for one of the projects
+func (r *HarborSyncConfigReconciler) restoreSecret(
+	cl client.Client,
+	syncConfig crdv1.HarborSync,
+	projects []harbor.Project,
+	ns v1.Namespace,
+	secret types.NamespacedName,
+) error {
+	for _, project := range projects {
+		for _, mapping := range syncConfig.Spec.Mapping {
+			targets, err := reconciler.MappingTargets(mapping, syncConfig, project, []string{ns.Name})
+			if err != nil {
+				return err
+			}
+			if !containsSecret(targets, secret) {
+				continue
+			}
+			credential, err := reconciler.GetCredentials(r.CredCache, project, syncConfig.Spec.RobotAccountSuffix)
+			if err != nil {
+				return fmt.Errorf("could not get credentials of project %s: %s", project.Name, err.Error())
+			}
+			if credential == nil {
+				return fmt.Errorf("no credentials for project %s", project.Name)
+			}
+			restored, err := reconciler.RestoreSecret(cl, syncConfig, project, secret, *credential, r.Harbor.BaseURL())
+			if err != nil {
+				return err
+			}
+			if restored {
+				log.WithFields(log.Fields{
+					"config":    syncConfig.ObjectMeta.Name,
+					"namespace": secret.Namespace,
+					"secret":    secret.Name,
+				}).Info("restored secret")
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// namespaceCreated filters namespace events: only new namespaces are relevant.
+// Mappings select namespaces by name, changes of the labels do not matter and namespaces can not be renamed.
+var namespaceCreated = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		return true
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return false
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		return false
+	},
+	GenericFunc: func(e event.GenericEvent) bool {
+		return false
+	},
+}
+
+// syncConfigsForNamespace returns the HarborSyncs with a mapping that applies to the namespace
+func (r *HarborSyncConfigReconciler) syncConfigsForNamespace(obj client.Object) []reconcile.Request {
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		return nil
+	}
+	var syncConfigs crdv1.HarborSyncList
+	if err := r.List(context.Background(), &syncConfigs); err != nil {
+		log.Error(err, "unable to list sync configs")
+		return nil
+	}
+	var reqs []reconcile.Request
+	for _, syncConfig := range syncConfigs.Items {
+		if !r.mappingApplies(syncConfig, *ns) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"config":    syncConfig.ObjectMeta.Name,
+			"namespace": ns.Name,
+		}).Debug("namespace created")
+		r.forceSync.Store(syncConfig.ObjectMeta.Name, struct{}{})
+		reqs = append(reqs, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: syncConfig.ObjectMeta.Name},
+		})
+	}
+	return reqs
+}
+
+// mappingApplies returns true if any of the mappings of the sync config
+// writes a secret into the namespace
+func (r *HarborSyncConfigReconciler) mappingApplies(syncConfig crdv1.HarborSync, ns v1.Namespace) bool {
+	if len(syncConfig.Spec.Mapping) == 0 {
+		return false
+	}
+	matches, err := findMatches(syncConfig, r.Harbor, r.MaxProjects)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"config": syncConfig.ObjectMeta.Name,
+		}).Errorf("unable to find matches: %s", err.Error())
+		return false
+	}
+	for _, mapping := range syncConfig.Spec.Mapping {
+		for _, project := range matches {
+			targets, err := reconciler.MappingTargets(mapping, syncConfig, project, []string{ns.Name})
+			if err != nil {
+				log.WithFields(log.Fields{
+					"config": syncConfig.ObjectMeta.Name,
+				}).Error(err)
+				break
+			}
+			if len(targets) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
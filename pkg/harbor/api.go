@@ -26,6 +26,26 @@ type API interface {
 	BaseURL() string
 }
 
+// Synced is implemented by APIs which cache the harbor resources
+type Synced interface {
+	// HasSynced returns true once the resources have been fetched from harbor
+	HasSynced() bool
+}
+
+// HasSynced returns false if the api caches the harbor resources and the cache
+// has not been filled yet. An api without a cache has always synced.
+func HasSynced(api API) bool {
+	if s, ok := api.(Synced); ok {
+		return s.HasSynced()
+	}
+	return true
+}
+
+// Registry verifies credentials against the harbor registry
+type Registry interface {
+	Login(username, password string) error
+}
+
 // Project is the harbor API response
 type Project struct {
 	ID        int             `json:"project_id"`
@@ -41,6 +41,8 @@ type Client struct {
 	Password   string
 	UserAgent  string
 	HTTPClient *http.Client
+	// InstanceID is added to the description of the robot accounts, see InstanceRobotDescription
+	InstanceID string
 	// we need to keep track of robot accounts that were
 	// returned previously to get proper metrics (e.g. robot account gets deleted)
 	mu                *sync.Mutex
@@ -18,11 +18,15 @@ package harbor
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestInfo(t *testing.T) {
@@ -104,6 +108,49 @@ func TestProjects(t *testing.T) {
 	}
 }
 
+func TestRemovedProjectMetrics(t *testing.T) {
+	projects := `[{"project_id":1,"name":"project_1"},{"project_id":2,"name":"project_2"}]`
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/robots") {
+			res.Write([]byte(`[{"name":"robot$sync","expires_at":1}]`))
+			return
+		}
+		res.Write([]byte(projects))
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL, "/api/", "foo", "bar", false, false)
+	if err != nil {
+		t.Fail()
+	}
+	robotAccountExpiry.Reset()
+	pp, err := c.ListProjects()
+	if err != nil {
+		t.FailNow()
+	}
+	for _, p := range pp {
+		_, err = c.GetRobotAccounts(p)
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	if n := testutil.CollectAndCount(robotAccountExpiry); n != 2 {
+		t.Errorf("expected 2 robot account series, found %d", n)
+	}
+
+	// project_2 has been deleted
+	projects = `[{"project_id":1,"name":"project_1"}]`
+	_, err = c.ListProjects()
+	if err != nil {
+		t.FailNow()
+	}
+	if n := testutil.CollectAndCount(robotAccountExpiry); n != 1 {
+		t.Errorf("expected 1 robot account series, found %d", n)
+	}
+	if v := testutil.ToFloat64(robotAccountExpiry.WithLabelValues("project_1", "robot$sync")); v != 1 {
+		t.Errorf("unexpected expiry of remaining robot account: %f", v)
+	}
+}
+
 func TestRobotsPre110(t *testing.T) {
 	var srv *httptest.Server
 	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
@@ -114,6 +161,9 @@ func TestRobotsPre110(t *testing.T) {
 			body, _ := ioutil.ReadAll(req.Body)
 			var r CreateRobotRequest
 			json.Unmarshal(body, &r)
+			if r.Description != RobotDescription {
+				t.Errorf("unexpected description: %s", r.Description)
+			}
 			if len(r.Access) != 2 {
 				t.Errorf("wrong number of permissions. expected 2, found %d. body: %#v", len(r.Access), r)
 			}
@@ -138,6 +188,34 @@ func TestRobotsPre110(t *testing.T) {
 	}
 }
 
+func TestRobotsInstanceDescription(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(201)
+		if req.URL.Path == "/api/systeminfo" {
+			res.Write([]byte(`{"harbor_version":"1.10.0"}`))
+		} else {
+			body, _ := ioutil.ReadAll(req.Body)
+			var r CreateRobotRequest
+			json.Unmarshal(body, &r)
+			if r.Description != "managed by harbor-sync (instance cluster-a)" {
+				t.Errorf("unexpected description: %s", r.Description)
+			}
+			res.Write([]byte(`{"name":"foo","token":"bar"}`))
+		}
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL, "/api/", "foo", "bar", false, false)
+	if err != nil {
+		t.FailNow()
+	}
+	c.InstanceID = "cluster-a"
+	_, err = c.CreateRobotAccount("foo", false, Project{Name: "example"})
+	if err != nil {
+		t.FailNow()
+	}
+}
+
 func TestRobotsPushPre110(t *testing.T) {
 	var srv *httptest.Server
 	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
@@ -256,3 +334,56 @@ func TestRobotsPushPost110(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestLogin(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/":
+			res.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/service/token",service="harbor-registry"`, srv.URL))
+			res.WriteHeader(http.StatusUnauthorized)
+		case "/service/token":
+			user, pass, ok := req.BasicAuth()
+			if req.URL.Query().Get("service") != "harbor-registry" || req.URL.Query().Get("account") != user {
+				res.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !ok || user != "robot$sync-bot" || pass != "1234" {
+				res.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			res.Write([]byte(`{"token":"abc"}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL, "/api/", "foo", "bar", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Login("robot$sync-bot", "1234")
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = c.Login("robot$sync-bot", "wrong")
+	if !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("expected credentials to be rejected, got: %v", err)
+	}
+}
+
+func TestLoginWithoutChallenge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	c, err := New(srv.URL, "/api/", "foo", "bar", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Login("robot$sync-bot", "1234")
+	if err == nil || errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("expected missing challenge to fail, got: %v", err)
+	}
+}
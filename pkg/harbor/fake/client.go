@@ -69,3 +69,16 @@ func (f Client) BaseURL() string {
 	}
 	return ""
 }
+
+// Registry implements harbor.Registry
+type Registry struct {
+	LoginFunc func(username, password string) error
+}
+
+// Login ...
+func (f Registry) Login(username, password string) error {
+	if f.LoginFunc != nil {
+		return f.LoginFunc(username, password)
+	}
+	return nil
+}
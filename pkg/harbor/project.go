@@ -46,5 +46,27 @@ func (c *Client) ListProjects() ([]Project, error) {
 		}
 	}
 
+	// remove labels for non-existent projects
+	c.mu.Lock()
+	for name, robots := range c.lastRobotAccounts {
+		if containsProject(allProjects, name) {
+			continue
+		}
+		for _, rname := range robots {
+			robotAccountExpiry.DeleteLabelValues(name, rname)
+		}
+		delete(c.lastRobotAccounts, name)
+	}
+	c.mu.Unlock()
+
 	return allProjects, nil
 }
+
+func containsProject(projects []Project, name string) bool {
+	for _, project := range projects {
+		if project.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package harbor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrCredentialsRejected is returned by Login if the registry does not accept the credentials
+var ErrCredentialsRejected = errors.New("registry rejected the credentials")
+
+// Login verifies the credentials against the registry of harbor.
+// It performs the token flow of the registry API which is also used by `docker login`:
+// the registry answers GET /v2/ with a bearer challenge and the credentials
+// are exchanged for a token at the realm of the challenge.
+func (c *Client) Login(username, password string) error {
+	u := c.APIBaseURL.ResolveReference(&url.URL{Path: "/v2/"})
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach registry: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected response status of registry: %s", resp.Status)
+	}
+	realm, service, err := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return err
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return fmt.Errorf("invalid token realm %s: %s", realm, err.Error())
+	}
+	query := tokenURL.Query()
+	query.Set("account", username)
+	if service != "" {
+		query.Set("service", service)
+	}
+	tokenURL.RawQuery = query.Encode()
+	req, err = http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, password)
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err = c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach token service: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("could not login as %s: %w", username, ErrCredentialsRejected)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status of token service: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("could not decode token response: %s", err.Error())
+	}
+	if token.Token == "" && token.AccessToken == "" {
+		return fmt.Errorf("token service did not issue a token for %s", username)
+	}
+	return nil
+}
+
+// parseBearerChallenge returns the realm and service of a WWW-Authenticate header,
+// e.g. Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"
+func parseBearerChallenge(header string) (string, string, error) {
+	if !strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return "", "", fmt.Errorf("registry did not send a bearer challenge: %q", header)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(header[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	if params["realm"] == "" {
+		return "", "", fmt.Errorf("bearer challenge of registry has no realm: %q", header)
+	}
+	return params["realm"], params["service"], nil
+}
@@ -43,6 +43,25 @@ func (p *ProjectsCache) Set(project harbor.Project) {
 	p.mu.Unlock()
 }
 
+// Replace replaces all cache items with the given projects at once.
+// It returns the projects which have been removed from the cache
+func (p *ProjectsCache) Replace(projects []harbor.Project) []harbor.Project {
+	data := make(map[string]harbor.Project)
+	for _, project := range projects {
+		data[project.Name] = project
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var removed []harbor.Project
+	for name, project := range p.data {
+		if _, ok := data[name]; !ok {
+			removed = append(removed, project)
+		}
+	}
+	p.data = data
+	return removed
+}
+
 // Get reads from the cache
 func (p *ProjectsCache) Get() []harbor.Project {
 	p.mu.RLock()
@@ -61,6 +80,13 @@ func (r *RobotsCache) Set(key string, val []harbor.Robot) {
 	r.mu.Unlock()
 }
 
+// Replace replaces all cache items at once
+func (r *RobotsCache) Replace(data map[string][]harbor.Robot) {
+	r.mu.Lock()
+	r.data = data
+	r.mu.Unlock()
+}
+
 // Get returns an item from cache
 func (r *RobotsCache) Get(key string) []harbor.Robot {
 	r.mu.RLock()
@@ -19,6 +19,7 @@ package repository
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchellh/hashstructure"
@@ -39,6 +40,10 @@ type Repository struct {
 	ProjectsCache *ProjectsCache
 	RobotsCache   *RobotsCache
 	syncChan      chan struct{}
+	removedChan   chan harbor.Project
+
+	// synced is set to 1 once the cache has been filled
+	synced int32
 }
 
 // New is the repository constructor
@@ -54,7 +59,8 @@ func New(client harbor.API, interval time.Duration) (*Repository, error) {
 			mu:   &sync.RWMutex{},
 			data: make(map[string][]harbor.Robot),
 		},
-		syncChan: make(chan struct{}),
+		syncChan:    make(chan struct{}),
+		removedChan: make(chan harbor.Project),
 	}, nil
 }
 
@@ -64,7 +70,14 @@ func (r *Repository) BaseURL() string {
 }
 
 // Update fetches the projects and robot accounts
+// and replaces the cached state once all of them have been fetched
 func (r *Repository) Update() error {
+	_, err := r.update()
+	return err
+}
+
+// update replaces the cached state and returns the projects which do no longer exist
+func (r *Repository) update() ([]harbor.Project, error) {
 	var err error
 	projects, err := r.Client.ListProjects()
 	if err != nil {
@@ -72,7 +85,7 @@ func (r *Repository) Update() error {
 			"component": "repository",
 			"action":    "update",
 		}).Errorf("error listing projects: %s", err)
-		return err
+		return nil, err
 	}
 	log.WithFields(log.Fields{
 		"component":     "repository",
@@ -80,12 +93,12 @@ func (r *Repository) Update() error {
 		"project_count": len(projects),
 	}).Debug()
 
+	robots := make(map[string][]harbor.Robot)
 	for _, project := range projects {
-		r.ProjectsCache.Set(project)
 		robotAccounts, err := r.Client.GetRobotAccounts(project)
 		if err != nil {
 			log.Errorf("error fetching robot accounts for %s: %s", project.Name, err)
-			return err
+			return nil, err
 		}
 		log.WithFields(log.Fields{
 			"component":   "repository",
@@ -93,9 +106,26 @@ func (r *Repository) Update() error {
 			"project":     project.Name,
 			"robot_count": len(robotAccounts),
 		}).Debug()
-		r.RobotsCache.Set(project.Name, robotAccounts)
+		robots[project.Name] = robotAccounts
+	}
+	// robots are replaced first so that every cached project has its robot accounts
+	r.RobotsCache.Replace(robots)
+	removed := r.ProjectsCache.Replace(projects)
+	atomic.StoreInt32(&r.synced, 1)
+	for _, project := range removed {
+		log.WithFields(log.Fields{
+			"component": "repository",
+			"action":    "update",
+			"project":   project.Name,
+		}).Info("project has been removed")
 	}
-	return r.UpdateHash()
+	return removed, r.UpdateHash()
+}
+
+// HasSynced returns true once the projects and robot accounts have been fetched.
+// Until then the cache is empty and must not be mistaken for a harbor without projects.
+func (r *Repository) HasSynced() bool {
+	return atomic.LoadInt32(&r.synced) == 1
 }
 
 // UpdateHash recalculates the StateHash
@@ -142,13 +172,20 @@ func (r *Repository) Start(ctx context.Context) error {
 				"component": "repository",
 				"action":    "sync",
 			}).Infof("starting sync")
-			err := r.Update()
+			removed, err := r.update()
 			if err != nil {
 				log.WithFields(log.Fields{
 					"component": "repository",
 					"action":    "sync",
 				}).Errorf("error running update: %s", err)
 			}
+			for _, project := range removed {
+				select {
+				case r.removedChan <- project:
+				case <-ctx.Done():
+					return nil
+				}
+			}
 			if r.StateHash != oldHash {
 				log.WithFields(log.Fields{
 					"component": "repository",
@@ -170,3 +207,9 @@ func (r *Repository) Start(ctx context.Context) error {
 func (r *Repository) Sync() <-chan struct{} {
 	return r.syncChan
 }
+
+// Removed returns a channel which notifies the user
+// when a project has been removed from harbor
+func (r *Repository) Removed() <-chan harbor.Project {
+	return r.removedChan
+}
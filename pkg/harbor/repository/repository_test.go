@@ -68,8 +68,13 @@ var _ = Describe("Repository", func() {
 			}, nil
 		}
 		Expect(rep.StateHash).To(Equal(uint64(0)))
+		Expect(rep.HasSynced()).To(BeFalse())
+		Expect(harbor.HasSynced(rep)).To(BeFalse())
 		err = rep.Update()
 		Expect(err).ToNot(HaveOccurred())
+		Expect(rep.HasSynced()).To(BeTrue())
+		Expect(harbor.HasSynced(rep)).To(BeTrue())
+		Expect(harbor.HasSynced(c)).To(BeTrue())
 
 		// expect to that cache has been set
 		// and state was updated
@@ -99,6 +104,60 @@ var _ = Describe("Repository", func() {
 		Expect(rep.Update()).To(HaveOccurred())
 	})
 
+	It("should remove deleted projects", func() {
+		projects := []harbor.Project{{Name: "foo"}, {Name: "bar"}}
+		c := &fake.Client{}
+		rep, err := New(c, time.Millisecond*10)
+		Expect(err).ToNot(HaveOccurred())
+		c.ListProjectsFunc = func() ([]harbor.Project, error) {
+			return projects, nil
+		}
+		c.GetRobotAccountsFunc = func(p harbor.Project) ([]harbor.Robot, error) {
+			return []harbor.Robot{{Name: p.Name + "-1"}}, nil
+		}
+		Expect(rep.Update()).ToNot(HaveOccurred())
+		Expect(rep.ListProjects()).To(HaveLen(2))
+
+		// a failing update must not touch the cache
+		projects = []harbor.Project{{Name: "foo"}}
+		c.GetRobotAccountsFunc = func(p harbor.Project) ([]harbor.Robot, error) {
+			return nil, errListRobots
+		}
+		Expect(rep.Update()).To(HaveOccurred())
+		Expect(rep.ListProjects()).To(HaveLen(2))
+		Expect(rep.RobotsCache.Get("bar")).To(HaveLen(1))
+
+		c.GetRobotAccountsFunc = func(p harbor.Project) ([]harbor.Robot, error) {
+			return []harbor.Robot{{Name: p.Name + "-1"}}, nil
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rep.Start(ctx)
+
+		var removed harbor.Project
+		Eventually(rep.Removed()).Should(Receive(&removed))
+		Expect(removed.Name).To(Equal("bar"))
+		Expect(rep.ListProjects()).To(Equal([]harbor.Project{{Name: "foo"}}))
+		Expect(rep.RobotsCache.Get("bar")).To(BeEmpty())
+	})
+
+	It("should not be synced until an update succeeded", func() {
+		c := &fake.Client{}
+		rep, err := New(c, time.Second*500)
+		Expect(err).ToNot(HaveOccurred())
+		c.ListProjectsFunc = func() ([]harbor.Project, error) {
+			return nil, errListProjects
+		}
+		Expect(rep.Update()).To(HaveOccurred())
+		Expect(rep.HasSynced()).To(BeFalse())
+
+		c.ListProjectsFunc = func() ([]harbor.Project, error) {
+			return nil, nil
+		}
+		Expect(rep.Update()).ToNot(HaveOccurred())
+		Expect(rep.HasSynced()).To(BeTrue())
+	})
+
 	It("should sync with the API", func() {
 		var projects []harbor.Project
 		var robots []harbor.Robot
@@ -39,6 +39,19 @@ type Robot struct {
 	UpdateTime   string `json:"update_time"`
 }
 
+// RobotDescription is the description of robot accounts created by harbor-sync.
+// It is used to tell them apart from robot accounts created by someone else.
+const RobotDescription = "managed by harbor-sync"
+
+// InstanceRobotDescription returns the description of robot accounts created by the harbor-sync instance
+// with the given id. It tells apart the robot accounts of installations which share a harbor.
+func InstanceRobotDescription(instanceID string) string {
+	if instanceID == "" {
+		return RobotDescription
+	}
+	return fmt.Sprintf("%s (instance %s)", RobotDescription, instanceID)
+}
+
 // CreateRobotRequest is the request payload for creating a robot account
 type CreateRobotRequest struct {
 	// TODO(mj): these are only available in v2.2.0+
@@ -46,8 +59,9 @@ type CreateRobotRequest struct {
 	Kind      string `json:"kind"`
 	Namespace string `json:"namespace"`
 
-	Name   string                     `json:"name"`
-	Access []CreateRobotRequestAccess `json:"access"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	Access      []CreateRobotRequestAccess `json:"access"`
 }
 
 // CreateRobotRequestAccess defines the permissions for the robot account
@@ -153,8 +167,9 @@ func (c *Client) CreateRobotAccount(name string, pushAccess bool, project Projec
 	}
 
 	reqBody, err := json.Marshal(CreateRobotRequest{
-		Name:   name,
-		Access: permissions,
+		Name:        name,
+		Description: InstanceRobotDescription(c.InstanceID),
+		Access:      permissions,
 	})
 
 	if err != nil {
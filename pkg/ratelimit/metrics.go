@@ -0,0 +1,39 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	allowedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harbor_sync_rate_limit_allowed",
+		Help: "The number of changes which have been allowed by the budget",
+	}, []string{"budget"})
+	deferredCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "harbor_sync_rate_limit_deferred",
+		Help: "The number of changes which have been deferred because the budget was exhausted",
+	}, []string{"budget"})
+)
+
+func init() {
+	metrics.Registry.Register(allowedCounter)
+	metrics.Registry.Register(deferredCounter)
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Budget is a token bucket which limits the rate of changes across the controller,
+// e.g. robot account rotations or secret writes.
+// A nil Budget allows everything.
+type Budget struct {
+	name    string
+	limiter *rate.Limiter
+}
+
+// NewBudget returns a budget which allows perMinute changes per minute
+// and bursts of up to burst changes. It returns nil if perMinute is not positive.
+func NewBudget(name string, perMinute float64, burst int) *Budget {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Budget{
+		name:    name,
+		limiter: rate.NewLimiter(rate.Limit(perMinute/60), burst),
+	}
+}
+
+// Allow consumes n tokens and returns true if they are available.
+// Otherwise nothing is consumed, the deferral is recorded and false is returned.
+func (b *Budget) Allow(n int) bool {
+	if b == nil {
+		return true
+	}
+	if b.limiter.AllowN(time.Now(), n) {
+		allowedCounter.WithLabelValues(b.name).Add(float64(n))
+		return true
+	}
+	deferredCounter.WithLabelValues(b.name).Add(float64(n))
+	return false
+}
+
+// Defer returns a DeferredError which tells when n tokens are available again
+func (b *Budget) Defer(n int) *DeferredError {
+	err := &DeferredError{Budget: b.name, RetryAfter: time.Second}
+	r := b.limiter.ReserveN(time.Now(), n)
+	if r.OK() && r.Delay() > err.RetryAfter {
+		err.RetryAfter = r.Delay()
+	}
+	r.Cancel()
+	return err
+}
+
+// DeferredError is returned if a change has been deferred because the budget is exhausted.
+// The change should be retried after RetryAfter.
+type DeferredError struct {
+	Budget     string
+	RetryAfter time.Duration
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("%s budget exhausted: retry after %s", e.Budget, e.RetryAfter.Round(time.Second))
+}
+
+// Client limits the writes of secrets with a budget.
+// Other objects are not limited.
+type Client struct {
+	client.Client
+	Secrets *Budget
+}
+
+// NewClient returns a client which limits the writes of secrets
+func NewClient(cl client.Client, secrets *Budget) *Client {
+	return &Client{
+		Client:  cl,
+		Secrets: secrets,
+	}
+}
+
+// Create implements client.Writer
+func (c *Client) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.allow(obj); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// Update implements client.Writer
+func (c *Client) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.allow(obj); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// Patch implements client.Writer
+func (c *Client) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.allow(obj); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *Client) allow(obj client.Object) error {
+	if _, ok := obj.(*v1.Secret); !ok || c.Secrets.Allow(1) {
+		return nil
+	}
+	return c.Secrets.Defer(1)
+}
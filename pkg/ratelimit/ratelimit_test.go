@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNilBudget(t *testing.T) {
+	b := NewBudget("unlimited", 0, 10)
+	if b != nil {
+		t.Fatalf("expected nil budget")
+	}
+	for i := 0; i < 100; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("expected nil budget to allow everything")
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := NewBudget("test-budget", 2, 3)
+	if !b.Allow(2) {
+		t.Errorf("expected burst to be allowed")
+	}
+	if b.Allow(2) {
+		t.Errorf("expected exhausted budget to defer")
+	}
+	if !b.Allow(1) {
+		t.Errorf("expected remaining token to be allowed")
+	}
+	err := b.Defer(2)
+	if err.Budget != "test-budget" {
+		t.Errorf("unexpected budget name: %s", err.Budget)
+	}
+	// 2 tokens per minute refill in 60s
+	if err.RetryAfter < 50*time.Second || err.RetryAfter > 60*time.Second {
+		t.Errorf("unexpected retry after: %s", err.RetryAfter)
+	}
+	// Defer must not consume tokens
+	if b.Defer(2).RetryAfter > err.RetryAfter {
+		t.Errorf("expected defer to not consume tokens")
+	}
+	if v := testutil.ToFloat64(allowedCounter.WithLabelValues("test-budget")); v != 3 {
+		t.Errorf("unexpected allowed count: %f", v)
+	}
+	if v := testutil.ToFloat64(deferredCounter.WithLabelValues("test-budget")); v != 2 {
+		t.Errorf("unexpected deferred count: %f", v)
+	}
+}
+
+func TestClient(t *testing.T) {
+	c := NewClient(fake.NewClientBuilder().Build(), NewBudget("test-client", 1, 1))
+	err := c.Create(context.Background(), &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Create(context.Background(), &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "two"}})
+	var deferred *DeferredError
+	if !errors.As(err, &deferred) {
+		t.Fatalf("expected secret write to be deferred, got %v", err)
+	}
+	// other objects are not limited
+	err = c.Create(context.Background(), &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "one"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+)
+
+// DesiredSecrets returns the secrets which the mappings of the sync config write
+// for the given projects into the given namespaces
+func DesiredSecrets(syncConfig crdv1.HarborSync, projects []harbor.Project, namespaces []v1.Namespace) ([]types.NamespacedName, error) {
+	var desired []types.NamespacedName
+	for _, mapping := range syncConfig.Spec.Mapping {
+		for _, project := range projects {
+			targets, err := MappingTargets(mapping, syncConfig, project, namespaceNames(namespaces))
+			if err != nil {
+				return nil, err
+			}
+			desired = append(desired, targets...)
+		}
+	}
+	return desired, nil
+}
+
+// GarbageCollectSecrets removes the secrets owned by the sync config which are not desired.
+// Depending on the deletion policy the secrets are deleted or the owner label is removed.
+// It returns the secrets which have been deleted.
+func GarbageCollectSecrets(cl client.Client, syncConfig crdv1.HarborSync, desired []types.NamespacedName) ([]v1.Secret, error) {
+	return collectSecrets(cl, syncConfig, func(secret v1.Secret) bool {
+		return !containsName(desired, types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name})
+	})
+}
+
+// GarbageCollectProjectSecrets removes the secrets owned by the sync config
+// which contain the credentials of the project, e.g. because the project has been removed from harbor.
+// Depending on the deletion policy the secrets are deleted or the owner label is removed.
+// It returns the secrets which have been deleted.
+func GarbageCollectProjectSecrets(cl client.Client, syncConfig crdv1.HarborSync, project harbor.Project) ([]v1.Secret, error) {
+	return collectSecrets(cl, syncConfig, func(secret v1.Secret) bool {
+		return secret.Annotations[crdv1.ProjectAnnotation] == project.Name
+	})
+}
+
+// collectSecrets deletes or releases the secrets owned by the sync config for which collect returns true
+func collectSecrets(cl client.Client, syncConfig crdv1.HarborSync, collect func(v1.Secret) bool) ([]v1.Secret, error) {
+	var secrets v1.SecretList
+	err := cl.List(context.Background(), &secrets, client.MatchingLabels{
+		crdv1.OwnerLabel: syncConfig.ObjectMeta.Name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets: %s", err.Error())
+	}
+	var deleted []v1.Secret
+	var errs []string
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		key := types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}
+		if !collect(*secret) {
+			continue
+		}
+		logger := log.WithFields(log.Fields{
+			"config":    syncConfig.ObjectMeta.Name,
+			"namespace": secret.Namespace,
+			"secret":    secret.Name,
+		})
+		if syncConfig.Spec.DeletionPolicy == crdv1.DeletionPolicyRetain {
+			patch := client.MergeFrom(secret.DeepCopy())
+			delete(secret.Labels, crdv1.OwnerLabel)
+			err = cl.Patch(context.Background(), secret, patch)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("could not release secret %s: %s", key, err.Error()))
+				continue
+			}
+			logger.Info("released secret that is no longer desired")
+			continue
+		}
+		err = cl.Delete(context.Background(), secret)
+		if err != nil && !apierrs.IsNotFound(err) {
+			errs = append(errs, fmt.Sprintf("could not delete secret %s: %s", key, err.Error()))
+			continue
+		}
+		logger.Info("deleted secret that is no longer desired")
+		deleted = append(deleted, *secret)
+	}
+	if len(errs) == 0 {
+		return deleted, nil
+	}
+	return deleted, fmt.Errorf("error collecting secrets: %s", strings.Join(errs, " | "))
+}
+
+func containsName(arr []types.NamespacedName, el types.NamespacedName) bool {
+	for _, a := range arr {
+		if a == el {
+			return true
+		}
+	}
+	return false
+}
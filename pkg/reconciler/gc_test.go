@@ -0,0 +1,140 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("GarbageCollection", func() {
+	ns := "gc-secrets"
+
+	cfg := crdv1.HarborSync{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-gc-cfg"},
+		Spec: crdv1.HarborSyncSpec{
+			Type:        crdv1.RegexMatching,
+			ProjectName: "team-(.*)",
+			Mapping: []crdv1.ProjectMapping{
+				{
+					Type:      crdv1.MatchMappingType,
+					Namespace: ns,
+					Secret:    "$1-pull-token",
+				},
+			},
+		},
+	}
+
+	makeSecret := func(name, owner string) {
+		err := k8sClient.Create(context.Background(), &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+				Name:      name,
+				Labels:    map[string]string{crdv1.OwnerLabel: owner},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	getSecret := func(name string) (v1.Secret, error) {
+		var secret v1.Secret
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Namespace: ns, Name: name}, &secret)
+		return secret, err
+	}
+
+	BeforeEach(func() {
+		test.EnsureNamespace(k8sClient, ns)
+		makeSecret("foo-pull-token", "my-gc-cfg")
+		makeSecret("bar-pull-token", "my-gc-cfg")
+		makeSecret("other-pull-token", "other-cfg")
+	})
+
+	AfterEach(func() {
+		var secrets v1.SecretList
+		err := k8sClient.List(context.Background(), &secrets)
+		Expect(err).ToNot(HaveOccurred())
+		for _, secret := range secrets.Items {
+			if secret.Namespace == ns {
+				test.DeleteSecret(k8sClient, ns, secret.Name)
+			}
+		}
+	})
+
+	It("should compute the desired secrets", func() {
+		desired, err := DesiredSecrets(cfg, []harbor.Project{{Name: "team-foo"}}, []v1.Namespace{
+			{ObjectMeta: metav1.ObjectMeta{Name: ns}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(desired).To(Equal([]types.NamespacedName{{Namespace: ns, Name: "foo-pull-token"}}))
+	})
+
+	It("should delete secrets that are no longer desired", func() {
+		deleted, err := GarbageCollectSecrets(k8sClient, cfg, []types.NamespacedName{{Namespace: ns, Name: "foo-pull-token"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(HaveLen(1))
+		Expect(deleted[0].Name).To(Equal("bar-pull-token"))
+
+		_, err = getSecret("foo-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = getSecret("other-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = getSecret("bar-pull-token")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should delete the secrets of a project", func() {
+		secret, err := getSecret("foo-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+		secret.Annotations = map[string]string{crdv1.ProjectAnnotation: "team-foo"}
+		Expect(k8sClient.Update(context.Background(), &secret)).To(Succeed())
+
+		deleted, err := GarbageCollectProjectSecrets(k8sClient, cfg, harbor.Project{Name: "team-foo"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(HaveLen(1))
+		Expect(deleted[0].Name).To(Equal("foo-pull-token"))
+
+		_, err = getSecret("foo-pull-token")
+		Expect(err).To(HaveOccurred())
+		_, err = getSecret("bar-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should release secrets with deletion policy retain", func() {
+		retainCfg := cfg.DeepCopy()
+		retainCfg.Spec.DeletionPolicy = crdv1.DeletionPolicyRetain
+		deleted, err := GarbageCollectSecrets(k8sClient, *retainCfg, []types.NamespacedName{{Namespace: ns, Name: "foo-pull-token"}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(deleted).To(BeEmpty())
+
+		secret, err := getSecret("foo-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secret.Labels).To(HaveKeyWithValue(crdv1.OwnerLabel, "my-gc-cfg"))
+		secret, err = getSecret("bar-pull-token")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secret.Labels).ToNot(HaveKey(crdv1.OwnerLabel))
+	})
+})
@@ -17,8 +17,10 @@ limitations under the License.
 package reconciler
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -31,18 +33,37 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 
 	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 	"github.com/moolen/harbor-sync/pkg/util"
 )
 
 // MappingFunc implements a specific strategy for
-// reconciling the cluster state
+// reconciling the cluster state. It returns the secrets which have been
+// written and those which could not be written, also if an error is returned.
 type MappingFunc func(
 	client.Client,
 	crdv1.ProjectMapping,
 	crdv1.HarborSync,
 	harbor.Project,
 	crdv1.RobotAccountCredential,
-	string) error
+	string) (MappingResult, error)
+
+// MappingResult contains the secrets which a mapping has written
+// and the secrets which could not be written
+type MappingResult struct {
+	Written []types.NamespacedName
+	Failed  []FailedSecret
+
+	// RestartAfter is the time until delayed restarts of workloads are due, see RestartWorkloads.
+	// It is 0 if no restart has been delayed.
+	RestartAfter time.Duration
+}
+
+// FailedSecret is a secret which could not be written
+type FailedSecret struct {
+	Secret types.NamespacedName
+	Err    error
+}
 
 // MappingFuncForConfig returns a MappingFunc for the given mapping
 // which can be used by the called to reconcile the desired state
@@ -62,41 +83,70 @@ func mapByMatching(
 	project harbor.Project,
 	credential crdv1.RobotAccountCredential,
 	harborURL string,
-) error {
-	nsMatcher, err := regexp.Compile(mapping.Namespace)
-	if err != nil {
-		return fmt.Errorf("invalid regex: %s", err.Error())
-	}
+) (MappingResult, error) {
+	var result MappingResult
 	// get all namespaces
 	// match ns against mapping.Namespace regex
 	var nsList v1.NamespaceList
-	err = cl.List(context.Background(), &nsList)
+	err := cl.List(context.Background(), &nsList)
 	if err != nil {
-		return fmt.Errorf("error listingnamespaces: %s", err.Error())
+		return result, fmt.Errorf("error listingnamespaces: %s", err.Error())
 	}
 
-	matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
+	targets, err := MappingTargets(mapping, syncConfig, project, namespaceNames(nsList.Items))
 	if err != nil {
-		return fmt.Errorf("error compiling regex: %s", err.Error())
+		return result, err
 	}
 
 	var errs []string
-	for _, ns := range nsList.Items {
-		if nsMatcher.MatchString(ns.Name) {
-			proposedSecret := matcher.ReplaceAllString(project.Name, mapping.Secret)
-			secret := util.MakeSecret(ns.Name, proposedSecret, harborURL, credential)
-			err = util.UpsertSecret(cl, secret)
-			if err != nil {
-				errs = append(errs, err.Error())
-				continue
-			}
-			UpdateProjectStatusNamespace(&syncConfig.Status, project, ns.Name)
+	var conflicts []SecretConflict
+	// deferred is set if secret writes have been deferred by the rate limit
+	var deferred *ratelimit.DeferredError
+	for _, target := range targets {
+		owner, err := secretOwner(cl, target)
+		if err != nil {
+			errs = append(errs, err.Error())
+			result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: err})
+			continue
+		}
+		if owner != "" && owner != syncConfig.ObjectMeta.Name {
+			conflict := SecretConflict{Secret: target, Owner: owner}
+			conflicts = append(conflicts, conflict)
+			result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: &ConflictError{Conflicts: []SecretConflict{conflict}}})
+			continue
+		}
+		secret := makeOwnedSecret(target, syncConfig, project, harborURL, credential)
+		changed, err := util.UpsertSecret(cl, secret)
+		if errors.As(err, &deferred) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+			result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: err})
+			continue
+		}
+		result.Written = append(result.Written, target)
+		wait, err := RestartWorkloads(cl, mapping.RolloutRestart, target, changed)
+		if wait > 0 && (result.RestartAfter == 0 || wait < result.RestartAfter) {
+			result.RestartAfter = wait
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) == 0 && len(conflicts) == 0 && deferred == nil {
+		return result, nil
+	}
+	if len(errs) == 0 && len(conflicts) == 0 {
+		return result, deferred
+	}
 	if len(errs) == 0 {
-		return nil
+		return result, &ConflictError{Conflicts: conflicts}
 	}
-	return fmt.Errorf("error upserting secrets: %s", strings.Join(errs, " | "))
+	if len(conflicts) > 0 {
+		errs = append(errs, (&ConflictError{Conflicts: conflicts}).Error())
+	}
+	return result, fmt.Errorf("error upserting secrets: %s", strings.Join(errs, " | "))
 }
 
 func mapByTranslating(
@@ -106,28 +156,165 @@ func mapByTranslating(
 	project harbor.Project,
 	credential crdv1.RobotAccountCredential,
 	harborURL string,
-) error {
+) (MappingResult, error) {
+	var result MappingResult
 	matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
 	if err != nil {
-		return fmt.Errorf("error compiling regex: %s", err.Error())
+		return result, fmt.Errorf("error compiling regex: %s", err.Error())
 	}
 	// propse a namespace and secret name / ignore missing namespace
 	var ns v1.Namespace
 	proposedNamespace := matcher.ReplaceAllString(project.Name, mapping.Namespace)
 	err = cl.Get(context.Background(), types.NamespacedName{Name: proposedNamespace}, &ns)
 	if apierrs.IsNotFound(err) {
-		return nil
+		return result, nil
 	} else if err != nil {
-		return fmt.Errorf("error fetching namespace %s: %s", proposedNamespace, err.Error())
+		return result, fmt.Errorf("error fetching namespace %s: %s", proposedNamespace, err.Error())
 	}
 
-	UpdateProjectStatusNamespace(&syncConfig.Status, project, ns.Name)
 	// propose a secret name for this project
 	proposedSecret := matcher.ReplaceAllString(project.Name, mapping.Secret)
-	secret := util.MakeSecret(proposedNamespace, proposedSecret, harborURL, credential)
-	err = util.UpsertSecret(cl, secret)
+	target := types.NamespacedName{Namespace: proposedNamespace, Name: proposedSecret}
+	owner, err := secretOwner(cl, target)
+	if err != nil {
+		result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: err})
+		return result, err
+	}
+	if owner != "" && owner != syncConfig.ObjectMeta.Name {
+		err = &ConflictError{Conflicts: []SecretConflict{{Secret: target, Owner: owner}}}
+		result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: err})
+		return result, err
+	}
+	secret := makeOwnedSecret(target, syncConfig, project, harborURL, credential)
+	changed, err := util.UpsertSecret(cl, secret)
+	var deferred *ratelimit.DeferredError
+	if errors.As(err, &deferred) {
+		return result, err
+	}
+	if err != nil {
+		result.Failed = append(result.Failed, FailedSecret{Secret: target, Err: err})
+		return result, err
+	}
+	result.Written = append(result.Written, target)
+	result.RestartAfter, err = RestartWorkloads(cl, mapping.RolloutRestart, target, changed)
+	return result, err
+}
+
+// RestoreSecret writes the secret of the project to the target, e.g. after it has been modified or deleted.
+// Workloads are not restarted. It returns true if the secret has been written.
+func RestoreSecret(
+	cl client.Client,
+	syncConfig crdv1.HarborSync,
+	project harbor.Project,
+	target types.NamespacedName,
+	credential crdv1.RobotAccountCredential,
+	harborURL string,
+) (bool, error) {
+	owner, err := secretOwner(cl, target)
+	if err != nil {
+		return false, err
+	}
+	if owner != "" && owner != syncConfig.ObjectMeta.Name {
+		return false, &ConflictError{Conflicts: []SecretConflict{{Secret: target, Owner: owner}}}
+	}
+	return util.UpsertSecret(cl, makeOwnedSecret(target, syncConfig, project, harborURL, credential))
+}
+
+// SecretConflict is a secret which should be written by a HarborSync
+// but is owned by another one
+type SecretConflict struct {
+	Secret types.NamespacedName
+	Owner  string
+}
+
+// ConflictError is returned by the mapping functions if secrets have not been written
+// because they are owned by another HarborSync
+type ConflictError struct {
+	Conflicts []SecretConflict
+}
+
+func (e *ConflictError) Error() string {
+	var secrets []string
+	for _, c := range e.Conflicts {
+		secrets = append(secrets, fmt.Sprintf("%s (owned by %s)", c.Secret, c.Owner))
+	}
+	return fmt.Sprintf("refusing to write secrets owned by another HarborSync: %s", strings.Join(secrets, ", "))
+}
+
+// secretOwner returns the name of the HarborSync which owns the secret.
+// It returns an empty string if the secret does not exist or is not owned by a HarborSync
+func secretOwner(cl client.Client, target types.NamespacedName) (string, error) {
+	var secret v1.Secret
+	err := cl.Get(context.Background(), target, &secret)
+	if apierrs.IsNotFound(err) {
+		return "", nil
+	}
 	if err != nil {
-		return err
+		return "", fmt.Errorf("could not fetch secret %s: %s", target, err.Error())
+	}
+	return secret.Labels[crdv1.OwnerLabel], nil
+}
+
+// makeOwnedSecret creates the secret for the project
+// and marks it as owned by the sync config
+func makeOwnedSecret(
+	target types.NamespacedName,
+	syncConfig crdv1.HarborSync,
+	project harbor.Project,
+	harborURL string,
+	credential crdv1.RobotAccountCredential,
+) v1.Secret {
+	secret := util.MakeSecret(target.Namespace, target.Name, harborURL, credential)
+	secret.Labels = map[string]string{
+		crdv1.OwnerLabel: syncConfig.ObjectMeta.Name,
+	}
+	secret.Annotations = map[string]string{
+		crdv1.ProjectAnnotation: project.Name,
+	}
+	return secret
+}
+
+// MappingTargets returns the secrets which the mapping writes for the given project.
+// Only namespaces that are contained in the provided list are considered.
+func MappingTargets(
+	mapping crdv1.ProjectMapping,
+	syncConfig crdv1.HarborSync,
+	project harbor.Project,
+	namespaces []string,
+) ([]types.NamespacedName, error) {
+	matcher, err := regexp.Compile(syncConfig.Spec.ProjectName)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regex: %s", err.Error())
+	}
+	proposedSecret := matcher.ReplaceAllString(project.Name, mapping.Secret)
+
+	var targets []types.NamespacedName
+	switch mapping.Type {
+	case crdv1.TranslateMappingType:
+		proposedNamespace := matcher.ReplaceAllString(project.Name, mapping.Namespace)
+		if contains(namespaces, proposedNamespace) {
+			targets = append(targets, types.NamespacedName{Namespace: proposedNamespace, Name: proposedSecret})
+		}
+	case crdv1.MatchMappingType:
+		nsMatcher, err := regexp.Compile(mapping.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		for _, ns := range namespaces {
+			if nsMatcher.MatchString(ns) {
+				targets = append(targets, types.NamespacedName{Namespace: ns, Name: proposedSecret})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid mapping type: %s", mapping.Type)
+	}
+	return targets, nil
+}
+
+func namespaceNames(namespaces []v1.Namespace) []string {
+	var names []string
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
 	}
-	return nil
+	return names
 }
@@ -18,11 +18,14 @@ package reconciler
 
 import (
 	"context"
+	"errors"
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 	"github.com/moolen/harbor-sync/pkg/test"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -56,7 +59,7 @@ var _ = Describe("Mapping", func() {
 				Secret:    "platform-pull-token",
 			}
 			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-match-cfg", "platform-team", &mapping, nil)
-			err = mapByMatching(
+			result, err := mapByMatching(
 				k8sClient,
 				mapping,
 				cfg,
@@ -71,6 +74,11 @@ var _ = Describe("Mapping", func() {
 				"my-registry-url",
 			)
 			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Written).To(ConsistOf(
+				types.NamespacedName{Namespace: "team-match-a", Name: "platform-pull-token"},
+				types.NamespacedName{Namespace: "team-match-b", Name: "platform-pull-token"},
+			))
+			Expect(result.Failed).To(BeEmpty())
 
 			teamASecret := v1.Secret{}
 			teamBSecret := v1.Secret{}
@@ -88,6 +96,112 @@ var _ = Describe("Mapping", func() {
 		})
 	})
 
+	Describe("Conflict", func() {
+
+		BeforeEach(func() {
+			test.EnsureNamespace(k8sClient, "team-conflict-a")
+			test.EnsureNamespace(k8sClient, "team-conflict-b")
+		})
+
+		AfterEach(func() {
+			test.DeleteSecret(k8sClient, "team-conflict-a", "platform-pull-token")
+			test.DeleteSecret(k8sClient, "team-conflict-b", "platform-pull-token")
+			test.DeleteHarborSyncConfig(k8sClient, "my-conflict-cfg")
+		})
+
+		It("should refuse to write secrets owned by another config", func() {
+			owned := v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "team-conflict-a",
+					Name:      "platform-pull-token",
+					Labels:    map[string]string{crdv1.OwnerLabel: "other-cfg"},
+				},
+				Data: map[string][]byte{"foo": []byte("bar")},
+			}
+			Expect(k8sClient.Create(context.Background(), &owned)).To(Succeed())
+
+			mapping := crdv1.ProjectMapping{
+				Type:      crdv1.MatchMappingType,
+				Namespace: "team-conflict-.*",
+				Secret:    "platform-pull-token",
+			}
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-conflict-cfg", "platform-team", &mapping, nil)
+			result, err := mapByMatching(
+				k8sClient,
+				mapping,
+				cfg,
+				harbor.Project{ID: 1, Name: "platform-team"},
+				crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "my-token"},
+				"my-registry-url",
+			)
+			Expect(result.Written).To(Equal([]types.NamespacedName{{Namespace: "team-conflict-b", Name: "platform-pull-token"}}))
+			Expect(result.Failed).To(HaveLen(1))
+			Expect(result.Failed[0].Secret).To(Equal(types.NamespacedName{Namespace: "team-conflict-a", Name: "platform-pull-token"}))
+			Expect(result.Failed[0].Err.Error()).To(ContainSubstring("owned by other-cfg"))
+			var conflictErr *ConflictError
+			Expect(errors.As(err, &conflictErr)).To(BeTrue())
+			Expect(conflictErr.Conflicts).To(Equal([]SecretConflict{
+				{Secret: types.NamespacedName{Namespace: "team-conflict-a", Name: "platform-pull-token"}, Owner: "other-cfg"},
+			}))
+
+			var secret v1.Secret
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-conflict-a", Name: "platform-pull-token"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(secret.Data["foo"])).To(Equal("bar"))
+			err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: "team-conflict-b", Name: "platform-pull-token"}, &secret)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secret.Labels[crdv1.OwnerLabel]).To(Equal("my-conflict-cfg"))
+		})
+	})
+
+	Describe("RateLimit", func() {
+
+		BeforeEach(func() {
+			test.EnsureNamespace(k8sClient, "team-ratelimit-a")
+			test.EnsureNamespace(k8sClient, "team-ratelimit-b")
+		})
+
+		AfterEach(func() {
+			// only one of the secrets has been written
+			for _, ns := range []string{"team-ratelimit-a", "team-ratelimit-b"} {
+				k8sClient.Delete(context.Background(), &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "platform-pull-token"}})
+			}
+			test.DeleteHarborSyncConfig(k8sClient, "my-ratelimit-cfg")
+		})
+
+		It("should defer secret writes when the budget is exhausted", func() {
+			mapping := crdv1.ProjectMapping{
+				Type:      crdv1.MatchMappingType,
+				Namespace: "team-ratelimit-.*",
+				Secret:    "platform-pull-token",
+			}
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-ratelimit-cfg", "platform-team", &mapping, nil)
+			cl := ratelimit.NewClient(k8sClient, ratelimit.NewBudget("secret", 1, 1))
+			_, err := mapByMatching(
+				cl,
+				mapping,
+				cfg,
+				harbor.Project{ID: 1, Name: "platform-team"},
+				crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "my-token"},
+				"my-registry-url",
+			)
+			var deferred *ratelimit.DeferredError
+			Expect(errors.As(err, &deferred)).To(BeTrue())
+			Expect(deferred.Budget).To(Equal("secret"))
+
+			// exactly one secret has been written
+			var secrets int
+			for _, ns := range []string{"team-ratelimit-a", "team-ratelimit-b"} {
+				var secret v1.Secret
+				err = k8sClient.Get(context.Background(), types.NamespacedName{Namespace: ns, Name: "platform-pull-token"}, &secret)
+				if err == nil {
+					secrets++
+				}
+			}
+			Expect(secrets).To(Equal(1))
+		})
+	})
+
 	Describe("Translate", func() {
 
 		BeforeEach(func() {
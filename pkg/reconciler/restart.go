@@ -0,0 +1,251 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+// DefaultRestartMinInterval is the minimum time between two restarts of a workload
+// if not specified otherwise
+const DefaultRestartMinInterval = time.Minute * 10
+
+// workload is a Deployment, StatefulSet or DaemonSet
+type workload struct {
+	obj      client.Object
+	template *v1.PodTemplateSpec
+}
+
+// RestartWorkloads restarts the workloads in the secret's namespace which reference the secret
+// by setting a checksum of their imagePullSecrets managed by harbor-sync on the pod template.
+// Workloads which have never been restarted by harbor-sync are only restarted if the secret changed.
+// If they can not be restarted, the restart is marked as pending on the secret and retried in a subsequent call.
+// Workloads which have been restarted recently are skipped: the time until they may be restarted
+// is returned, the caller must call RestartWorkloads again.
+func RestartWorkloads(cl client.Client, cfg *crdv1.RolloutRestart, secret types.NamespacedName, changed bool) (time.Duration, error) {
+	if cfg == nil {
+		return 0, nil
+	}
+	selector := labels.Everything()
+	if cfg.Selector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(cfg.Selector)
+		if err != nil {
+			return 0, fmt.Errorf("invalid label selector: %s", err.Error())
+		}
+	}
+	minInterval := DefaultRestartMinInterval
+	if cfg.MinInterval != nil {
+		minInterval = cfg.MinInterval.Duration
+	}
+	workloads, err := listWorkloads(cl, secret.Namespace, selector)
+	if err != nil {
+		return 0, err
+	}
+	var s v1.Secret
+	err = cl.Get(context.Background(), secret, &s)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching secret %s/%s: %s", secret.Namespace, secret.Name, err.Error())
+	}
+	wasPending := s.Annotations[crdv1.RestartPendingAnnotation] == "true"
+	changed = changed || wasPending
+
+	// wait is the shortest time until a delayed restart is due
+	var wait time.Duration
+	// pending is set if a workload which has never been restarted could not be restarted
+	var pending bool
+	var errs []string
+	for _, w := range workloads {
+		logger := log.WithFields(log.Fields{
+			"namespace": w.obj.GetNamespace(),
+			"name":      w.obj.GetName(),
+			"kind":      fmt.Sprintf("%T", w.obj),
+		})
+		refs, err := workloadPullSecrets(cl, secret.Namespace, w.template.Spec)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !contains(refs, secret.Name) {
+			continue
+		}
+		checksum, err := pullSecretChecksum(cl, secret.Namespace, refs)
+		if err != nil {
+			errs = append(errs, err.Error())
+			pending = pending || changed
+			continue
+		}
+		current := w.template.Annotations[crdv1.PullSecretChecksumAnnotation]
+		if current == checksum || (current == "" && !changed) {
+			continue
+		}
+		restartedAt, _ := time.Parse(time.RFC3339, w.template.Annotations[crdv1.RestartedAtAnnotation])
+		if due := time.Until(restartedAt.Add(minInterval)); due > 0 {
+			logger.Infof("delaying restart of workload for %s: restarted recently", due.Round(time.Second))
+			if wait == 0 || due < wait {
+				wait = due
+			}
+			continue
+		}
+		patch := client.MergeFrom(w.obj.DeepCopyObject().(client.Object))
+		if w.template.Annotations == nil {
+			w.template.Annotations = make(map[string]string)
+		}
+		w.template.Annotations[crdv1.PullSecretChecksumAnnotation] = checksum
+		w.template.Annotations[crdv1.RestartedAtAnnotation] = time.Now().Format(time.RFC3339)
+		err = cl.Patch(context.Background(), w.obj, patch)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not restart %s/%s: %s", w.obj.GetNamespace(), w.obj.GetName(), err.Error()))
+			// workloads which have been restarted before are retried because their checksum is outdated
+			pending = pending || current == ""
+			continue
+		}
+		logger.Info("restarted workload")
+	}
+	if pending != wasPending {
+		err = setRestartPending(cl, &s, pending)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == 0 {
+		return wait, nil
+	}
+	return wait, fmt.Errorf("error restarting workloads: %s", strings.Join(errs, " | "))
+}
+
+// setRestartPending adds or removes the RestartPendingAnnotation of the secret
+func setRestartPending(cl client.Client, secret *v1.Secret, pending bool) error {
+	patch := client.MergeFrom(secret.DeepCopy())
+	if pending {
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[crdv1.RestartPendingAnnotation] = "true"
+	} else {
+		delete(secret.Annotations, crdv1.RestartPendingAnnotation)
+	}
+	err := cl.Patch(context.Background(), secret, patch)
+	if err != nil {
+		return fmt.Errorf("could not update secret %s/%s: %s", secret.Namespace, secret.Name, err.Error())
+	}
+	return nil
+}
+
+func listWorkloads(cl client.Client, namespace string, selector labels.Selector) ([]workload, error) {
+	opts := []client.ListOption{
+		client.InNamespace(namespace),
+		client.MatchingLabelsSelector{Selector: selector},
+	}
+	var workloads []workload
+	var deployments appsv1.DeploymentList
+	err := cl.List(context.Background(), &deployments, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing deployments: %s", err.Error())
+	}
+	for i := range deployments.Items {
+		workloads = append(workloads, workload{&deployments.Items[i], &deployments.Items[i].Spec.Template})
+	}
+	var statefulSets appsv1.StatefulSetList
+	err = cl.List(context.Background(), &statefulSets, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %s", err.Error())
+	}
+	for i := range statefulSets.Items {
+		workloads = append(workloads, workload{&statefulSets.Items[i], &statefulSets.Items[i].Spec.Template})
+	}
+	var daemonSets appsv1.DaemonSetList
+	err = cl.List(context.Background(), &daemonSets, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing daemonsets: %s", err.Error())
+	}
+	for i := range daemonSets.Items {
+		workloads = append(workloads, workload{&daemonSets.Items[i], &daemonSets.Items[i].Spec.Template})
+	}
+	return workloads, nil
+}
+
+// workloadPullSecrets returns the sorted names of the imagePullSecrets
+// referenced by the pod spec or its ServiceAccount
+func workloadPullSecrets(cl client.Client, namespace string, spec v1.PodSpec) ([]string, error) {
+	var names []string
+	for _, ref := range spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	saName := spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+	var sa v1.ServiceAccount
+	err := cl.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: saName}, &sa)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return nil, fmt.Errorf("error fetching service account %s/%s: %s", namespace, saName, err.Error())
+	}
+	for _, ref := range sa.ImagePullSecrets {
+		if !contains(names, ref.Name) {
+			names = append(names, ref.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pullSecretChecksum computes a checksum over the data of the given secrets which are managed by harbor-sync.
+// Missing secrets and secrets which are not managed by harbor-sync are ignored,
+// so that changes of other secrets do not restart the workloads.
+func pullSecretChecksum(cl client.Client, namespace string, names []string) (string, error) {
+	h := sha256.New()
+	for _, name := range names {
+		var secret v1.Secret
+		err := cl.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, &secret)
+		if apierrs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error fetching secret %s/%s: %s", namespace, name, err.Error())
+		}
+		if _, ok := secret.Labels[crdv1.OwnerLabel]; !ok {
+			continue
+		}
+		var keys []string
+		for key := range secret.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(h, "%s\n", name)
+		for _, key := range keys {
+			fmt.Fprintf(h, "%s\n%s\n", key, secret.Data[key])
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"time"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/test"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("RestartWorkloads", func() {
+	ns := "restart-workloads"
+	secretName := types.NamespacedName{Namespace: ns, Name: "pull-token"}
+	secretLabels := map[string]string{crdv1.OwnerLabel: "restart-workloads"}
+
+	makeDeployment := func(name string, labels map[string]string) {
+		podLabels := map[string]string{"app": name}
+		err := k8sClient.Create(context.Background(), &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: labels},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: podLabels},
+				Template: v1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+					Spec: v1.PodSpec{
+						ImagePullSecrets: []v1.LocalObjectReference{{Name: secretName.Name}},
+						Containers:       []v1.Container{{Name: "app", Image: "nginx"}},
+					},
+				},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	templateAnnotations := func(name string) map[string]string {
+		var deploy appsv1.Deployment
+		err := k8sClient.Get(context.Background(), types.NamespacedName{Namespace: ns, Name: name}, &deploy)
+		Expect(err).ToNot(HaveOccurred())
+		return deploy.Spec.Template.Annotations
+	}
+
+	updateSecret := func(token string) {
+		secret := v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: secretName.Name, Labels: secretLabels},
+			Data:       map[string][]byte{"token": []byte(token)},
+		}
+		err := k8sClient.Update(context.Background(), &secret)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		test.EnsureNamespace(k8sClient, ns)
+		err := k8sClient.Create(context.Background(), &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: secretName.Name, Labels: secretLabels},
+			Data:       map[string][]byte{"token": []byte("1")},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		makeDeployment("selected", map[string]string{"restart": "true"})
+		makeDeployment("ignored", nil)
+	})
+
+	AfterEach(func() {
+		test.DeleteSecret(k8sClient, ns, secretName.Name)
+		for _, name := range []string{"selected", "ignored"} {
+			err := k8sClient.Delete(context.Background(), &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+			})
+			Expect(err).ToNot(HaveOccurred())
+		}
+	})
+
+	It("should restart selected workloads after the secret changed", func() {
+		cfg := &crdv1.RolloutRestart{
+			Selector:    &metav1.LabelSelector{MatchLabels: map[string]string{"restart": "true"}},
+			MinInterval: &metav1.Duration{Duration: 0},
+		}
+
+		// secret did not change: nothing to do
+		_, err := RestartWorkloads(k8sClient, cfg, secretName, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(templateAnnotations("selected")).To(BeEmpty())
+
+		// secret changed
+		_, err = RestartWorkloads(k8sClient, cfg, secretName, true)
+		Expect(err).ToNot(HaveOccurred())
+		annotations := templateAnnotations("selected")
+		Expect(annotations).To(HaveKey(crdv1.PullSecretChecksumAnnotation))
+		Expect(annotations).To(HaveKey(crdv1.RestartedAtAnnotation))
+		Expect(templateAnnotations("ignored")).To(BeEmpty())
+		checksum := annotations[crdv1.PullSecretChecksumAnnotation]
+
+		// checksum is up to date
+		_, err = RestartWorkloads(k8sClient, cfg, secretName, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(templateAnnotations("selected")).To(Equal(annotations))
+
+		// pending restarts are picked up in subsequent calls
+		updateSecret("2")
+		_, err = RestartWorkloads(k8sClient, cfg, secretName, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(templateAnnotations("selected")[crdv1.PullSecretChecksumAnnotation]).ToNot(Equal(checksum))
+	})
+
+	It("should not restart workloads more often than the min interval", func() {
+		cfg := &crdv1.RolloutRestart{
+			MinInterval: &metav1.Duration{Duration: time.Hour},
+		}
+		_, err := RestartWorkloads(k8sClient, cfg, secretName, true)
+		Expect(err).ToNot(HaveOccurred())
+		annotations := templateAnnotations("ignored")
+		Expect(annotations).To(HaveKey(crdv1.PullSecretChecksumAnnotation))
+
+		updateSecret("2")
+		wait, err := RestartWorkloads(k8sClient, cfg, secretName, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(templateAnnotations("ignored")).To(Equal(annotations))
+		Expect(wait).To(BeNumerically(">", 50*time.Minute))
+		Expect(wait).To(BeNumerically("<=", time.Hour))
+	})
+
+	It("should restart workloads if a restart is pending", func() {
+		cfg := &crdv1.RolloutRestart{
+			MinInterval: &metav1.Duration{Duration: 0},
+		}
+		var secret v1.Secret
+		err := k8sClient.Get(context.Background(), secretName, &secret)
+		Expect(err).ToNot(HaveOccurred())
+		secret.Annotations = map[string]string{crdv1.RestartPendingAnnotation: "true"}
+		err = k8sClient.Update(context.Background(), &secret)
+		Expect(err).ToNot(HaveOccurred())
+
+		wait, err := RestartWorkloads(k8sClient, cfg, secretName, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(wait).To(BeZero())
+		Expect(templateAnnotations("selected")).To(HaveKey(crdv1.PullSecretChecksumAnnotation))
+		Expect(templateAnnotations("ignored")).To(HaveKey(crdv1.PullSecretChecksumAnnotation))
+
+		err = k8sClient.Get(context.Background(), secretName, &secret)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(secret.Annotations).ToNot(HaveKey(crdv1.RestartPendingAnnotation))
+	})
+
+	It("should only hash secrets which are managed by harbor-sync", func() {
+		err := k8sClient.Create(context.Background(), &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "unmanaged"},
+			Data:       map[string][]byte{"token": []byte("1")},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer test.DeleteSecret(k8sClient, ns, "unmanaged")
+
+		managed, err := pullSecretChecksum(k8sClient, ns, []string{secretName.Name})
+		Expect(err).ToNot(HaveOccurred())
+		all, err := pullSecretChecksum(k8sClient, ns, []string{secretName.Name, "unmanaged"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(all).To(Equal(managed))
+	})
+})
@@ -17,6 +17,7 @@ limitations under the License.
 package reconciler
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -24,19 +25,32 @@ import (
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"github.com/moolen/harbor-sync/pkg/harbor"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 )
 
 const robotPrefix = "robot$"
 
+// rotationSuffix is appended to the suffix of the robot account by staged rotations, see RotateRobotAccount
+const rotationSuffix = "-next"
+
+// ErrNoRobotAccount is returned by RotateRobotAccount if the project has no robot account
+// with stored credentials which could be replaced
+var ErrNoRobotAccount = errors.New("no robot account with credentials to rotate")
+
 // CredentialStore is an interface that is used to store the credentials
 type CredentialStore interface {
 	Has(project, name string) bool
 	Get(project, name string) (*crdv1.RobotAccountCredential, error)
 	Set(project string, cred crdv1.RobotAccountCredential) error
+	Delete(project, name string) error
 	Reset() error
 }
 
-// ReconcileRobotAccounts ensures that the required robot accounts exist in the given project
+// ReconcileRobotAccounts ensures that the required robot accounts exist in the given project.
+// The robot account is rotated if the rotation interval has passed or if it has been created
+// before rotateBefore, a zero rotateBefore is ignored.
+// Deleting and creating a robot account consumes a token of the budget each. If the budget is
+// exhausted nothing is changed and a *ratelimit.DeferredError is returned.
 func ReconcileRobotAccounts(
 	harborAPI harbor.API,
 	creds CredentialStore,
@@ -44,6 +58,8 @@ func ReconcileRobotAccounts(
 	accountSuffix string,
 	pushAccess bool,
 	rotationInterval time.Duration,
+	rotateBefore time.Time,
+	budget *ratelimit.Budget,
 ) (*crdv1.RobotAccountCredential, bool, error) {
 	robots, err := harborAPI.GetRobotAccounts(project)
 	if err != nil {
@@ -54,79 +70,48 @@ func ReconcileRobotAccounts(
 		"project_name":   project.Name,
 		"robot_accounts": len(robots),
 	}).Info("found robot accounts")
+	robot, leftovers := currentRobotAccount(robots, creds, project, accountSuffix)
+	deleteLeftovers(harborAPI, creds, project, leftovers)
+	// reserved is true if the token for creating the robot account has been consumed
+	reserved := false
 	// check if we manage the credentials for this robot account
 	// if we do not have them we first delete, then re-create the robot account
-	for _, robot := range robots {
+	if robot != nil {
 		log.WithFields(log.Fields{
-			"project_name":   project.Name,
-			"robot_account":  robot.Name,
-			"account_suffix": accountSuffix,
-		}).Info("trying to match robot account")
+			"project_name":  project.Name,
+			"robot_account": robot.Name,
+		}).Info("robot account already exists")
+		haveCredentials := creds.Has(project.Name, robot.Name)
+		existingCreds, _ := creds.Get(project.Name, robot.Name)
 
-		// only one robot account will match
-		if matchRobotAccount(robot, project, accountSuffix) {
+		if !haveCredentials {
+			// case: robot account exists in harbor, but we do not have the credentials: re-create!
 			log.WithFields(log.Fields{
 				"project_name":  project.Name,
 				"robot_account": robot.Name,
-			}).Info("robot account already exists")
-			haveCredentials := creds.Has(project.Name, robot.Name)
-			existingCreds, _ := creds.Get(project.Name, robot.Name)
-
-			// case: robot account exists in harbor, but we do not have the credentials: re-create!
-			if !haveCredentials {
-				log.WithFields(log.Fields{
-					"project_name":  project.Name,
-					"robot_account": robot.Name,
-				}).Info("store does not have credentials, deleting robot account")
-				err = harborAPI.DeleteRobotAccount(project, robot.ID)
-				if err != nil {
-					return nil, false, fmt.Errorf("could not delete robot account: %s", err.Error())
-				}
-				break
-			}
-
+			}).Info("store does not have credentials, deleting robot account")
+		} else if robot.Disabled {
 			// case: robot is disabled: re-create
-			if robot.Disabled == true {
-				log.WithFields(log.Fields{
-					"project_name":  project.Name,
-					"robot_account": robot.Name,
-				}).Info("robot account is disabled, deleting it")
-				err = harborAPI.DeleteRobotAccount(project, robot.ID)
-				if err != nil {
-					return nil, false, fmt.Errorf("could not delete robot account: %s", err.Error())
-				}
-				break
-			}
-
+			log.WithFields(log.Fields{
+				"project_name":  project.Name,
+				"robot_account": robot.Name,
+			}).Info("robot account is disabled, deleting it")
+		} else if shouldRotate(*robot, rotationInterval, rotateBefore) {
 			// we can not tell what permissions a robot account has
 			// hence we have to rely on a rotation of the robot
-			if shouldRotate(robot, rotationInterval) {
-				log.WithFields(log.Fields{
-					"project_name":  project.Name,
-					"robot_account": robot.Name,
-				}).Info("robot account should rotate, deleting it")
-				err = harborAPI.DeleteRobotAccount(project, robot.ID)
-				if err != nil {
-					return nil, false, fmt.Errorf("could not delete robot account: %s", err.Error())
-				}
-				break
-			}
-
+			log.WithFields(log.Fields{
+				"project_name":  project.Name,
+				"robot_account": robot.Name,
+			}).Info("robot account should rotate, deleting it")
+		} else if expiresSoon(*robot, rotationInterval) {
 			// case: robot will expires soon: re-create
 			// TODO: implement token regeneration API once it is upstream available:
 			// https://github.com/goharbor/harbor/issues/8405
-			if expiresSoon(robot, rotationInterval) {
-				log.WithFields(log.Fields{
-					"project_name":  project.Name,
-					"robot_account": robot.Name,
-				}).Info("robot account expires soon, deleting it")
-				err = harborAPI.DeleteRobotAccount(project, robot.ID)
-				if err != nil {
-					return nil, false, fmt.Errorf("could not delete robot account: %s", err.Error())
-				}
-				break
-			}
-
+			log.WithFields(log.Fields{
+				"project_name":  project.Name,
+				"robot_account": robot.Name,
+			}).Info("robot account expires soon, deleting it")
+		} else {
 			// good case: we have the credentials. do not re-create
 			log.WithFields(log.Fields{
 				"project_name":  project.Name,
@@ -134,8 +119,16 @@ func ReconcileRobotAccounts(
 			}).Info("found credentials in store. will not delete robot account")
 			return existingCreds, false, nil
 		}
+		err = recreate(harborAPI, project, *robot, budget)
+		if err != nil {
+			return nil, false, err
+		}
+		reserved = true
 	}
 
+	if !reserved && !budget.Allow(1) {
+		return nil, false, budget.Defer(1)
+	}
 	log.WithFields(log.Fields{
 		"project_name":         project.Name,
 		"robot_account_suffix": accountSuffix,
@@ -163,11 +156,355 @@ func ReconcileRobotAccounts(
 	return &cred, true, nil
 }
 
+// recreate deletes the robot account so that it can be created again.
+// The tokens for deleting and creating the robot account are consumed at once
+// to not leave the project without robot account if the budget is exhausted in between.
+func recreate(harborAPI harbor.API, project harbor.Project, robot harbor.Robot, budget *ratelimit.Budget) error {
+	if !budget.Allow(2) {
+		return budget.Defer(2)
+	}
+	err := harborAPI.DeleteRobotAccount(project, robot.ID)
+	if err != nil {
+		return fmt.Errorf("could not delete robot account: %s", err.Error())
+	}
+	return nil
+}
+
+// VerificationError is returned by RotateRobotAccount if the replacement robot account
+// failed the verification. The previous robot account and its credentials are kept.
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("credentials failed the verification: %s", e.Err.Error())
+}
+
+// RotateRobotAccount replaces the robot account with the given suffix without revoking it first.
+// The replacement is created under the alternate name of the robot account, see alternateSuffix,
+// and verified with verify. Only if the verification succeeds the previous robot account is deleted
+// and its credentials are replaced in the store. Otherwise the replacement is deleted, the previous
+// robot account stays valid and its credentials are returned with a *VerificationError.
+// Creating and deleting a robot account consumes a token of the budget each. If the budget is
+// exhausted nothing is changed and a *ratelimit.DeferredError is returned.
+func RotateRobotAccount(
+	harborAPI harbor.API,
+	creds CredentialStore,
+	project harbor.Project,
+	accountSuffix string,
+	pushAccess bool,
+	budget *ratelimit.Budget,
+	verify func(crdv1.RobotAccountCredential) error,
+) (*crdv1.RobotAccountCredential, error) {
+	robots, err := harborAPI.GetRobotAccounts(project)
+	if err != nil {
+		return nil, fmt.Errorf("could not get robot accounts from harbor")
+	}
+	previous, leftovers := currentRobotAccount(robots, creds, project, accountSuffix)
+	if previous == nil || !creds.Has(project.Name, previous.Name) {
+		return nil, ErrNoRobotAccount
+	}
+	previousCred, err := creds.Get(project.Name, previous.Name)
+	if err != nil {
+		return nil, err
+	}
+	deleteLeftovers(harborAPI, creds, project, leftovers)
+	if !budget.Allow(2) {
+		return nil, budget.Defer(2)
+	}
+	suffix := alternateSuffix(*previous, project, accountSuffix)
+	logger := log.WithFields(log.Fields{
+		"project_name":  project.Name,
+		"robot_account": previous.Name,
+	})
+	logger.Infof("creating replacement robot account with suffix %s", suffix)
+	res, err := harborAPI.CreateRobotAccount(suffix, pushAccess, project)
+	if err != nil {
+		return nil, fmt.Errorf("could not create robot account: %w", err)
+	}
+	cred := crdv1.RobotAccountCredential{
+		Name:      res.Name,
+		CreatedAt: time.Now().UTC().Unix(),
+		Token:     res.Token,
+	}
+	err = verify(cred)
+	if err != nil {
+		logger.Errorf("replacement robot account failed the verification, deleting it: %s", err.Error())
+		robots, listErr := harborAPI.GetRobotAccounts(project)
+		if listErr != nil {
+			return nil, fmt.Errorf("could not get robot accounts from harbor")
+		}
+		for _, robot := range robots {
+			if robot.Name != previous.Name && matchRobotAccount(robot, project, accountSuffix) {
+				deleteErr := harborAPI.DeleteRobotAccount(project, robot.ID)
+				if deleteErr != nil {
+					logger.Errorf("could not delete replacement robot account: %s", deleteErr.Error())
+				}
+			}
+		}
+		return previousCred, &VerificationError{Err: err}
+	}
+	err = creds.Set(project.Name, cred)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("replacement robot account passed the verification, deleting the previous robot account")
+	// the previous robot account is left over if it can not be deleted now, see deleteLeftovers
+	err = harborAPI.DeleteRobotAccount(project, previous.ID)
+	if err != nil {
+		logger.Errorf("could not delete robot account: %s", err.Error())
+		return &cred, nil
+	}
+	if previous.Name != cred.Name {
+		err = creds.Delete(project.Name, previous.Name)
+		if err != nil {
+			logger.Errorf("could not delete credentials from store: %s", err.Error())
+		}
+	}
+	return &cred, nil
+}
+
+// currentRobotAccount returns the robot account with the given suffix which is in use and the robot accounts
+// with the suffix which are left over, e.g. from an interrupted rotation. The robot account whose stored
+// credentials have been created last is in use. It returns nil if no robot account has the suffix.
+func currentRobotAccount(robots []harbor.Robot, creds CredentialStore, project harbor.Project, accountSuffix string) (*harbor.Robot, []harbor.Robot) {
+	var current *harbor.Robot
+	var currentCreatedAt int64
+	var leftovers []harbor.Robot
+	for i := range robots {
+		robot := robots[i]
+		if !matchRobotAccount(robot, project, accountSuffix) {
+			continue
+		}
+		var createdAt int64
+		if cred, err := creds.Get(project.Name, robot.Name); err == nil && creds.Has(project.Name, robot.Name) {
+			createdAt = cred.CreatedAt
+		}
+		if current == nil {
+			current = &robot
+			currentCreatedAt = createdAt
+			continue
+		}
+		if createdAt > currentCreatedAt {
+			leftovers = append(leftovers, *current)
+			current = &robot
+			currentCreatedAt = createdAt
+			continue
+		}
+		leftovers = append(leftovers, robot)
+	}
+	return current, leftovers
+}
+
+// deleteLeftovers deletes robot accounts which are left over from an interrupted rotation
+// and their credentials. Errors are logged, the robot accounts are deleted with the next reconciliation.
+func deleteLeftovers(harborAPI harbor.API, creds CredentialStore, project harbor.Project, leftovers []harbor.Robot) {
+	for _, robot := range leftovers {
+		logger := log.WithFields(log.Fields{
+			"project_name":  project.Name,
+			"robot_account": robot.Name,
+		})
+		logger.Info("deleting left over robot account")
+		err := harborAPI.DeleteRobotAccount(project, robot.ID)
+		if err != nil {
+			logger.Errorf("could not delete robot account: %s", err.Error())
+			continue
+		}
+		err = creds.Delete(project.Name, robot.Name)
+		if err != nil {
+			logger.Errorf("could not delete credentials from store: %s", err.Error())
+		}
+	}
+}
+
+// MissingCredentials returns the projects in which the robot account with the given suffix
+// exists in harbor but its credentials are missing from the store.
+// It also returns the number of projects in which the robot account exists.
+// ReconcileRobotAccounts would re-create the robot accounts in the returned projects.
+func MissingCredentials(
+	harborAPI harbor.API,
+	creds CredentialStore,
+	projects []harbor.Project,
+	accountSuffix string,
+) ([]harbor.Project, int, error) {
+	var missing []harbor.Project
+	var existing int
+	for _, project := range projects {
+		robots, err := harborAPI.GetRobotAccounts(project)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not get robot accounts from harbor")
+		}
+		robot, _ := currentRobotAccount(robots, creds, project, accountSuffix)
+		if robot == nil {
+			continue
+		}
+		existing++
+		if !creds.Has(project.Name, robot.Name) {
+			missing = append(missing, project)
+		}
+	}
+	return missing, existing, nil
+}
+
+// RotationDue returns the current credentials of the robot account with the given suffix
+// if ReconcileRobotAccounts would rotate it because the rotation interval has passed, it has been created
+// before rotateBefore or it expires soon.
+// It returns nil if the robot account is not due or if it would be re-created for another reason,
+// e.g. because it is disabled or its credentials are missing.
+func RotationDue(
+	harborAPI harbor.API,
+	creds CredentialStore,
+	project harbor.Project,
+	accountSuffix string,
+	rotationInterval time.Duration,
+	rotateBefore time.Time,
+) (*crdv1.RobotAccountCredential, error) {
+	robots, err := harborAPI.GetRobotAccounts(project)
+	if err != nil {
+		return nil, fmt.Errorf("could not get robot accounts from harbor")
+	}
+	robot, _ := currentRobotAccount(robots, creds, project, accountSuffix)
+	if robot == nil || robot.Disabled || !creds.Has(project.Name, robot.Name) {
+		return nil, nil
+	}
+	if !shouldRotate(*robot, rotationInterval, rotateBefore) && !expiresSoon(*robot, rotationInterval) {
+		return nil, nil
+	}
+	return creds.Get(project.Name, robot.Name)
+}
+
+// FindRobotAccount returns the robot account with the given suffix which is in use.
+// It returns nil if the robot account does not exist.
+func FindRobotAccount(
+	harborAPI harbor.API,
+	creds CredentialStore,
+	project harbor.Project,
+	accountSuffix string,
+) (*harbor.Robot, error) {
+	robots, err := harborAPI.GetRobotAccounts(project)
+	if err != nil {
+		return nil, fmt.Errorf("could not get robot accounts from harbor")
+	}
+	robot, _ := currentRobotAccount(robots, creds, project, accountSuffix)
+	return robot, nil
+}
+
+// ExpiresWithin returns true if the robot account expires within the given duration.
+// Robot accounts which never expire have no expiry date.
+func ExpiresWithin(robot harbor.Robot, within time.Duration) bool {
+	return robot.ExpiresAt > 0 && expiresSoon(robot, within)
+}
+
+// DeleteRobotAccounts revokes the robot accounts with the given suffix
+// in the project and deletes their credentials from the store
+func DeleteRobotAccounts(
+	harborAPI harbor.API,
+	creds CredentialStore,
+	project harbor.Project,
+	accountSuffix string,
+) error {
+	robots, err := harborAPI.GetRobotAccounts(project)
+	if err != nil {
+		return fmt.Errorf("could not get robot accounts from harbor")
+	}
+	for _, robot := range robots {
+		if !matchRobotAccount(robot, project, accountSuffix) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"project_name":  project.Name,
+			"robot_account": robot.Name,
+		}).Info("deleting robot account")
+		err = harborAPI.DeleteRobotAccount(project, robot.ID)
+		if err != nil {
+			return fmt.Errorf("could not delete robot account: %s", err.Error())
+		}
+		err = creds.Delete(project.Name, robot.Name)
+		if err != nil {
+			return fmt.Errorf("could not delete credentials from store: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// GetCredentials returns the stored credentials of the robot account with the given suffix
+// in the project which have been created last. It returns nil if the store does not have credentials.
+func GetCredentials(creds CredentialStore, project harbor.Project, accountSuffix string) (*crdv1.RobotAccountCredential, error) {
+	var current *crdv1.RobotAccountCredential
+	for _, name := range robotAccountNames(project, accountSuffix) {
+		if !creds.Has(project.Name, name) {
+			continue
+		}
+		cred, err := creds.Get(project.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || cred.CreatedAt > current.CreatedAt {
+			current = cred
+		}
+	}
+	return current, nil
+}
+
+// DeleteCredentials deletes the credentials of the robot account with the given suffix
+// from the store. It is used for projects which have been removed from harbor:
+// the robot accounts are gone with the project, only the credentials are left.
+func DeleteCredentials(creds CredentialStore, project harbor.Project, accountSuffix string) error {
+	for _, name := range robotAccountNames(project, accountSuffix) {
+		err := creds.Delete(project.Name, name)
+		if err != nil {
+			return fmt.Errorf("could not delete credentials from store: %s", err.Error())
+		}
+	}
+	return nil
+}
+
 func addPrefix(str string) string {
 	return robotPrefix + str
 }
 
+// robotAccountNames returns the names the robot account with the given suffix may have:
+// it may have been created with or without the project name and with the alternate suffix
+func robotAccountNames(project harbor.Project, accountSuffix string) []string {
+	var names []string
+	for _, suffix := range []string{accountSuffix, accountSuffix + rotationSuffix} {
+		names = append(names,
+			addPrefix(suffix),
+			addPrefix(fmt.Sprintf("%s+%s", project.Name, suffix)),
+		)
+	}
+	return names
+}
+
+// alternateSuffix returns the suffix of the replacement of the robot account in a staged rotation.
+// The robot account alternates between the suffix and the suffix with rotationSuffix appended,
+// so that the replacement can be created before the previous robot account is deleted.
+func alternateSuffix(robot harbor.Robot, project harbor.Project, accountSuffix string) string {
+	if matchRobotName(robot, project, accountSuffix) {
+		return accountSuffix + rotationSuffix
+	}
+	return accountSuffix
+}
+
+// SuffixesOverlap returns true if the robot accounts with the suffixes a and b may have the same name.
+// This is the case if the suffixes are equal or if one of them is the other one with rotationSuffix
+// appended: the robot accounts of a staged rotation carry both suffixes.
+func SuffixesOverlap(a, b string) bool {
+	return a == b || a+rotationSuffix == b || b+rotationSuffix == a
+}
+
+// MatchRobotAccount returns true if the robot account has been created
+// in the project with the given suffix
+func MatchRobotAccount(robot harbor.Robot, project harbor.Project, accountSuffix string) bool {
+	return matchRobotAccount(robot, project, accountSuffix)
+}
+
 func matchRobotAccount(robot harbor.Robot, project harbor.Project, accountSuffix string) bool {
+	return matchRobotName(robot, project, accountSuffix) ||
+		matchRobotName(robot, project, accountSuffix+rotationSuffix)
+}
+
+func matchRobotName(robot harbor.Robot, project harbor.Project, accountSuffix string) bool {
 	// pre global-robot-accounts (2.2.0+)
 	if robot.Name == addPrefix(accountSuffix) {
 		return true
@@ -182,7 +519,7 @@ func matchRobotAccount(robot harbor.Robot, project harbor.Project, accountSuffix
 	return false
 }
 
-func shouldRotate(robot harbor.Robot, interval time.Duration) bool {
+func shouldRotate(robot harbor.Robot, interval time.Duration, rotateBefore time.Time) bool {
 	created, err := time.Parse(time.RFC3339Nano, robot.CreationTime)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -191,6 +528,9 @@ func shouldRotate(robot harbor.Robot, interval time.Duration) bool {
 		}).Errorf("error parsing time: %s\n", err.Error())
 		return true
 	}
+	if created.Before(rotateBefore) {
+		return true
+	}
 	return created.UTC().Add(interval).Before(time.Now().UTC())
 }
 
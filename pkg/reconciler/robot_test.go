@@ -17,11 +17,13 @@ limitations under the License.
 package reconciler
 
 import (
+	"errors"
 	"time"
 
 	crdv1 "github.com/moolen/harbor-sync/api/v1"
 	"github.com/moolen/harbor-sync/pkg/harbor"
 	harborfake "github.com/moolen/harbor-sync/pkg/harbor/fake"
+	"github.com/moolen/harbor-sync/pkg/ratelimit"
 	store "github.com/moolen/harbor-sync/pkg/store/disk"
 	"github.com/moolen/harbor-sync/pkg/test"
 	. "github.com/onsi/ginkgo"
@@ -80,6 +82,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeTrue())
@@ -102,6 +106,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeFalse())
@@ -113,6 +119,76 @@ var _ = Describe("Controller", func() {
 			Expect(cacheCreds.Token).To(Equal("bar"))
 		})
 
+		It("should rotate robot accounts created before rotateBefore", func() {
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cfg", "my-project", &mapping, nil)
+			credStore.Set("foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "bar"})
+			var deleteCalled bool
+			harborClient.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleteCalled = true
+				return nil
+			}
+			rotateBefore, _ := time.Parse(time.RFC3339, "2222-01-02T15:04:06Z")
+			credentials, changed, err := ReconcileRobotAccounts(
+				harborClient,
+				credStore,
+				harborProject,
+				cfg.Spec.RobotAccountSuffix,
+				false,
+				time.Hour*1,
+				rotateBefore,
+				nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeTrue())
+			Expect(deleteCalled).To(BeTrue())
+			Expect(credentials.Token).To(Equal(createdAccount.Token))
+
+			// robot accounts created afterwards are kept
+			credStore.Set("foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "bar"})
+			deleteCalled = false
+			rotateBefore, _ = time.Parse(time.RFC3339, "2222-01-02T15:04:05Z")
+			credentials, changed, err = ReconcileRobotAccounts(
+				harborClient,
+				credStore,
+				harborProject,
+				cfg.Spec.RobotAccountSuffix,
+				false,
+				time.Hour*1,
+				rotateBefore,
+				nil,
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changed).To(BeFalse())
+			Expect(deleteCalled).To(BeFalse())
+			Expect(credentials.Token).To(Equal("bar"))
+		})
+
+		It("should defer deleting the robot account when the budget is exhausted", func() {
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cfg", "my-project", &mapping, nil)
+			var deleteCalled bool
+			harborClient.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleteCalled = true
+				return nil
+			}
+			budget := ratelimit.NewBudget("robot", 1, 2)
+			Expect(budget.Allow(1)).To(BeTrue())
+			_, changed, err := ReconcileRobotAccounts(
+				harborClient,
+				credStore,
+				harborProject,
+				cfg.Spec.RobotAccountSuffix,
+				false,
+				time.Hour*1,
+				time.Time{},
+				budget,
+			)
+			var deferred *ratelimit.DeferredError
+			Expect(errors.As(err, &deferred)).To(BeTrue())
+			Expect(deferred.RetryAfter).To(BeNumerically(">", 30*time.Second))
+			Expect(changed).To(BeFalse())
+			Expect(deleteCalled).To(BeFalse())
+		})
+
 		It("should delete robot account when credentials are missing", func() {
 			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cfg", "my-project", &mapping, nil)
 			var deleteCalled bool
@@ -127,6 +203,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeTrue())
@@ -164,6 +242,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeTrue())
@@ -200,6 +280,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeTrue())
@@ -236,6 +318,8 @@ var _ = Describe("Controller", func() {
 				cfg.Spec.RobotAccountSuffix,
 				false,
 				time.Hour*1,
+				time.Time{},
+				nil,
 			)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(changed).To(BeTrue())
@@ -247,5 +331,97 @@ var _ = Describe("Controller", func() {
 			Expect(cacheCreds.Name).To(Equal(createdAccount.Name))
 			Expect(cacheCreds.Token).To(Equal(createdAccount.Token))
 		})
+
+		It("should delete the previous account once the replacement is verified", func() {
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cfg", "my-project", &mapping, nil)
+			harborClient.GetRobotAccountsFunc = func(project harbor.Project) ([]harbor.Robot, error) {
+				return []harbor.Robot{
+					{
+						ID:           1,
+						Name:         "robot$sync-bot",
+						CreationTime: time.Now().UTC().Add(-time.Hour * 2).Format(time.RFC3339Nano),
+						ExpiresAt:    time.Now().UTC().Add(time.Hour * 24).Unix(),
+					},
+				}, nil
+			}
+			var createdName string
+			harborClient.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				createdName = name
+				return &harbor.CreateRobotResponse{Name: "robot$" + name, Token: "5678"}, nil
+			}
+			var deleted []int
+			harborClient.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, robotID)
+				return nil
+			}
+			credStore.Set("foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "bar"})
+			credentials, err := RotateRobotAccount(
+				harborClient,
+				credStore,
+				harborProject,
+				cfg.Spec.RobotAccountSuffix,
+				false,
+				nil,
+				func(cred crdv1.RobotAccountCredential) error {
+					Expect(cred.Token).To(Equal("5678"))
+					return nil
+				},
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(createdName).To(Equal("sync-bot-next"))
+			Expect(deleted).To(Equal([]int{1}))
+			Expect(credentials.Name).To(Equal("robot$sync-bot-next"))
+			Expect(credentials.Token).To(Equal("5678"))
+			Expect(credStore.Has("foo", "robot$sync-bot")).To(BeFalse())
+			Expect(credStore.Has("foo", "robot$sync-bot-next")).To(BeTrue())
+		})
+
+		It("should keep the previous account if the replacement fails the verification", func() {
+			cfg := test.EnsureHarborSyncConfigWithParams(k8sClient, "my-cfg", "my-project", &mapping, nil)
+			robots := []harbor.Robot{
+				{
+					ID:           1,
+					Name:         "robot$sync-bot",
+					CreationTime: time.Now().UTC().Add(-time.Hour * 2).Format(time.RFC3339Nano),
+					ExpiresAt:    time.Now().UTC().Add(time.Hour * 24).Unix(),
+				},
+			}
+			harborClient.GetRobotAccountsFunc = func(project harbor.Project) ([]harbor.Robot, error) {
+				return robots, nil
+			}
+			harborClient.CreateRobotAccountFunc = func(name string, pushAccess bool, project harbor.Project) (*harbor.CreateRobotResponse, error) {
+				robots = append(robots, harbor.Robot{
+					ID:           2,
+					Name:         "robot$" + name,
+					CreationTime: time.Now().UTC().Format(time.RFC3339Nano),
+					ExpiresAt:    time.Now().UTC().Add(time.Hour * 24).Unix(),
+				})
+				return &harbor.CreateRobotResponse{Name: "robot$" + name, Token: "5678"}, nil
+			}
+			var deleted []int
+			harborClient.DeleteRobotAccountFunc = func(project harbor.Project, robotID int) error {
+				deleted = append(deleted, robotID)
+				return nil
+			}
+			credStore.Set("foo", crdv1.RobotAccountCredential{Name: "robot$sync-bot", Token: "bar"})
+			credentials, err := RotateRobotAccount(
+				harborClient,
+				credStore,
+				harborProject,
+				cfg.Spec.RobotAccountSuffix,
+				false,
+				nil,
+				func(cred crdv1.RobotAccountCredential) error {
+					return errors.New("unauthorized")
+				},
+			)
+			var verificationErr *VerificationError
+			Expect(errors.As(err, &verificationErr)).To(BeTrue())
+			Expect(deleted).To(Equal([]int{2}))
+			Expect(credentials.Name).To(Equal("robot$sync-bot"))
+			Expect(credentials.Token).To(Equal("bar"))
+			Expect(credStore.Has("foo", "robot$sync-bot")).To(BeTrue())
+			Expect(credStore.Has("foo", "robot$sync-bot-next")).To(BeFalse())
+		})
 	})
 })
@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/harbor"
+)
+
+// MatchServiceAccount returns true if the selector selects the given ServiceAccount
+func MatchServiceAccount(selector *crdv1.ServiceAccountSelector, sa v1.ServiceAccount) (bool, error) {
+	if selector == nil {
+		return false, nil
+	}
+	if contains(selector.Names, sa.Name) {
+		return true, nil
+	}
+	if selector.Selector == nil {
+		return false, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(selector.Selector)
+	if err != nil {
+		return false, fmt.Errorf("invalid label selector: %s", err.Error())
+	}
+	return sel.Matches(labels.Set(sa.Labels)), nil
+}
+
+// ServiceAccountPullSecrets returns the names of the secrets that the given
+// ServiceAccount should reference as imagePullSecrets according to the sync config.
+// Only secrets which exist and are owned by the sync config are referenced:
+// secrets must contain the secrets in the namespace of the ServiceAccount.
+func ServiceAccountPullSecrets(syncConfig crdv1.HarborSync, secrets []v1.Secret, sa v1.ServiceAccount) ([]string, error) {
+	var names []string
+	for _, mapping := range syncConfig.Spec.Mapping {
+		ok, err := MatchServiceAccount(mapping.ServiceAccounts, sa)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		for _, secret := range secrets {
+			project := secret.Annotations[crdv1.ProjectAnnotation]
+			if secret.Labels[crdv1.OwnerLabel] != syncConfig.ObjectMeta.Name || project == "" {
+				continue
+			}
+			targets, err := MappingTargets(mapping, syncConfig, harbor.Project{Name: project}, []string{sa.Namespace})
+			if err != nil {
+				return nil, err
+			}
+			for _, target := range targets {
+				if target.Name == secret.Name && !contains(names, secret.Name) {
+					names = append(names, secret.Name)
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// UpdateServiceAccountPullSecrets makes sure that the ServiceAccount references the desired secrets.
+// Secrets which have been added by harbor-sync earlier but are no longer desired are removed.
+// imagePullSecrets which were not added by harbor-sync are left untouched.
+func UpdateServiceAccountPullSecrets(cl client.Client, sa v1.ServiceAccount, desired []string) error {
+	managed := parsePullSecretsAnnotation(sa.Annotations[crdv1.ImagePullSecretsAnnotation])
+	var newManaged []string
+	var pullSecrets []v1.LocalObjectReference
+	for _, ref := range sa.ImagePullSecrets {
+		if contains(managed, ref.Name) && !contains(desired, ref.Name) {
+			continue
+		}
+		if contains(managed, ref.Name) {
+			newManaged = append(newManaged, ref.Name)
+		}
+		pullSecrets = append(pullSecrets, ref)
+	}
+	for _, name := range desired {
+		if containsRef(pullSecrets, name) {
+			continue
+		}
+		pullSecrets = append(pullSecrets, v1.LocalObjectReference{Name: name})
+		newManaged = append(newManaged, name)
+	}
+	sort.Strings(newManaged)
+	annotation := strings.Join(newManaged, ",")
+
+	if annotation == sa.Annotations[crdv1.ImagePullSecretsAnnotation] && len(pullSecrets) == len(sa.ImagePullSecrets) {
+		return nil
+	}
+
+	patch := client.MergeFrom(sa.DeepCopy())
+	sa.ImagePullSecrets = pullSecrets
+	if sa.Annotations == nil {
+		sa.Annotations = make(map[string]string)
+	}
+	if annotation == "" {
+		delete(sa.Annotations, crdv1.ImagePullSecretsAnnotation)
+	} else {
+		sa.Annotations[crdv1.ImagePullSecretsAnnotation] = annotation
+	}
+	err := cl.Patch(context.Background(), &sa, patch)
+	if err != nil {
+		return fmt.Errorf("could not patch service account %s/%s: %s", sa.Namespace, sa.Name, err.Error())
+	}
+	return nil
+}
+
+func parsePullSecretsAnnotation(val string) []string {
+	var out []string
+	for _, name := range strings.Split(val, ",") {
+		if name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func containsRef(refs []v1.LocalObjectReference, name string) bool {
+	for _, ref := range refs {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
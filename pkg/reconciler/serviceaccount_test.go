@@ -0,0 +1,165 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"context"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+	"github.com/moolen/harbor-sync/pkg/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("ServiceAccount", func() {
+
+	Describe("ServiceAccountPullSecrets", func() {
+		cfg := crdv1.HarborSync{
+			Spec: crdv1.HarborSyncSpec{
+				Type:        crdv1.RegexMatching,
+				ProjectName: "team-(.*)",
+				Mapping: []crdv1.ProjectMapping{
+					{
+						Type:      crdv1.TranslateMappingType,
+						Namespace: "$1",
+						Secret:    "$1-pull-token",
+						ServiceAccounts: &crdv1.ServiceAccountSelector{
+							Names: []string{"default"},
+						},
+					},
+					{
+						Type:      crdv1.MatchMappingType,
+						Namespace: "shared",
+						Secret:    "$1-shared-token",
+						ServiceAccounts: &crdv1.ServiceAccountSelector{
+							Selector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{"pull": "shared"},
+							},
+						},
+					},
+					{
+						Type:      crdv1.MatchMappingType,
+						Namespace: ".*",
+						Secret:    "$1-unattached",
+					},
+				},
+			},
+		}
+		cfg.ObjectMeta.Name = "my-sa-cfg"
+		ownedSecret := func(namespace, name, owner, project string) v1.Secret {
+			return v1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        name,
+				Labels:      map[string]string{crdv1.OwnerLabel: owner},
+				Annotations: map[string]string{crdv1.ProjectAnnotation: project},
+			}}
+		}
+		secrets := []v1.Secret{
+			ownedSecret("foo", "foo-pull-token", "my-sa-cfg", "team-foo"),
+			ownedSecret("foo", "foo-unattached", "my-sa-cfg", "team-foo"),
+			ownedSecret("shared", "foo-shared-token", "my-sa-cfg", "team-foo"),
+			ownedSecret("shared", "bar-shared-token", "my-sa-cfg", "team-bar"),
+			ownedSecret("shared", "baz-shared-token", "other-cfg", "team-baz"),
+		}
+
+		It("should select service accounts by name", func() {
+			sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "default"}}
+			secrets, err := ServiceAccountPullSecrets(cfg, secrets[:2], sa)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secrets).To(Equal([]string{"foo-pull-token"}))
+		})
+
+		It("should select service accounts by label", func() {
+			sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "shared",
+				Name:      "builder",
+				Labels:    map[string]string{"pull": "shared"},
+			}}
+			secrets, err := ServiceAccountPullSecrets(cfg, secrets[2:], sa)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secrets).To(Equal([]string{"foo-shared-token", "bar-shared-token"}))
+		})
+
+		It("should only reference existing secrets", func() {
+			sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "bar", Name: "default"}}
+			secrets, err := ServiceAccountPullSecrets(cfg, nil, sa)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secrets).To(BeEmpty())
+		})
+
+		It("should not select other service accounts", func() {
+			sa := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "builder"}}
+			secrets, err := ServiceAccountPullSecrets(cfg, secrets[:2], sa)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(secrets).To(BeEmpty())
+		})
+	})
+
+	Describe("UpdateServiceAccountPullSecrets", func() {
+		ns := "sa-pull-secrets"
+
+		BeforeEach(func() {
+			test.EnsureNamespace(k8sClient, ns)
+		})
+
+		AfterEach(func() {
+			test.DeleteNamespace(k8sClient, ns)
+		})
+
+		getSA := func() v1.ServiceAccount {
+			var sa v1.ServiceAccount
+			err := k8sClient.Get(context.Background(), types.NamespacedName{Namespace: ns, Name: "builder"}, &sa)
+			Expect(err).ToNot(HaveOccurred())
+			return sa
+		}
+
+		It("should add and remove only managed pull secrets", func() {
+			sa := v1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: "builder"},
+				ImagePullSecrets: []v1.LocalObjectReference{
+					{Name: "user-secret"},
+					{Name: "shared-secret"},
+				},
+			}
+			err := k8sClient.Create(context.Background(), &sa)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = UpdateServiceAccountPullSecrets(k8sClient, getSA(), []string{"shared-secret", "synced-secret"})
+			Expect(err).ToNot(HaveOccurred())
+			sa = getSA()
+			Expect(sa.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{
+				{Name: "user-secret"},
+				{Name: "shared-secret"},
+				{Name: "synced-secret"},
+			}))
+			Expect(sa.Annotations[crdv1.ImagePullSecretsAnnotation]).To(Equal("synced-secret"))
+
+			err = UpdateServiceAccountPullSecrets(k8sClient, getSA(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			sa = getSA()
+			Expect(sa.ImagePullSecrets).To(Equal([]v1.LocalObjectReference{
+				{Name: "user-secret"},
+				{Name: "shared-secret"},
+			}))
+			Expect(sa.Annotations).ToNot(HaveKey(crdv1.ImagePullSecretsAnnotation))
+		})
+	})
+})
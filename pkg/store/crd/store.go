@@ -90,6 +90,20 @@ func (s *Store) Set(project string, cred crdv1.RobotAccountCredential) error {
 	return err
 }
 
+func (s *Store) Delete(project, name string) error {
+	rname, err := BuildResourceName(project, name)
+	if err != nil {
+		return err
+	}
+	err = s.kubeClient.Delete(context.Background(), &crdv1.HarborRobotAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: rname},
+	})
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("could not delete robot account %s: %s", rname, err)
+	}
+	return nil
+}
+
 func (s *Store) Reset() error {
 	ctx := context.Background()
 	r := crdv1.HarborRobotAccount{}
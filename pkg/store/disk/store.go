@@ -63,7 +63,9 @@ func (d *Store) Has(project, name string) bool {
 // Get returns a item
 func (d *Store) Get(project, name string) (*crdv1.RobotAccountCredential, error) {
 	var cred crdv1.RobotAccountCredential
-	rd, err := d.c.ReadStream(path.Join(project, name), true)
+	// a direct read uncaches the item asynchronously which corrupts the cache size
+	// if the item is erased in the meantime. All writes go through diskv, the cache is up to date.
+	rd, err := d.c.ReadStream(path.Join(project, name), false)
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +90,15 @@ func (d *Store) Set(project string, cred crdv1.RobotAccountCredential) error {
 	return d.c.Write(path.Join(project, cred.Name), data)
 }
 
+// Delete removes an item from the disk store
+func (d *Store) Delete(project, name string) error {
+	key := path.Join(project, name)
+	if !d.c.Has(key) {
+		return nil
+	}
+	return d.c.Erase(key)
+}
+
 // Keys returns all available keys
 func (d *Store) Keys() [][]string {
 	var keys [][]string
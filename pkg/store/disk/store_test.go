@@ -85,6 +85,20 @@ func TestStore(t *testing.T) {
 		t.Errorf("unexpected key")
 	}
 
+	// delete foo
+	err = c.Delete("foo", "robot$foo")
+	if err != nil {
+		t.Error(err)
+	}
+	if c.Has("foo", "robot$foo") {
+		t.Errorf("expected key to not exist")
+	}
+	// deleting a missing key is a no-op
+	err = c.Delete("foo", "robot$foo")
+	if err != nil {
+		t.Error(err)
+	}
+
 	//
 	// delete all entries
 	//
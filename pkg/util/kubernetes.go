@@ -16,32 +16,37 @@ package util
 import (
 	log "github.com/sirupsen/logrus"
 	clientv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
-	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	kube_record "k8s.io/client-go/tools/record"
 )
 
+// EventSource is the component of the recorded events
+const EventSource = "harbor-sync"
+
 const (
 	// Rate of refill for the event spam filter in client go
 	// 1 per event key per 5 minutes.
 	defaultQPS = 1. / 300.
 	// Number of events allowed per event key before rate limiting is triggered
-	// Has to greater than or equal to 1.
-	defaultBurstSize = 1
+	// Has to greater than or equal to 1. A reconciliation records
+	// several events on the same object, e.g. one per matched project.
+	defaultBurstSize = 25
 	// Number of distinct event keys in the rate limiting cache.
 	defaultLRUCache = 8192
 )
 
-// CreateEventRecorder creates an event recorder to send custom events to Kubernetes to be recorded for targeted Kubernetes objects
-func CreateEventRecorder(kubeClient clientset.Interface) kube_record.EventRecorder {
+// CreateEventRecorder creates an event recorder to send custom events to Kubernetes to be recorded for targeted Kubernetes objects.
+// The scheme must contain the types of the objects.
+func CreateEventRecorder(kubeClient clientset.Interface, scheme *runtime.Scheme) kube_record.EventRecorder {
 	eventBroadcaster := kube_record.NewBroadcasterWithCorrelatorOptions(getCorrelationOptions())
 	eventBroadcaster.StartLogging(log.Infof)
 	if _, isfake := kubeClient.(*fake.Clientset); !isfake {
 		eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(kubeClient.CoreV1().RESTClient()).Events("")})
 	}
-	return eventBroadcaster.NewRecorder(scheme.Scheme, clientv1.EventSource{Component: "cluster-autoscaler"})
+	return eventBroadcaster.NewRecorder(scheme, clientv1.EventSource{Component: EventSource})
 }
 
 func getCorrelationOptions() kube_record.CorrelatorOptions {
@@ -20,6 +20,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"reflect"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -27,6 +28,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // MakeSecret creates a v1.Secret with type dockerconfigjson from the given credentials
@@ -45,20 +47,58 @@ func MakeSecret(namespace, name string, baseURL string, credentials crdv1.RobotA
 	}
 }
 
-// UpsertSecret creates or updates the specified secret
-func UpsertSecret(cl client.Client, secret v1.Secret) error {
-	err := cl.Create(context.Background(), &secret)
-	if apierrs.IsAlreadyExists(err) {
-		err = cl.Update(context.Background(), &secret)
+// UpsertSecret creates or updates the specified secret.
+// Labels and annotations of the specified secret are merged into the existing ones.
+// It returns true if the secret has been created or its data has changed
+func UpsertSecret(cl client.Client, secret v1.Secret) (bool, error) {
+	var existing v1.Secret
+	err := cl.Get(context.Background(), types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}, &existing)
+	if apierrs.IsNotFound(err) {
+		err = cl.Create(context.Background(), &secret)
 		if err != nil {
-			return fmt.Errorf("could not update secret: %s/%s", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name)
+			return false, fmt.Errorf("could not create secret %s/%s: %w", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err)
 		}
-		return nil
+		return true, nil
 	}
 	if err != nil {
-		return fmt.Errorf("could not create secret %s/%s: %s", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err.Error())
+		return false, fmt.Errorf("could not fetch secret %s/%s: %s", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err.Error())
+	}
+	dataChanged := existing.Type != secret.Type || !reflect.DeepEqual(existing.Data, secret.Data)
+	if !dataChanged && containsAll(existing.Labels, secret.Labels) && containsAll(existing.Annotations, secret.Annotations) {
+		return false, nil
+	}
+	existing.Type = secret.Type
+	existing.Data = secret.Data
+	existing.Labels = merge(existing.Labels, secret.Labels)
+	existing.Annotations = merge(existing.Annotations, secret.Annotations)
+	err = cl.Update(context.Background(), &existing)
+	if err != nil {
+		return false, fmt.Errorf("could not update secret %s/%s: %w", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name, err)
+	}
+	return dataChanged, nil
+}
+
+// containsAll returns true if all key/value pairs of b are contained in a
+func containsAll(a, b map[string]string) bool {
+	for k, v := range b {
+		if val, ok := a[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
+func merge(dst, src map[string]string) map[string]string {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]string)
+	}
+	for k, v := range src {
+		dst[k] = v
 	}
-	return nil
+	return dst
 }
 
 func ignoreNotFound(err error) error {
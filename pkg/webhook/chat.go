@@ -0,0 +1,148 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+// fact is a line of a chat message
+type fact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// chatTitles are the titles of the chat messages per event type
+var chatTitles = map[crdv1.WebhookEventType]string{
+	crdv1.RobotRotatedEvent:     "Robot account rotated",
+	crdv1.RobotExpiringEvent:    "Robot account expires soon",
+	crdv1.ReconcileFailedEvent:  "Reconciliation failed",
+	crdv1.ProjectMatchedEvent:   "Project matched",
+	crdv1.ProjectUnmatchedEvent: "Project no longer matches",
+	crdv1.SecretDeletedEvent:    "Secret deleted",
+}
+
+// chatMessage returns the title and the facts of the event. The token is never included.
+func chatMessage(ev Event) (string, []fact) {
+	title, ok := chatTitles[ev.Type]
+	if !ok {
+		title = string(ev.Type)
+	}
+	var facts []fact
+	add := func(name, value string) {
+		if value != "" {
+			facts = append(facts, fact{Name: name, Value: value})
+		}
+	}
+	switch data := ev.Data.(type) {
+	case crdv1.WebhookUpdatePayload:
+		add("HarborSync", data.HarborSync)
+		add("Project", data.Project)
+		add("Robot account", data.Credentials.Name)
+		if data.Credentials.CreatedAt > 0 {
+			add("Created", formatUnix(data.Credentials.CreatedAt))
+		}
+		add("Namespaces", strings.Join(data.Namespaces, ", "))
+	case *crdv1.WebhookEventPayload:
+		add("HarborSync", data.HarborSync)
+		add("Project", data.Project)
+		add("Robot account", data.RobotAccount)
+		if data.ExpiresAt > 0 {
+			add("Expires", formatUnix(data.ExpiresAt))
+		}
+		if data.Secret != "" {
+			add("Secret", fmt.Sprintf("%s/%s", data.Namespace, data.Secret))
+		}
+		add("Error", data.Error)
+	default:
+		add("Project", ev.Subject)
+	}
+	return title, facts
+}
+
+func formatUnix(sec int64) string {
+	return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+}
+
+// slackMessage is the payload of a Slack incoming webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// mattermostMessage is the payload of a Mattermost incoming webhook
+type mattermostMessage struct {
+	Username string `json:"username"`
+	Text     string `json:"text"`
+}
+
+// teamsMessage is a message card for a Microsoft Teams incoming webhook
+type teamsMessage struct {
+	Type     string         `json:"@type"`
+	Context  string         `json:"@context"`
+	Summary  string         `json:"summary"`
+	Title    string         `json:"title"`
+	Sections []teamsSection `json:"sections"`
+}
+
+type teamsSection struct {
+	Facts []fact `json:"facts"`
+}
+
+// encodeChat returns the message of the event in the format of the chat system
+func encodeChat(format crdv1.WebhookFormat, ev Event) ([]byte, error) {
+	title, facts := chatMessage(ev)
+	var msg interface{}
+	switch format {
+	case crdv1.SlackWebhookFormat:
+		lines := []string{fmt.Sprintf("*%s*", slackEscape(title))}
+		for _, f := range facts {
+			lines = append(lines, fmt.Sprintf("*%s:* %s", f.Name, slackEscape(f.Value)))
+		}
+		msg = slackMessage{Text: strings.Join(lines, "\n")}
+	case crdv1.MattermostWebhookFormat:
+		lines := []string{fmt.Sprintf("**%s**", title)}
+		for _, f := range facts {
+			lines = append(lines, fmt.Sprintf("**%s:** %s", f.Name, f.Value))
+		}
+		msg = mattermostMessage{Username: "harbor-sync", Text: strings.Join(lines, "\n")}
+	case crdv1.TeamsWebhookFormat:
+		msg = teamsMessage{
+			Type:     "MessageCard",
+			Context:  "https://schema.org/extensions",
+			Summary:  title,
+			Title:    title,
+			Sections: []teamsSection{{Facts: facts}},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported chat format: %s", format)
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chat message: %s", err.Error())
+	}
+	return body, nil
+}
+
+// slackEscape escapes the control characters of Slack messages
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// Encrypt encrypts the plaintext to the PEM encoded RSA or EC public key
+// and returns the JWE in compact serialization
+func Encrypt(publicKey string, plaintext []byte) (string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return "", fmt.Errorf("could not decode encryption key: no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("could not parse encryption key: %s", err.Error())
+	}
+	var alg jose.KeyAlgorithm
+	switch key.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return "", fmt.Errorf("unsupported encryption key type %T, use an RSA or EC key", key)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: key}, (&jose.EncrypterOptions{}).WithContentType("application/json"))
+	if err != nil {
+		return "", fmt.Errorf("could not create encrypter: %s", err.Error())
+	}
+	obj, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		return "", fmt.Errorf("could not encrypt payload: %s", err.Error())
+	}
+	return obj.CompactSerialize()
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+const (
+	// CloudEventsSpecVersion is the version of the CloudEvents specification
+	CloudEventsSpecVersion = "1.0"
+
+	jsonContentType        = "application/json"
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// Event is a webhook event. The attributes are used as CloudEvents attributes.
+type Event struct {
+	// ID identifies the event, it does not change if the event is sent again
+	ID string
+
+	Type crdv1.WebhookEventType
+
+	// Source identifies the HarborSync which emitted the event
+	Source string
+
+	// Subject is the project the event is about
+	Subject string
+
+	Time time.Time
+
+	// Data is the payload of the event, it is encoded as JSON
+	Data interface{}
+}
+
+// Source returns the event source of the HarborSync with the given name
+func Source(syncConfigName string) string {
+	return fmt.Sprintf("/apis/%s/%s/harborsyncs/%s", crdv1.GroupVersion.Group, crdv1.GroupVersion.Version, syncConfigName)
+}
+
+// cloudEvent is a CloudEvent in structured content mode
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// encode returns the headers and the body of the request for the event in the given format
+func encode(format crdv1.WebhookFormat, ev Event) (http.Header, []byte, error) {
+	header := http.Header{}
+	switch format {
+	case crdv1.SlackWebhookFormat, crdv1.MattermostWebhookFormat, crdv1.TeamsWebhookFormat:
+		body, err := encodeChat(format, ev)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Content-Type", jsonContentType)
+		return header, body, nil
+	}
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode webhook payload: %s", err.Error())
+	}
+	switch format {
+	case "", crdv1.JSONWebhookFormat:
+		header.Set("Content-Type", jsonContentType)
+		return header, data, nil
+	case crdv1.CloudEventsStructuredWebhookFormat:
+		body, err := json.Marshal(cloudEvent{
+			SpecVersion:     CloudEventsSpecVersion,
+			ID:              ev.ID,
+			Type:            string(ev.Type),
+			Source:          ev.Source,
+			Subject:         ev.Subject,
+			Time:            ev.Time.UTC().Format(time.RFC3339),
+			DataContentType: jsonContentType,
+			Data:            data,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode cloud event: %s", err.Error())
+		}
+		header.Set("Content-Type", cloudEventsContentType)
+		return header, body, nil
+	case crdv1.CloudEventsBinaryWebhookFormat:
+		header.Set("Content-Type", jsonContentType)
+		header.Set("ce-specversion", CloudEventsSpecVersion)
+		header.Set("ce-id", ev.ID)
+		header.Set("ce-type", string(ev.Type))
+		header.Set("ce-source", ev.Source)
+		if ev.Subject != "" {
+			header.Set("ce-subject", ev.Subject)
+		}
+		header.Set("ce-time", ev.Time.UTC().Format(time.RFC3339))
+		return header, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported webhook format: %s", format)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+const (
+	// SignatureHeader contains the HMAC-SHA256 signature of the payload
+	SignatureHeader = "X-Harbor-Sync-Signature"
+
+	// DefaultTimeout is the timeout of a single request
+	DefaultTimeout = time.Second * 10
+)
+
+// Sender sends webhooks. Secrets referenced by the webhook config are read with the client.
+type Sender struct {
+	client.Client
+
+	// AllowedNamespaces contains the namespaces of the secrets which may be referenced.
+	// HarborSyncs are cluster-scoped, secrets in other namespaces are not read
+	// so that their values can not be sent to arbitrary endpoints.
+	AllowedNamespaces []string
+}
+
+// NewSender returns a sender which reads secrets in the allowed namespaces with the given client
+func NewSender(cl client.Client, allowedNamespaces []string) *Sender {
+	return &Sender{
+		Client:            cl,
+		AllowedNamespaces: allowedNamespaces,
+	}
+}
+
+// Send posts the event in the format of the webhook config to its endpoint once. Failed requests are not retried,
+// the caller must send the event again. It returns the status code of the response, 0 if there was none.
+func (s *Sender) Send(cfg crdv1.WebhookConfig, ev Event) (int, error) {
+	header, payload, err := encode(cfg.Format, ev)
+	if err != nil {
+		return 0, err
+	}
+	err = s.addHeaders(cfg, header, payload)
+	if err != nil {
+		return 0, err
+	}
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return post(httpClient, cfg.Endpoint, header, payload)
+}
+
+// addHeaders adds the configured headers, authentication and signature to the headers of the request.
+// Configured headers may not replace the headers set by harbor-sync, see reservedHeader.
+func (s *Sender) addHeaders(cfg crdv1.WebhookConfig, header http.Header, payload []byte) error {
+	header.Set("User-Agent", "harbor-sync")
+	for _, h := range cfg.Headers {
+		if reservedHeader(cfg, h.Name) {
+			return fmt.Errorf("header %s is set by harbor-sync and may not be configured", h.Name)
+		}
+		value := h.Value
+		if h.ValueFrom != nil {
+			v, err := s.secretValue(*h.ValueFrom)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		header.Set(h.Name, value)
+	}
+	if cfg.Auth != nil && cfg.Auth.Bearer != nil {
+		token, err := s.secretValue(*cfg.Auth.Bearer)
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if cfg.Auth != nil && cfg.Auth.Basic != nil {
+		ref := *cfg.Auth.Basic
+		username, err := s.secretValue(crdv1.SecretKeyReference{Namespace: ref.Namespace, Name: ref.Name, Key: v1.BasicAuthUsernameKey})
+		if err != nil {
+			return err
+		}
+		password, err := s.secretValue(crdv1.SecretKeyReference{Namespace: ref.Namespace, Name: ref.Name, Key: v1.BasicAuthPasswordKey})
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+	if cfg.SigningSecret != nil {
+		key, err := s.secretValue(*cfg.SigningSecret)
+		if err != nil {
+			return err
+		}
+		header.Set(SignatureHeader, Sign([]byte(key), payload))
+	}
+	return nil
+}
+
+// reservedHeader returns true if the header is set by harbor-sync:
+// the content type, the CloudEvents attributes, the user agent, the signature
+// and the authorization if the webhook config has authentication.
+func reservedHeader(cfg crdv1.WebhookConfig, name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	switch {
+	case name == "Content-Type", name == "User-Agent", name == http.CanonicalHeaderKey(SignatureHeader):
+		return true
+	case strings.HasPrefix(name, "Ce-"):
+		return true
+	case name == "Authorization":
+		return cfg.Auth != nil
+	}
+	return false
+}
+
+// secretValue returns the value of the referenced key. The secret must be in one of the allowed namespaces.
+func (s *Sender) secretValue(ref crdv1.SecretKeyReference) (string, error) {
+	if !s.allowed(ref.Namespace) {
+		return "", fmt.Errorf("secret %s/%s may not be referenced: only secrets in the namespaces %v are allowed", ref.Namespace, ref.Name, s.AllowedNamespaces)
+	}
+	var secret v1.Secret
+	err := s.Get(context.Background(), types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, &secret)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch secret %s/%s: %s", ref.Namespace, ref.Name, err.Error())
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", ref.Namespace, ref.Name, ref.Key)
+	}
+	return string(value), nil
+}
+
+// allowed returns true if secrets in the namespace may be referenced
+func (s *Sender) allowed(namespace string) bool {
+	for _, ns := range s.AllowedNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the HMAC-SHA256 signature of the payload as it is sent in the SignatureHeader
+func Sign(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newHTTPClient returns a client with the timeout and the CA bundle of the webhook config
+func newHTTPClient(cfg crdv1.WebhookConfig) (*http.Client, error) {
+	timeout := DefaultTimeout
+	if cfg.Timeout != nil {
+		timeout = cfg.Timeout.Duration
+	}
+	c := &http.Client{Timeout: timeout}
+	if len(cfg.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.CABundle) {
+			return nil, fmt.Errorf("could not parse CA bundle of webhook %s", cfg.Endpoint)
+		}
+		c.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return c, nil
+}
+
+func post(httpClient *http.Client, endpoint string, header http.Header, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("could not create request: %s", err.Error())
+	}
+	req.Header = header.Clone()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending webhook to %s: %s", endpoint, err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected http response code: %d for %s", res.StatusCode, endpoint)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,466 @@
+/*
+Copyright 2019 The Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	crdv1 "github.com/moolen/harbor-sync/api/v1"
+)
+
+var testEvent = Event{
+	ID:      "42",
+	Type:    crdv1.RobotRotatedEvent,
+	Source:  Source("my-cfg"),
+	Subject: "team-foo",
+	Time:    time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+	Data:    map[string]string{"project": "team-foo"},
+}
+
+func newTestSender() *Sender {
+	cl := fake.NewClientBuilder().WithObjects(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "webhook"},
+			Data: map[string][]byte{
+				"key":   []byte("signing-key"),
+				"token": []byte("my-token"),
+				"team":  []byte("platform"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "basic"},
+			Data: map[string][]byte{
+				"username": []byte("alice"),
+				"password": []byte("secret"),
+			},
+		},
+	).Build()
+	return NewSender(cl, []string{"default"})
+}
+
+func TestSendSignedRequest(t *testing.T) {
+	payload := []byte(`{"project":"foo"}`)
+	ev := Event{Data: map[string]string{"project": "foo"}}
+	var header http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	code, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Headers: []crdv1.WebhookHeader{
+			{Name: "X-Static", Value: "static"},
+			{Name: "X-Team", ValueFrom: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "team"}},
+		},
+		Auth: &crdv1.WebhookAuth{
+			Bearer: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "token"},
+		},
+		SigningSecret: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "key"},
+	}, ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("unexpected code: %d", code)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if header.Get(SignatureHeader) != Sign([]byte("signing-key"), payload) {
+		t.Errorf("unexpected signature: %s", header.Get(SignatureHeader))
+	}
+	if header.Get("Authorization") != "Bearer my-token" {
+		t.Errorf("unexpected authorization: %s", header.Get("Authorization"))
+	}
+	if header.Get("X-Static") != "static" || header.Get("X-Team") != "platform" {
+		t.Errorf("unexpected headers: %#v", header)
+	}
+	if header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected content type: %s", header.Get("Content-Type"))
+	}
+}
+
+func TestSendBasicAuth(t *testing.T) {
+	var username, password string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	defer srv.Close()
+
+	_, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Auth: &crdv1.WebhookAuth{
+			Basic: &crdv1.SecretReference{Namespace: "default", Name: "basic"},
+		},
+	}, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || password != "secret" {
+		t.Errorf("unexpected credentials: %s:%s", username, password)
+	}
+}
+
+func TestSendMissingSecret(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	_, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint:      srv.URL,
+		SigningSecret: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "missing"},
+	}, testEvent)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if calls != 0 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+}
+
+func TestSendReservedHeaders(t *testing.T) {
+	calls := 0
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		header = r.Header
+	}))
+	defer srv.Close()
+
+	bearer := &crdv1.WebhookAuth{Bearer: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "token"}}
+	for _, cfg := range []crdv1.WebhookConfig{
+		{Endpoint: srv.URL, Headers: []crdv1.WebhookHeader{{Name: "content-type", Value: "text/plain"}}},
+		{Endpoint: srv.URL, Headers: []crdv1.WebhookHeader{{Name: "User-Agent", Value: "curl"}}},
+		{Endpoint: srv.URL, Headers: []crdv1.WebhookHeader{{Name: "ce-id", Value: "1"}}},
+		{Endpoint: srv.URL, Headers: []crdv1.WebhookHeader{{Name: SignatureHeader, Value: "sha256=00"}}},
+		{Endpoint: srv.URL, Auth: bearer, Headers: []crdv1.WebhookHeader{{Name: "Authorization", Value: "Bearer other"}}},
+	} {
+		_, err := newTestSender().Send(cfg, testEvent)
+		if err == nil || !strings.Contains(err.Error(), "may not be configured") {
+			t.Errorf("expected error for %s, got %v", cfg.Headers[0].Name, err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+
+	// the authorization may be configured as header if the webhook has no authentication
+	_, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Headers:  []crdv1.WebhookHeader{{Name: "Authorization", Value: "Token static"}},
+	}, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization") != "Token static" {
+		t.Errorf("unexpected authorization: %s", header.Get("Authorization"))
+	}
+}
+
+func TestSendSecretNotAllowed(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+
+	s := newTestSender()
+	s.AllowedNamespaces = []string{"harbor-sync"}
+	for _, cfg := range []crdv1.WebhookConfig{
+		{Endpoint: srv.URL, SigningSecret: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "key"}},
+		{Endpoint: srv.URL, Headers: []crdv1.WebhookHeader{{Name: "X-Team", ValueFrom: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "team"}}}},
+		{Endpoint: srv.URL, Auth: &crdv1.WebhookAuth{Bearer: &crdv1.SecretKeyReference{Namespace: "default", Name: "webhook", Key: "token"}}},
+		{Endpoint: srv.URL, Auth: &crdv1.WebhookAuth{Basic: &crdv1.SecretReference{Namespace: "default", Name: "basic"}}},
+	} {
+		_, err := s.Send(cfg, testEvent)
+		if err == nil || !strings.Contains(err.Error(), "may not be referenced") {
+			t.Errorf("expected error, got %v", err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+}
+
+func TestSendOnce(t *testing.T) {
+	for _, code := range []int{400, 500, 503} {
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			calls++
+		}))
+
+		res, err := newTestSender().Send(crdv1.WebhookConfig{Endpoint: srv.URL}, testEvent)
+		srv.Close()
+		if err == nil {
+			t.Errorf("expected error for code %d", code)
+		}
+		if res != code {
+			t.Errorf("unexpected code: %d", res)
+		}
+		if calls != 1 {
+			t.Errorf("unexpected calls for code %d: %d", code, calls)
+		}
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 200)
+	}))
+	defer srv.Close()
+
+	code, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Timeout:  &metav1.Duration{Duration: time.Millisecond * 20},
+	}, testEvent)
+	if err == nil {
+		t.Fatal("expected timeout")
+	}
+	if code != 0 {
+		t.Errorf("unexpected code: %d", code)
+	}
+}
+
+func TestSendCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := crdv1.WebhookConfig{Endpoint: srv.URL}
+	_, err := newTestSender().Send(cfg, testEvent)
+	if err == nil {
+		t.Fatal("expected unknown authority error")
+	}
+
+	cfg.CABundle = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	_, err = newTestSender().Send(cfg, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.CABundle = []byte("invalid")
+	_, err = newTestSender().Send(cfg, testEvent)
+	if err == nil {
+		t.Fatal("expected invalid bundle error")
+	}
+}
+
+func TestSendCloudEvents(t *testing.T) {
+	var header http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	_, err := newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Format:   crdv1.CloudEventsStructuredWebhookFormat,
+	}, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Content-Type") != "application/cloudevents+json" {
+		t.Errorf("unexpected content type: %s", header.Get("Content-Type"))
+	}
+	var structured map[string]interface{}
+	if err := json.Unmarshal(body, &structured); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              "42",
+		"type":            "io.harborsync.robot.rotated",
+		"source":          "/apis/crd.harborsync.io/v1/harborsyncs/my-cfg",
+		"subject":         "team-foo",
+		"time":            "2020-01-01T10:00:00Z",
+		"datacontenttype": "application/json",
+		"data":            map[string]interface{}{"project": "team-foo"},
+	}
+	if !reflect.DeepEqual(structured, expected) {
+		t.Errorf("unexpected structured event: %s", body)
+	}
+
+	_, err = newTestSender().Send(crdv1.WebhookConfig{
+		Endpoint: srv.URL,
+		Format:   crdv1.CloudEventsBinaryWebhookFormat,
+	}, testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"Content-Type":   "application/json",
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          "42",
+		"Ce-Type":        "io.harborsync.robot.rotated",
+		"Ce-Source":      "/apis/crd.harborsync.io/v1/harborsyncs/my-cfg",
+		"Ce-Subject":     "team-foo",
+		"Ce-Time":        "2020-01-01T10:00:00Z",
+	} {
+		if header.Get(key) != value {
+			t.Errorf("unexpected %s header: %s", key, header.Get(key))
+		}
+	}
+	if string(body) != `{"project":"team-foo"}` {
+		t.Errorf("unexpected binary event data: %s", body)
+	}
+}
+
+func TestSendChatFormats(t *testing.T) {
+	var header http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	rotated := testEvent
+	rotated.Data = crdv1.WebhookUpdatePayload{
+		Version:    crdv1.WebhookPayloadVersion,
+		Type:       crdv1.RobotRotatedEvent,
+		HarborSync: "my-cfg",
+		Project:    "team-foo",
+		Credentials: crdv1.WebhookCredentials{
+			Name:      "robot$sync-bot",
+			CreatedAt: 1577872800,
+			Token:     "super-secret-token",
+		},
+		Namespaces: []string{"team-a", "team-b"},
+	}
+	failed := testEvent
+	failed.Type = crdv1.ReconcileFailedEvent
+	failed.Data = &crdv1.WebhookEventPayload{
+		Version:    crdv1.WebhookPayloadVersion,
+		Type:       crdv1.ReconcileFailedEvent,
+		HarborSync: "my-cfg",
+		Error:      "harbor <unavailable>",
+	}
+
+	for _, tc := range []struct {
+		format   crdv1.WebhookFormat
+		event    Event
+		expected string
+	}{
+		{
+			format:   crdv1.SlackWebhookFormat,
+			event:    rotated,
+			expected: `{"text":"*Robot account rotated*\n*HarborSync:* my-cfg\n*Project:* team-foo\n*Robot account:* robot$sync-bot\n*Created:* 2020-01-01T10:00:00Z\n*Namespaces:* team-a, team-b"}`,
+		},
+		{
+			format:   crdv1.SlackWebhookFormat,
+			event:    failed,
+			expected: `{"text":"*Reconciliation failed*\n*HarborSync:* my-cfg\n*Error:* harbor \u0026lt;unavailable\u0026gt;"}`,
+		},
+		{
+			format:   crdv1.MattermostWebhookFormat,
+			event:    rotated,
+			expected: `{"username":"harbor-sync","text":"**Robot account rotated**\n**HarborSync:** my-cfg\n**Project:** team-foo\n**Robot account:** robot$sync-bot\n**Created:** 2020-01-01T10:00:00Z\n**Namespaces:** team-a, team-b"}`,
+		},
+		{
+			format:   crdv1.TeamsWebhookFormat,
+			event:    failed,
+			expected: `{"@type":"MessageCard","@context":"https://schema.org/extensions","summary":"Reconciliation failed","title":"Reconciliation failed","sections":[{"facts":[{"name":"HarborSync","value":"my-cfg"},{"name":"Error","value":"harbor \u003cunavailable\u003e"}]}]}`,
+		},
+	} {
+		_, err := newTestSender().Send(crdv1.WebhookConfig{
+			Endpoint: srv.URL,
+			Format:   tc.format,
+		}, tc.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: unexpected content type: %s", tc.format, header.Get("Content-Type"))
+		}
+		if string(body) != tc.expected {
+			t.Errorf("%s: unexpected message: %s", tc.format, body)
+		}
+		if strings.Contains(string(body), "super-secret-token") {
+			t.Errorf("%s: message contains the token", tc.format)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []interface{}{rsaKey, ecKey} {
+		var public interface{}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			public = &k.PublicKey
+		case *ecdsa.PrivateKey:
+			public = &k.PublicKey
+		}
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		serialized, err := Encrypt(string(publicPEM), []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := jose.ParseEncrypted(serialized)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := obj.Decrypt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(plaintext) != "secret" {
+			t.Errorf("unexpected plaintext: %s", plaintext)
+		}
+	}
+
+	_, err = Encrypt("invalid", []byte("secret"))
+	if err == nil {
+		t.Error("expected error for invalid key")
+	}
+}